@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// adminHandler serves operational endpoints. It is only reachable on
+// ADMIN_LISTEN_ADDR, so it is never exposed on the proxy port.
+func adminHandler(holder *configHolder) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, holder.Load())
+	})
+	mux.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		serveQueue(w, holder.Load())
+	})
+	return mux
+}
+
+// serveAdmin runs the admin listener in the background. Changing the address
+// requires a restart.
+func serveAdmin(addr string, holder *configHolder) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		log.Println("Admin endpoints listening on", addr)
+		if err := http.ListenAndServe(addr, adminHandler(holder)); err != nil {
+			log.Println("Admin listener:", err)
+		}
+	}()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UPSTREAM_BALANCING values: how a target is chosen from UPSTREAM_TARGETS.
+const BALANCE_ROUND_ROBIN = "round-robin"
+const BALANCE_LEAST_CONNECTIONS = "least-connections"
+
+func parseBalancing(v string) (string, error) {
+	balancing := strings.ToLower(strings.TrimSpace(v))
+	if balancing != BALANCE_ROUND_ROBIN && balancing != BALANCE_LEAST_CONNECTIONS {
+		return "", fmt.Errorf("must be %s or %s", BALANCE_ROUND_ROBIN, BALANCE_LEAST_CONNECTIONS)
+	}
+	return balancing, nil
+}
+
+// parseUpstreamTargets parses comma separated upstream origins such as
+// http://10.0.0.1:2283.
+func parseUpstreamTargets(v string) ([]string, error) {
+	targets := []string{}
+	for _, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if err := validateUpstreamURL(field); err != nil {
+			return nil, fmt.Errorf("%q %w", field, err)
+		}
+		u, _ := url.Parse(field)
+		if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("%q must not have a path or query", field)
+		}
+		targets = append(targets, u.Scheme+"://"+u.Host)
+	}
+	return targets, nil
+}
+
+var (
+	upstreamHealthy = newMetric("upload_proxy_upstream_healthy", "gauge",
+		"1 if the last active health check of an upstream target passed.", "upstream")
+	upstreamActive = newMetric("upload_proxy_upstream_active_requests", "gauge",
+		"Requests in flight to an upstream target.", "upstream")
+)
+
+// upstreamTarget is the state of one of the UPSTREAM_TARGETS. Like circuit
+// breakers it is kept by origin, so it survives config reloads.
+type upstreamTarget struct {
+	origin    string
+	active    atomic.Int64
+	unhealthy atomic.Bool
+	// failures counts consecutive failed requests; after
+	// UPSTREAM_EJECT_THRESHOLD of them the target is skipped until
+	// ejectedUntil (Unix nanoseconds).
+	failures     atomic.Int64
+	ejectedUntil atomic.Int64
+}
+
+var (
+	targetsMu  sync.Mutex
+	targets    = map[string]*upstreamTarget{}
+	nextTarget atomic.Uint64
+)
+
+func targetFor(origin string) *upstreamTarget {
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	t, ok := targets[origin]
+	if !ok {
+		t = &upstreamTarget{origin: origin}
+		targets[origin] = t
+	}
+	return t
+}
+
+// balanced reports whether requests to u are spread over UPSTREAM_TARGETS,
+// which is the case for everything sent to the FORWARD_DESTINATION origin.
+func balanced(cfg *Config, u *url.URL) bool {
+	if len(cfg.UpstreamTargets) == 0 {
+		return false
+	}
+	dest, err := url.Parse(cfg.ForwardDestination)
+	return err == nil && dest.Scheme == u.Scheme && dest.Host == u.Host
+}
+
+// pickTarget returns the origin the next attempt for u is sent to. Targets
+// that failed their health check, were ejected or whose circuit breaker is
+// open are skipped, unless that leaves none.
+func pickTarget(cfg *Config, u *url.URL) *upstreamTarget {
+	if !balanced(cfg, u) {
+		return targetFor(u.Scheme + "://" + u.Host)
+	}
+	now := time.Now()
+	all := make([]*upstreamTarget, 0, len(cfg.UpstreamTargets))
+	candidates := make([]*upstreamTarget, 0, len(cfg.UpstreamTargets))
+	for _, origin := range cfg.UpstreamTargets {
+		t := targetFor(origin)
+		all = append(all, t)
+		target, _ := url.Parse(origin)
+		if !t.unhealthy.Load() && !t.ejected(now) && breakerFor(target).retryAfter(cfg, now) == 0 {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = all
+	}
+
+	start := int(nextTarget.Add(1) % uint64(len(candidates)))
+	picked := candidates[start]
+	if cfg.UpstreamBalancing == BALANCE_LEAST_CONNECTIONS {
+		for i := 1; i < len(candidates); i++ {
+			if t := candidates[(start+i)%len(candidates)]; t.active.Load() < picked.active.Load() {
+				picked = t
+			}
+		}
+	}
+	return picked
+}
+
+// withTarget returns a copy of req sent to the given origin. The Host
+// header is kept, so signed requests stay valid.
+func withTarget(req *http.Request, t *upstreamTarget) *http.Request {
+	origin, _ := url.Parse(t.origin)
+	if origin.Scheme == req.URL.Scheme && origin.Host == req.URL.Host {
+		return req
+	}
+	out := req.WithContext(req.Context())
+	out.URL = new(url.URL)
+	*out.URL = *req.URL
+	out.URL.Scheme, out.URL.Host = origin.Scheme, origin.Host
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	return out
+}
+
+// begin counts a request to t as in flight until its response body is
+// closed.
+func (t *upstreamTarget) begin() func(*http.Response) {
+	upstreamActive.Set(float64(t.active.Add(1)), t.origin)
+	return func(resp *http.Response) {
+		done := func() { upstreamActive.Set(float64(t.active.Add(-1)), t.origin) }
+		if resp == nil {
+			done()
+			return
+		}
+		resp.Body = &doneBody{ReadCloser: resp.Body, done: done}
+	}
+}
+
+// observe records the outcome of a request to t. Failures are counted like
+// by circuit breakers; after UPSTREAM_EJECT_THRESHOLD in a row the target
+// is ejected for UPSTREAM_EJECT_DURATION.
+func (t *upstreamTarget) observe(cfg *Config, req *http.Request, resp *http.Response, err error, now time.Time) {
+	if cfg.UpstreamEjectThreshold <= 0 || (err != nil && req.Context().Err() != nil) {
+		return
+	}
+	if err == nil && !containsStatus(cfg.RetryStatuses, resp.StatusCode) {
+		t.failures.Store(0)
+		return
+	}
+	if n := t.failures.Add(1); n >= int64(cfg.UpstreamEjectThreshold) {
+		t.failures.Store(0)
+		t.ejectedUntil.Store(now.Add(cfg.UpstreamEjectDuration).UnixNano())
+		log.Printf("Upstream target %s ejected for %s after %d consecutive failures", t.origin, cfg.UpstreamEjectDuration, n)
+	}
+}
+
+func (t *upstreamTarget) ejected(now time.Time) bool {
+	return now.UnixNano() < t.ejectedUntil.Load()
+}
+
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *doneBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// upstreamRetryAfter returns how long requests to u are rejected by circuit
+// breakers: that of its own breaker, or for balanced requests the shortest
+// of all targets.
+func upstreamRetryAfter(cfg *Config, u *url.URL) time.Duration {
+	if !balanced(cfg, u) {
+		return breakerFor(u).retryAfter(cfg, time.Now())
+	}
+	var wait time.Duration
+	for i, origin := range cfg.UpstreamTargets {
+		target, _ := url.Parse(origin)
+		w := breakerFor(target).retryAfter(cfg, time.Now())
+		if i == 0 || w < wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// checkTargets sends a GET for UPSTREAM_HEALTH_PATH to every target. Targets
+// that do not answer with a 2xx or 3xx status within the interval are
+// skipped until they pass again.
+func checkTargets(cfg *Config) {
+	timeout := cfg.UpstreamHealthInterval
+	if timeout <= 0 || timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+	var wg sync.WaitGroup
+	for _, origin := range cfg.UpstreamTargets {
+		wg.Add(1)
+		go func(t *upstreamTarget) {
+			defer wg.Done()
+			healthy := cfg.UpstreamHealthPath == "" || checkTarget(t, cfg.UpstreamHealthPath, timeout) == nil
+			if was := !t.unhealthy.Swap(!healthy); was != healthy {
+				if healthy {
+					log.Printf("Upstream target %s is healthy again", t.origin)
+				} else {
+					log.Printf("Upstream target %s failed its health check", t.origin)
+				}
+			}
+			value := 0.0
+			if healthy {
+				value = 1
+			}
+			upstreamHealthy.Set(value, t.origin)
+		}(targetFor(origin))
+	}
+	wg.Wait()
+}
+
+func checkTarget(t *upstreamTarget, path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.origin+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// watchUpstreams runs the active health checks in the background, with the
+// targets, path and interval of the current config.
+func (h *configHolder) watchUpstreams() {
+	go func() {
+		for {
+			cfg := h.Load()
+			if len(cfg.UpstreamTargets) > 0 {
+				checkTargets(cfg)
+			}
+			interval := cfg.UpstreamHealthInterval
+			if interval < time.Second {
+				interval = time.Second
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// targetStatus is the health check view of one upstream target.
+type targetStatus struct {
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	Ejected bool   `json:"ejected"`
+	Active  int64  `json:"active"`
+}
+
+func targetStatuses(cfg *Config) []targetStatus {
+	statuses := make([]targetStatus, 0, len(cfg.UpstreamTargets))
+	now := time.Now()
+	for _, origin := range cfg.UpstreamTargets {
+		t := targetFor(origin)
+		statuses = append(statuses, targetStatus{Target: origin, Healthy: !t.unhealthy.Load(), Ejected: t.ejected(now), Active: t.active.Load()})
+	}
+	return statuses
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// balancedTargets starts n upstreams that count their requests and answer
+// with the status in statuses, and returns a config spreading
+// FORWARD_DESTINATION over them.
+func balancedTargets(t *testing.T, n int) (*Config, []int, []int) {
+	var mu sync.Mutex
+	counts := make([]int, n)
+	statuses := make([]int, n)
+	cfg := defaultConfig()
+	cfg.ForwardDestination = "http://uploads.internal/api/assets"
+	for i := 0; i < n; i++ {
+		i := i
+		statuses[i] = http.StatusCreated
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			counts[i]++
+			mu.Unlock()
+			if r.Method == "POST" && r.Host != "uploads.internal" {
+				t.Errorf("Host = %q, want that of FORWARD_DESTINATION", r.Host)
+			}
+			w.WriteHeader(statuses[i])
+		}))
+		t.Cleanup(upstream.Close)
+		useClient(t, upstream.Client())
+		cfg.UpstreamTargets = append(cfg.UpstreamTargets, upstream.URL)
+	}
+	return cfg, counts, statuses
+}
+
+func sendBalanced(t *testing.T, cfg *Config) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", cfg.ForwardDestination, bytes.NewBufferString("processed"))
+	req.Header.Set("Idempotency-Key", "upload")
+	resp, err := sendUpstream(cfg, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestParseUpstreamTargets(t *testing.T) {
+	targets, err := parseUpstreamTargets(" http://10.0.0.1:2283/, https://upload.example.com ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0] != "http://10.0.0.1:2283" || targets[1] != "https://upload.example.com" {
+		t.Errorf("targets = %q", targets)
+	}
+	for _, v := range []string{"10.0.0.1:2283", "ftp://host", "http://host/api", "http://host?x=1"} {
+		if _, err := parseUpstreamTargets(v); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	cfg, counts, _ := balancedTargets(t, 3)
+	for i := 0; i < 30; i++ {
+		sendBalanced(t, cfg)
+	}
+	for i, count := range counts {
+		if count != 10 {
+			t.Errorf("target %d got %d requests, want 10", i, count)
+		}
+	}
+
+	// Requests to other upstreams are not balanced.
+	if balanced(cfg, &url.URL{Scheme: "http", Host: "other.internal"}) {
+		t.Error("other upstream is balanced")
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	cfg, counts, _ := balancedTargets(t, 2)
+	cfg.UpstreamBalancing = BALANCE_LEAST_CONNECTIONS
+
+	// A response that is still being read keeps its target busy.
+	busy := targetFor(cfg.UpstreamTargets[0])
+	done := busy.begin()
+	for i := 0; i < 4; i++ {
+		sendBalanced(t, cfg)
+	}
+	if counts[0] != 0 || counts[1] != 4 {
+		t.Errorf("requests = %v, want all on the idle target", counts)
+	}
+	done(nil)
+	if busy.active.Load() != 0 {
+		t.Errorf("active = %d after the request ended", busy.active.Load())
+	}
+}
+
+func TestBalancerSkipsFailingTargets(t *testing.T) {
+	cfg, counts, statuses := balancedTargets(t, 2)
+
+	// Targets failing the active health check get no requests.
+	statuses[0] = http.StatusServiceUnavailable
+	cfg.UpstreamHealthPath = "/health"
+	checkTargets(cfg)
+	for i := 0; i < 4; i++ {
+		sendBalanced(t, cfg)
+	}
+	if counts[1] != 5 {
+		t.Errorf("requests = %v, want all but the health check on the healthy target", counts)
+	}
+	statuses[0] = http.StatusCreated
+	checkTargets(cfg)
+	if targetFor(cfg.UpstreamTargets[0]).unhealthy.Load() {
+		t.Error("target still unhealthy after passing its check")
+	}
+
+	// A target that keeps failing is ejected by its circuit breaker, and
+	// retries go to the other one.
+	cfg.UpstreamHealthPath = ""
+	cfg.BreakerThreshold = 1
+	cfg.BreakerCooldown = time.Minute
+	cfg.RetryAttempts = 1
+	cfg.RetryBackoff = time.Millisecond
+	statuses[0] = http.StatusBadGateway
+	counts[0], counts[1] = 0, 0
+	for i := 0; i < 4; i++ {
+		if resp := sendBalanced(t, cfg); resp.StatusCode != http.StatusCreated {
+			t.Errorf("status = %d, want 201 from the other target", resp.StatusCode)
+		}
+	}
+	if counts[0] != 1 || counts[1] != 4 {
+		t.Errorf("requests = %v, want 1 on the failing target", counts)
+	}
+}
+
+func TestBalancerEjectsFailingTargets(t *testing.T) {
+	cfg, counts, statuses := balancedTargets(t, 2)
+	cfg.UpstreamEjectThreshold = 2
+	cfg.UpstreamEjectDuration = time.Minute
+	cfg.RetryAttempts = 1
+	cfg.RetryBackoff = time.Millisecond
+
+	// Without circuit breakers, a target that keeps failing is ejected by
+	// the balancer itself.
+	statuses[0] = http.StatusBadGateway
+	for i := 0; i < 6; i++ {
+		if resp := sendBalanced(t, cfg); resp.StatusCode != http.StatusCreated {
+			t.Errorf("status = %d, want 201 from the other target", resp.StatusCode)
+		}
+	}
+	if counts[0] != 2 || counts[1] != 6 {
+		t.Errorf("requests = %v, want 2 on the failing target", counts)
+	}
+	if statuses := targetStatuses(cfg); !statuses[0].Ejected || statuses[1].Ejected {
+		t.Errorf("statuses = %+v, want the first target ejected", statuses)
+	}
+
+	// Once the ejection ends, the target gets requests again.
+	targetFor(cfg.UpstreamTargets[0]).ejectedUntil.Store(0)
+	statuses[0] = http.StatusCreated
+	counts[0], counts[1] = 0, 0
+	for i := 0; i < 4; i++ {
+		sendBalanced(t, cfg)
+	}
+	if counts[0] != 2 || counts[1] != 2 {
+		t.Errorf("requests = %v, want them spread again", counts)
+	}
+}
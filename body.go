@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// requestBody is an upstream request body assembled from byte slices and
+// uploaded files. The chunks are streamed one after another instead of being
+// copied into one buffer, files straight from their spool file, and Open can
+// be called again to replay the body on a retry.
+type requestBody struct {
+	chunks []bodyChunk
+	size   int64
+	// cleanup runs on Close, e.g. to remove the spool files the body is
+	// read from.
+	cleanup func()
+}
+
+// bodyChunk is either data or a file.
+type bodyChunk struct {
+	data []byte
+	file *spooledFile
+}
+
+func newRequestBody(data []byte) *requestBody {
+	b := &requestBody{}
+	b.add(data)
+	return b
+}
+
+// Write appends a copy of p. multipart.Writer writes part headers and
+// boundaries through it.
+func (b *requestBody) Write(p []byte) (int, error) {
+	b.add(append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// add appends data without copying it. data must not change afterwards.
+func (b *requestBody) add(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b.chunks = append(b.chunks, bodyChunk{data: data})
+	b.size += int64(len(data))
+}
+
+// addFile appends an uploaded file. It is read each time the body is opened,
+// so it must exist until the body is closed.
+func (b *requestBody) addFile(f *spooledFile) {
+	if f.Size == 0 {
+		return
+	}
+	b.chunks = append(b.chunks, bodyChunk{file: f})
+	b.size += f.Size
+}
+
+func (b *requestBody) Len() int64 {
+	return b.size
+}
+
+// Open returns a new reader for the whole body.
+func (b *requestBody) Open() (io.ReadCloser, error) {
+	if b.size == 0 {
+		return http.NoBody, nil
+	}
+	r := &chunkReader{}
+	readers := make([]io.Reader, len(b.chunks))
+	for i, chunk := range b.chunks {
+		if chunk.file == nil {
+			readers[i] = bytes.NewReader(chunk.data)
+			continue
+		}
+		f, err := chunk.file.Open()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.files = append(r.files, f)
+		readers[i] = f
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+// Close releases what the body is read from. Readers opened before may
+// still be in use by the transport; unlinked spool files stay readable
+// until they are closed.
+func (b *requestBody) Close() {
+	if b != nil && b.cleanup != nil {
+		b.cleanup()
+		b.cleanup = nil
+	}
+}
+
+// chunkReader reads a requestBody and closes its files.
+type chunkReader struct {
+	io.Reader
+	files []io.Closer
+}
+
+func (r *chunkReader) Close() error {
+	for _, f := range r.files {
+		f.Close()
+	}
+	return nil
+}
+
+// newBodyRequest is http.NewRequest for a requestBody. Like the in-memory
+// bodies http.NewRequest knows, it sets ContentLength and GetBody.
+func newBodyRequest(method, target string, body *requestBody) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = body.Len()
+	req.GetBody = body.Open
+	req.Body, err = body.Open()
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readRequestBody reads all of body for tests that inspect a rebuilt upload
+// and closes it when the test ends.
+func readRequestBody(t *testing.T, body *requestBody) *bytes.Buffer {
+	t.Helper()
+	t.Cleanup(body.Close)
+	r, err := body.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewBuffer(data)
+}
+
+func TestRequestBody(t *testing.T) {
+	if r, _ := (&requestBody{}).Open(); r != http.NoBody {
+		t.Errorf("empty body = %T, want http.NoBody", r)
+	}
+
+	header := []byte("header;")
+	file := []byte("file")
+	spooled := filepath.Join(t.TempDir(), "spooled")
+	os.WriteFile(spooled, []byte(";spooled"), 0600)
+	body := &requestBody{}
+	body.Write(header)
+	body.add(file)
+	body.addFile(&spooledFile{Size: 8, path: spooled})
+	header[0] = 'X'
+	if body.Len() != 19 {
+		t.Errorf("Len() = %d, want 19", body.Len())
+	}
+	// Each Open starts from the beginning, so the body can be replayed.
+	for i := 0; i < 2; i++ {
+		if got := readRequestBody(t, body).String(); got != "header;file;spooled" {
+			t.Errorf("read %d = %q, want Write to copy and the body to replay", i+1, got)
+		}
+	}
+	if &body.chunks[1].data[0] != &file[0] {
+		t.Error("add copied the data")
+	}
+
+	closed := 0
+	body.cleanup = func() { closed++ }
+	body.Close()
+	body.Close()
+	if closed != 1 {
+		t.Errorf("cleanup ran %d times, want once", closed)
+	}
+}
+
+func TestProxyHandlerRetriesRebuiltBody(t *testing.T) {
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = append(received, string(data))
+		if r.ContentLength != int64(len(data)) {
+			t.Errorf("Content-Length = %d, body has %d bytes", r.ContentLength, len(data))
+		}
+		if len(received) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL + "/api/assets"
+	cfg.RetryAttempts = 1
+	cfg.RetryStatuses = []int{http.StatusServiceUnavailable}
+	cfg.RetryBackoff = time.Millisecond
+	cfg.UploadMemoryLimit = 0
+	cfg.SpoolDir = t.TempDir()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("deviceId", "phone")
+	part, _ := writer.CreateFormFile("assetData", "notes.txt")
+	part.Write(bytes.Repeat([]byte("not an image "), 1000))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/api/assets", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Idempotency-Key", "upload")
+	recorder := httptest.NewRecorder()
+	proxyHandler(recorder, req, cfg)
+
+	if recorder.Code != http.StatusCreated || len(received) != 2 {
+		t.Fatalf("status = %d after %d attempts, want 201 after 2", recorder.Code, len(received))
+	}
+	if received[0] != received[1] || !bytes.Contains([]byte(received[1]), bytes.Repeat([]byte("not an image "), 1000)) {
+		t.Error("Retry did not send the same rebuilt body")
+	}
+	// The file is sent from the spool, which is removed afterwards.
+	assertSpoolEmpty(t, cfg.SpoolDir)
+}
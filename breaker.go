@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of sending a request to an upstream
+// whose circuit breaker is open.
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+var (
+	circuitState = newMetric("upload_proxy_circuit_breaker_state", "gauge",
+		"1 for the current circuit breaker state of each upstream.", "upstream", "state")
+	circuitRejected = newMetric("upload_proxy_circuit_breaker_rejected_total", "counter",
+		"Requests rejected because the circuit breaker was open.", "upstream")
+)
+
+// circuitBreaker tracks consecutive failures of one upstream. After
+// BREAKER_THRESHOLD of them it opens and requests fail fast. Once
+// BREAKER_COOLDOWN has passed, up to BREAKER_HALF_OPEN_REQUESTS probes are
+// let through; the first result closes or reopens it.
+type circuitBreaker struct {
+	upstream string
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+// breakerFor returns the breaker for the scheme and host of u.
+func breakerFor(u *url.URL) *circuitBreaker {
+	upstream := u.Scheme + "://" + u.Host
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[upstream]
+	if !ok {
+		b = &circuitBreaker{upstream: upstream, state: circuitClosed}
+		breakers[upstream] = b
+	}
+	return b
+}
+
+// allow reports whether a request may be sent now. In the half-open state
+// an allowed request is a probe and must be followed by observe.
+func (b *circuitBreaker) allow(cfg *Config, now time.Time) error {
+	if cfg.BreakerThreshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen {
+		if now.Sub(b.openedAt) < cfg.BreakerCooldown {
+			return errCircuitOpen
+		}
+		b.setState(circuitHalfOpen)
+		b.probes = 0
+	}
+	if b.state == circuitHalfOpen {
+		if b.probes >= cfg.BreakerHalfOpenRequests {
+			return errCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// observe records the result of a request allow let through. Connection
+// errors and RETRY_STATUSES count as failures; requests cancelled by the
+// client count as neither.
+func (b *circuitBreaker) observe(cfg *Config, req *http.Request, resp *http.Response, err error, now time.Time) {
+	if cfg.BreakerThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && req.Context().Err() != nil {
+		if b.state == circuitHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		return
+	}
+
+	if err == nil && !containsStatus(cfg.RetryStatuses, resp.StatusCode) {
+		if b.state != circuitClosed {
+			log.Printf("Circuit breaker for %s closed", b.upstream)
+		}
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= cfg.BreakerThreshold) {
+		log.Printf("Circuit breaker for %s opened after %d consecutive failures", b.upstream, b.failures)
+		b.openedAt = now
+		b.setState(circuitOpen)
+	}
+}
+
+// retryAfter returns how long the breaker stays open, or 0 if requests may
+// be sent.
+func (b *circuitBreaker) retryAfter(cfg *Config, now time.Time) time.Duration {
+	if cfg.BreakerThreshold <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitOpen {
+		return 0
+	}
+	if wait := cfg.BreakerCooldown - now.Sub(b.openedAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	for _, s := range []string{circuitClosed, circuitOpen, circuitHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		circuitState.Set(value, b.upstream, s)
+	}
+}
+
+// rejectOpenCircuit answers with 503 while the circuit of the request's
+// upstream is open, so that no time is spent processing uploads that cannot
+// be delivered. With QUEUE_DIR set uploads are still processed and queued.
+func rejectOpenCircuit(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route) bool {
+	if cfg.BreakerThreshold <= 0 || cfg.QueueDir != "" {
+		return false
+	}
+	target, err := route.upstreamURL(r.URL)
+	if err != nil {
+		return false
+	}
+	wait := upstreamRetryAfter(cfg, target)
+	if wait == 0 {
+		return false
+	}
+	circuitRejected.Add(1, target.Scheme+"://"+target.Host)
+	writeCircuitOpen(w, wait)
+	return true
+}
+
+func writeCircuitOpen(w http.ResponseWriter, wait time.Duration) {
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	}
+	http.Error(w, errCircuitOpen.Error(), http.StatusServiceUnavailable)
+}
+
+// breakerStatus is the health check view of one breaker.
+type breakerStatus struct {
+	Upstream string     `json:"upstream"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// serveHealth reports the proxy as up, and as degraded while any circuit
+// breaker is not closed or any upstream target fails its health check. It
+// always answers 200: the proxy itself is healthy and can still queue
+// uploads.
+func serveHealth(w http.ResponseWriter, cfg *Config) {
+	health := struct {
+		Status    string          `json:"status"`
+		Upstreams []breakerStatus `json:"upstreams"`
+		Targets   []targetStatus  `json:"targets,omitempty"`
+	}{Status: "ok", Upstreams: []breakerStatus{}, Targets: targetStatuses(cfg)}
+	for _, t := range health.Targets {
+		if !t.Healthy {
+			health.Status = "degraded"
+		}
+	}
+
+	breakersMu.Lock()
+	for _, b := range breakers {
+		b.mu.Lock()
+		status := breakerStatus{Upstream: b.upstream, State: b.state, Failures: b.failures}
+		if b.state != circuitClosed {
+			openedAt := b.openedAt
+			status.OpenedAt = &openedAt
+			health.Status = "degraded"
+		}
+		b.mu.Unlock()
+		health.Upstreams = append(health.Upstreams, status)
+	}
+	breakersMu.Unlock()
+	sort.Slice(health.Upstreams, func(i, j int) bool { return health.Upstreams[i].Upstream < health.Upstreams[j].Upstream })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
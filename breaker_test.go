@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BreakerThreshold = 2
+	cfg.BreakerCooldown = time.Minute
+	cfg.BreakerHalfOpenRequests = 1
+	resetUpstreamState(t)
+	b := breakerFor(&url.URL{Scheme: "http", Host: "breaker-states.test"})
+	req := httptest.NewRequest("POST", "http://breaker-states.test/", nil)
+	failed := &http.Response{StatusCode: http.StatusBadGateway}
+	ok := &http.Response{StatusCode: http.StatusBadRequest}
+	now := time.Now()
+
+	// Consecutive failures open it; a success in between resets the count.
+	b.observe(cfg, req, failed, nil, now)
+	b.observe(cfg, req, ok, nil, now)
+	b.observe(cfg, req, nil, errors.New("connection refused"), now)
+	if err := b.allow(cfg, now); err != nil {
+		t.Fatalf("open after %d failures", b.failures)
+	}
+	b.observe(cfg, req, failed, nil, now)
+	if err := b.allow(cfg, now); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("allow = %v, want errCircuitOpen", err)
+	}
+	if wait := b.retryAfter(cfg, now.Add(20*time.Second)); wait != 40*time.Second {
+		t.Errorf("retryAfter = %s, want 40s", wait)
+	}
+	if v := circuitState.Value(b.upstream, circuitOpen); v != 1 {
+		t.Errorf("open state metric = %v", v)
+	}
+
+	// After the cooldown a single probe is let through, and a failed probe
+	// opens it again.
+	now = now.Add(time.Minute)
+	if err := b.allow(cfg, now); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	if err := b.allow(cfg, now); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("second probe allowed")
+	}
+	b.observe(cfg, req, failed, nil, now)
+	if err := b.allow(cfg, now.Add(time.Second)); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("allowed right after a failed probe")
+	}
+
+	// A cancelled probe frees its slot, a successful one closes it.
+	now = now.Add(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.allow(cfg, now)
+	b.observe(cfg, req.WithContext(ctx), nil, context.Canceled, now)
+	if err := b.allow(cfg, now); err != nil {
+		t.Fatalf("probe slot not released: %v", err)
+	}
+	b.observe(cfg, req, ok, nil, now)
+	if b.state != circuitClosed || b.failures != 0 {
+		t.Errorf("state = %s with %d failures, want closed", b.state, b.failures)
+	}
+}
+
+func TestCircuitBreakerFastFails(t *testing.T) {
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL
+	cfg.BreakerThreshold = 2
+	cfg.BreakerCooldown = time.Minute
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, spoolRequest(t, []byte("video")), cfg)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want the upstream's 503", rec.Code)
+		}
+	}
+
+	// Once open, requests are rejected before they are read or forwarded.
+	rec := httptest.NewRecorder()
+	req := spoolRequest(t, []byte("video"))
+	proxyHandler(rec, req, cfg)
+	if rec.Code != http.StatusServiceUnavailable || requests != 2 {
+		t.Errorf("status = %d after %d upstream requests, want 503 after 2", rec.Code, requests)
+	}
+	if rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("Retry-After = %q, want 60", rec.Header().Get("Retry-After"))
+	}
+	if req.MultipartForm != nil || req.PostForm != nil {
+		t.Error("request body was parsed")
+	}
+
+	// With a queue, uploads are processed and queued without trying the
+	// upstream.
+	cfg.QueueDir = t.TempDir()
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, spoolRequest(t, []byte("video")), cfg)
+	if rec.Code != http.StatusAccepted || requests != 2 || len(listQueue(cfg.QueueDir)) != 1 {
+		t.Errorf("status = %d after %d upstream requests, want 202 after 2", rec.Code, requests)
+	}
+
+	// The health check reports the open circuit.
+	rec = httptest.NewRecorder()
+	adminHandler(newConfigHolder("", nil, cfg)).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		Status    string
+		Upstreams []breakerStatus
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || health.Status != "degraded" {
+		t.Errorf("health = %d %s", rec.Code, rec.Body.String())
+	}
+	found := false
+	for _, u := range health.Upstreams {
+		if u.Upstream == upstream.URL {
+			found = u.State == circuitOpen && u.OpenedAt != nil
+		}
+	}
+	if !found {
+		t.Errorf("upstream missing or not open in %s", rec.Body.String())
+	}
+	if !strings.Contains(rec.Header().Get("Content-Type"), "json") {
+		t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+const cliUsage = `Usage: multipart-upload-proxy [command] [flags]
+
+Commands:
+  serve          Run the upload proxy (default)
+  process        Run the image pipeline on local files
+  check-config   Print the effective configuration and validate it
+  version        Print the version
+
+Every setting can be given as a flag, an environment variable or in the
+config file. Run "multipart-upload-proxy <command> -h" to list the flags.
+`
+
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return runServe(args, stderr)
+	case "process":
+		return runProcess(args, stdout, stderr)
+	case "check-config":
+		return runCheckConfig(args, stdout, stderr)
+	case "version":
+		fmt.Fprintln(stdout, version)
+		return 0
+	case "help":
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "Unknown command %q\n\n%s", command, cliUsage)
+		return 2
+	}
+}
+
+// configFlags adds -config and one flag per setting to a command.
+type configFlags struct {
+	configFile string
+	values     map[string]string
+}
+
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{values: map[string]string{}}
+	fs.StringVar(&cf.configFile, "config", os.Getenv(CONFIG_FILE), "Path to a YAML, TOML or JSON config file")
+	for _, s := range settings {
+		fs.Var(&settingFlag{setting: s, values: cf.values}, s.Flag(), "Same as "+s.Env)
+	}
+	return cf
+}
+
+// load reads the configuration and reports problems on stderr. It fails if
+// the file cannot be read, or on any problem when strict mode is enabled.
+func (cf *configFlags) load(stderr io.Writer) (*Config, bool) {
+	cfg, problems, err := loadConfig(cf.configFile, cf.values)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load config: %v\n", err)
+		return nil, false
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(stderr, problem)
+	}
+	if cfg.StrictConfig && len(problems) > 0 {
+		fmt.Fprintf(stderr, "Refusing to continue in strict mode with %d invalid setting(s)\n", len(problems))
+		return nil, false
+	}
+	return cfg, true
+}
+
+// settingFlag collects a flag value for loadConfig. Bool settings can be
+// given without a value, like regular boolean flags.
+type settingFlag struct {
+	setting setting
+	values  map[string]string
+}
+
+func (f *settingFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values[f.setting.Env]
+}
+
+func (f *settingFlag) Set(v string) error {
+	if f.setting.IsBool {
+		switch v {
+		case "true":
+			v = "1"
+		case "false":
+			v = "0"
+		}
+	}
+	f.values[f.setting.Env] = v
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.setting.IsBool
+}
+
+func runServe(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cf := newConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, ok := cf.load(stderr)
+	if !ok {
+		return 1
+	}
+	return serve(newConfigHolder(cf.configFile, cf.values, cfg))
+}
+
+// runCheckConfig prints the effective configuration with the source of each
+// value and returns a non-zero exit code if anything is invalid or unknown.
+func runCheckConfig(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cf := newConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, problems, err := loadConfig(cf.configFile, cf.values)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+
+	for _, s := range settings {
+		fmt.Fprintf(stdout, "%s=%s (%s)\n", s.Env, s.Get(cfg), cfg.sources[s.Env])
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(stderr, "\n%d problem(s) found:\n", len(problems))
+		for _, problem := range problems {
+			fmt.Fprintln(stderr, problem)
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunCheckConfig(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	path := writeTestConfigFile(t, "proxy.yaml", "jpeg_quality: 80\n")
+	os.Setenv("WEBP_QUALITY", "70")
+
+	var stdout, stderr bytes.Buffer
+	code := runCheckConfig([]string{"-config", path}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("runCheckConfig = %d, want 0; stderr: %s", code, stderr.String())
+	}
+
+	output := stdout.String()
+	for _, expected := range []string{
+		"JPEG_QUALITY=80 (file " + path + ")",
+		"WEBP_QUALITY=70 (environment)",
+		"IMG_MAX_WIDTH=1920 (default)",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestRunCheckConfig_Problems(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		expected string
+	}{
+		{"Invalid value", "jpeg_quality: 0\n", nil, "Invalid jpeg_quality"},
+		{"Unknown key", "jpeg_qualty: 80\n", nil, `Unknown setting "jpeg_qualty"`},
+		{"Destination without scheme", "", map[string]string{"FORWARD_DESTINATION": "immich:3001/api/assets"}, "Invalid FORWARD_DESTINATION"},
+		{"Destination without host", "", map[string]string{"FORWARD_DESTINATION": "http:///api/assets"}, "Invalid FORWARD_DESTINATION"},
+		{"Malformed file", "routes: [\n", nil, "Failed to load config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearAllTestEnvVars()
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+			}
+			path := writeTestConfigFile(t, "proxy.yaml", tt.file)
+
+			var stdout, stderr bytes.Buffer
+			code := runCheckConfig([]string{"-config", path}, &stdout, &stderr)
+			if code == 0 {
+				t.Error("runCheckConfig = 0, want non-zero")
+			}
+			if !strings.Contains(stderr.String(), tt.expected) {
+				t.Errorf("Expected stderr to contain %q, got:\n%s", tt.expected, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunCLI_Commands(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"version"}, &stdout, &stderr); code != 0 {
+		t.Errorf("version exit code = %d, want 0", code)
+	}
+	if strings.TrimSpace(stdout.String()) != version {
+		t.Errorf("version output = %q, want %q", stdout.String(), version)
+	}
+
+	stdout.Reset()
+	if code := runCLI([]string{"help"}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), "check-config") {
+		t.Errorf("help exit code = %d, output = %q", code, stdout.String())
+	}
+
+	stderr.Reset()
+	if code := runCLI([]string{"frobnicate"}, &stdout, &stderr); code != 2 {
+		t.Errorf("unknown command exit code = %d, want 2", code)
+	}
+	if !strings.Contains(stderr.String(), `Unknown command "frobnicate"`) {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+}
+
+func TestRunCheckConfig_FlagsOverrideEnvironment(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	os.Setenv("JPEG_QUALITY", "70")
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"check-config", "-jpeg-quality", "55", "-normalize-extensions=false", "-strict-config"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("check-config exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	for _, expected := range []string{
+		"JPEG_QUALITY=55 (flag)",
+		"NORMALIZE_EXTENSIONS=0 (flag)",
+		"STRICT_CONFIG=1 (flag)",
+	} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, stdout.String())
+		}
+	}
+
+	stderr.Reset()
+	if code := runCLI([]string{"check-config", "-webp-quality", "200"}, &stdout, &stderr); code == 0 {
+		t.Error("Expected non-zero exit code for invalid flag value")
+	}
+	if !strings.Contains(stderr.String(), "Invalid -webp-quality") {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamTransport sends requests with a transport built from the current
+// config. A reload that changes the timeouts or pool sizes swaps the
+// transport, so the global client never has to be replaced.
+type upstreamTransport struct {
+	mu        sync.RWMutex
+	transport *http.Transport
+	settings  string
+}
+
+var transport = &upstreamTransport{}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	rt := t.transport
+	t.mu.RUnlock()
+	if rt == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	return rt.RoundTrip(req)
+}
+
+// configure builds a new transport if the connection settings in cfg
+// differ from those in use. Idle connections of the old one are closed;
+// requests in flight finish on it.
+func (t *upstreamTransport) configure(cfg *Config) {
+	settings := fmt.Sprint(cfg.UpstreamDialTimeout, cfg.UpstreamTLSTimeout, cfg.UpstreamResponseTimeout,
+		cfg.UpstreamMaxIdleConns, cfg.UpstreamMaxIdleConnsPerHost, cfg.UpstreamMaxConnsPerHost,
+		cfg.UpstreamIdleConnTimeout, cfg.UpstreamHTTP2)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.transport != nil && t.settings == settings {
+		return
+	}
+	if t.transport != nil {
+		log.Println("Upstream connection settings changed, new connections use them")
+		t.transport.CloseIdleConnections()
+	}
+	t.transport, t.settings = newTransport(cfg), settings
+}
+
+func newTransport(cfg *Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: cfg.UpstreamDialTimeout, KeepAlive: 30 * time.Second}
+	rt := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.UpstreamTLSTimeout,
+		ResponseHeaderTimeout: cfg.UpstreamResponseTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          cfg.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.UpstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.UpstreamMaxConnsPerHost,
+		IdleConnTimeout:       cfg.UpstreamIdleConnTimeout,
+		ForceAttemptHTTP2:     cfg.UpstreamHTTP2,
+	}
+	if !cfg.UpstreamHTTP2 {
+		// A non-nil empty map turns off HTTP/2 negotiation.
+		rt.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return rt
+}
+
+// withTimeout limits req to UPSTREAM_TIMEOUT, including reading the
+// response body. The returned function must be called with the response,
+// or nil if there is none.
+func withTimeout(req *http.Request, timeout time.Duration) (*http.Request, func(*http.Response)) {
+	if timeout <= 0 {
+		return req, func(*http.Response) {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), func(resp *http.Response) {
+		if resp == nil {
+			cancel()
+			return
+		}
+		resp.Body = &doneBody{ReadCloser: resp.Body, done: cancel}
+	}
+}
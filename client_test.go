@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTransportSettings(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UpstreamMaxConnsPerHost = 8
+	rt := newTransport(cfg)
+	if rt.TLSHandshakeTimeout != 10*time.Second || rt.ResponseHeaderTimeout != time.Minute {
+		t.Errorf("timeouts = %s, %s", rt.TLSHandshakeTimeout, rt.ResponseHeaderTimeout)
+	}
+	if rt.MaxIdleConns != 100 || rt.MaxIdleConnsPerHost != 16 || rt.MaxConnsPerHost != 8 || rt.IdleConnTimeout != 90*time.Second {
+		t.Errorf("pool = %d, %d, %d, %s", rt.MaxIdleConns, rt.MaxIdleConnsPerHost, rt.MaxConnsPerHost, rt.IdleConnTimeout)
+	}
+	if !rt.ForceAttemptHTTP2 || rt.TLSNextProto != nil {
+		t.Error("HTTP/2 is not enabled by default")
+	}
+	cfg.UpstreamHTTP2 = false
+	if rt := newTransport(cfg); rt.ForceAttemptHTTP2 || rt.TLSNextProto == nil {
+		t.Error("HTTP/2 is not disabled")
+	}
+
+	// The transport is only replaced when its settings change.
+	ut := &upstreamTransport{}
+	ut.configure(cfg)
+	first := ut.transport
+	changed := *cfg
+	changed.RetryAttempts = 3
+	ut.configure(&changed)
+	if ut.transport != first {
+		t.Error("transport replaced without a connection setting change")
+	}
+	changed.UpstreamResponseTimeout = time.Second
+	ut.configure(&changed)
+	if ut.transport == first || ut.transport.ResponseHeaderTimeout != time.Second {
+		t.Error("transport not replaced after a timeout change")
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerDelay, _ := time.ParseDuration(r.URL.Query().Get("header"))
+		bodyDelay, _ := time.ParseDuration(r.URL.Query().Get("body"))
+		time.Sleep(headerDelay)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(bodyDelay)
+		io.WriteString(w, "done")
+	}))
+	defer upstream.Close()
+
+	cfg := defaultConfig()
+	cfg.UpstreamResponseTimeout = 50 * time.Millisecond
+	cfg.UpstreamTimeout = 200 * time.Millisecond
+	ut := &upstreamTransport{}
+	ut.configure(cfg)
+	useClient(t, &http.Client{Transport: ut})
+	send := func(headerDelay, bodyDelay time.Duration) (string, error) {
+		req, _ := http.NewRequest("POST", upstream.URL+"?header="+headerDelay.String()+"&body="+bodyDelay.String(), bytes.NewBufferString("processed"))
+		resp, err := sendUpstream(cfg, req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// A slow body is fine as long as the response starts in time and ends
+	// within UPSTREAM_TIMEOUT.
+	if body, err := send(0, 100*time.Millisecond); err != nil || body != "done" {
+		t.Errorf("slow body: %q, %v", body, err)
+	}
+
+	if _, err := send(100*time.Millisecond, 0); err == nil {
+		t.Error("no error after UPSTREAM_RESPONSE_TIMEOUT")
+	}
+
+	if _, err := send(0, 300*time.Millisecond); err == nil {
+		t.Error("no error after UPSTREAM_TIMEOUT")
+	}
+
+	// A timed out request counts as an upstream failure.
+	cfg.BreakerThreshold = 1
+	cfg.BreakerCooldown = time.Minute
+	send(100*time.Millisecond, 0)
+	if _, err := send(0, 0); err != errCircuitOpen {
+		t.Errorf("err = %v after a timeout, want errCircuitOpen", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ClientRule selects a processing profile for requests from particular
+// clients. All conditions that are set must match; the first matching rule
+// wins.
+type ClientRule struct {
+	// Route limits the rule to the route with this name.
+	Route string
+	// Header or FormField names a value that must match Match.
+	Header    string
+	FormField string
+	Match     *regexp.Regexp
+	// Sources are the networks the client address must be in.
+	Sources []*net.IPNet
+	Profile string
+}
+
+// clientRuleConfig is the serialized form used by the CLIENT_RULES setting.
+type clientRuleConfig struct {
+	Route     string   `json:"route,omitempty"`
+	Header    string   `json:"header,omitempty"`
+	FormField string   `json:"form_field,omitempty"`
+	Match     string   `json:"match,omitempty"`
+	Source    []string `json:"source,omitempty"`
+	Profile   string   `json:"profile"`
+}
+
+// clientProfile returns the profile of the first client rule matching the
+// request, or the route's profile. Form field rules only match once the
+// form has been parsed.
+func (cfg *Config) clientProfile(r *http.Request, route *Route) ProcessingProfile {
+	for i := range cfg.ClientRules {
+		rule := &cfg.ClientRules[i]
+		if rule.matches(r, route) {
+			if profile, ok := cfg.Profiles[rule.Profile]; ok {
+				return profile
+			}
+		}
+	}
+	return cfg.profileFor(route)
+}
+
+func (rule *ClientRule) matches(r *http.Request, route *Route) bool {
+	if rule.Route != "" && rule.Route != route.Name {
+		return false
+	}
+	if rule.Header != "" && !matchesAny(rule.Match, r.Header.Values(rule.Header)) {
+		return false
+	}
+	if rule.FormField != "" && (r.Form == nil || !matchesAny(rule.Match, r.Form[rule.FormField])) {
+		return false
+	}
+	if len(rule.Sources) > 0 && !containsIP(rule.Sources, clientIP(r)) {
+		return false
+	}
+	return true
+}
+
+func matchesAny(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the connecting client. Forwarding headers are
+// not trusted; use a header rule on X-Forwarded-For behind a trusted proxy.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClientRules decodes the CLIENT_RULES setting. Profiles and routes are
+// checked against the already parsed PROFILES and ROUTES.
+func parseClientRules(v string, cfg *Config) ([]ClientRule, error) {
+	var raw []clientRuleConfig
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, err
+	}
+
+	rules := make([]ClientRule, 0, len(raw))
+	for i, rc := range raw {
+		rule := ClientRule{
+			Route:     rc.Route,
+			Header:    rc.Header,
+			FormField: rc.FormField,
+			Profile:   rc.Profile,
+		}
+		if rule.Header != "" && rule.FormField != "" {
+			return nil, fmt.Errorf("rule %d: use either header or form_field, not both", i+1)
+		}
+		if rule.Header == "" && rule.FormField == "" && len(rc.Source) == 0 {
+			return nil, fmt.Errorf("rule %d: needs a header, form_field or source condition", i+1)
+		}
+		if rule.Header != "" || rule.FormField != "" {
+			re, err := regexp.Compile(rc.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid match %q: %w", i+1, rc.Match, err)
+			}
+			rule.Match = re
+		}
+		for _, source := range rc.Source {
+			network, err := parseNetwork(source)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			rule.Sources = append(rule.Sources, network)
+		}
+		if _, ok := cfg.Profiles[rule.Profile]; !ok {
+			return nil, fmt.Errorf("rule %d: unknown profile %q", i+1, rule.Profile)
+		}
+		if rule.Route != "" && !cfg.hasRoute(rule.Route) {
+			return nil, fmt.Errorf("rule %d: unknown route %q", i+1, rule.Route)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseNetwork accepts a CIDR or a single address.
+func parseNetwork(v string) (*net.IPNet, error) {
+	v = strings.TrimSpace(v)
+	if _, network, err := net.ParseCIDR(v); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source %q, expected an address or CIDR", v)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (cfg *Config) hasRoute(name string) bool {
+	if name == cfg.defaultRoute().Name {
+		return true
+	}
+	for _, route := range cfg.Routes {
+		if route.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func formatClientRules(rules []ClientRule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	raw := make([]clientRuleConfig, 0, len(rules))
+	for _, rule := range rules {
+		rc := clientRuleConfig{
+			Route:     rule.Route,
+			Header:    rule.Header,
+			FormField: rule.FormField,
+			Profile:   rule.Profile,
+		}
+		if rule.Match != nil {
+			rc.Match = rule.Match.String()
+		}
+		for _, network := range rule.Sources {
+			rc.Source = append(rc.Source, network.String())
+		}
+		raw = append(raw, rc)
+	}
+	b, _ := json.Marshal(raw)
+	return string(b)
+}
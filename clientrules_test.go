@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testClientRulesConfig(t *testing.T) *Config {
+	cfg := testRoutesConfig(t)
+	rules, err := parseClientRules(`[
+		{"route": "immich", "form_field": "deviceId", "match": "^WEB$", "profile": "originals"},
+		{"header": "User-Agent", "match": "Immich_(Android|iOS)", "profile": "phone"},
+		{"source": ["192.168.1.0/24", "10.1.2.3"], "profile": "originals"}
+	]`, cfg)
+	if err != nil {
+		t.Fatalf("parseClientRules failed: %v", err)
+	}
+	cfg.ClientRules = rules
+	return cfg
+}
+
+func TestClientProfile(t *testing.T) {
+	cfg := testClientRulesConfig(t)
+
+	webUpload := func(path, deviceID string) *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("deviceId", deviceID)
+		writer.Close()
+		req := httptest.NewRequest("POST", path, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.ParseMultipartForm(1 << 20)
+		return req
+	}
+	fromAddr := func(addr string) *http.Request {
+		req := httptest.NewRequest("POST", "/other", nil)
+		req.RemoteAddr = addr
+		return req
+	}
+	android := httptest.NewRequest("POST", "/other", nil)
+	android.Header.Set("User-Agent", "Immich_Android_1.90")
+
+	tests := []struct {
+		name      string
+		req       *http.Request
+		wantWidth int
+	}{
+		{"web uploader keeps originals", webUpload("/api/assets", "WEB"), 100000},
+		{"other device uses route profile", webUpload("/api/assets", "phone-1"), 1280},
+		{"form rule limited to its route", webUpload("/other", "WEB"), 1920},
+		{"user agent rule", android, 1280},
+		{"source network", fromAddr("192.168.1.20:50000"), 100000},
+		{"single source address", fromAddr("10.1.2.3:50000"), 100000},
+		{"other source", fromAddr("203.0.113.5:50000"), 1920},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := cfg.clientProfile(tt.req, cfg.matchRoute(tt.req))
+			if profile.MaxWidth != tt.wantWidth {
+				t.Errorf("MaxWidth = %d, want %d", profile.MaxWidth, tt.wantWidth)
+			}
+		})
+	}
+}
+
+func TestParseClientRulesErrors(t *testing.T) {
+	cfg := testRoutesConfig(t)
+	invalid := []string{
+		`[{"header": "User-Agent", "match": "x", "profile": "nope"}]`,
+		`[{"profile": "phone"}]`,
+		`[{"header": "User-Agent", "form_field": "deviceId", "match": "x", "profile": "phone"}]`,
+		`[{"header": "User-Agent", "match": "(", "profile": "phone"}]`,
+		`[{"source": ["not-an-ip"], "profile": "phone"}]`,
+		`[{"route": "missing", "source": ["10.0.0.0/8"], "profile": "phone"}]`,
+	}
+	for _, v := range invalid {
+		if _, err := parseClientRules(v, cfg); err == nil {
+			t.Errorf("parseClientRules(%s) expected error", v)
+		}
+	}
+
+	rules, err := parseClientRules(`[{"route": "default", "source": ["10.0.0.0/8"], "profile": "phone"}]`, cfg)
+	if err != nil {
+		t.Fatalf("parseClientRules failed: %v", err)
+	}
+	if got := formatClientRules(rules); got != `[{"route":"default","source":["10.0.0.0/8"],"profile":"phone"}]` {
+		t.Errorf("formatClientRules = %s", got)
+	}
+}
@@ -1,127 +1,731 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	ImgMaxWidth        int
-	ImgMaxHeight       int
-	ImgMaxNarrowSide   int
-	JpegQuality        int
-	WebpQuality        int
-	NormalizeExt       bool
-	UploadMaxSize      int64
-	ImgMaxPixels       int64
-	ForwardDestination string
-	FileUploadField    string
-	ListenPath         string
-	ConvertToFormat    string
+	ImgMaxWidth                 int
+	ImgMaxHeight                int
+	ImgMaxNarrowSide            int
+	JpegQuality                 int
+	WebpQuality                 int
+	NormalizeExt                bool
+	UploadMaxSize               int64
+	UploadMaxFileSize           int64
+	BodyMaxSize                 int64
+	UploadMemoryLimit           int64
+	SpoolDir                    string
+	SpoolMaxSize                int64
+	ImgMaxPixels                int64
+	ForwardDestination          string
+	FileUploadField             string
+	ListenPath                  string
+	ConvertToFormat             string
+	RequestHeaders              HeaderRules
+	ResponseHeaders             HeaderRules
+	StripPathPrefix             string
+	AddPathPrefix               string
+	PathRewrites                []PathRewrite
+	FieldRewrites               map[string]string
+	RawUploads                  bool
+	RawRenamePath               bool
+	JSONFields                  []JSONField
+	WebDAV                      bool
+	Tus                         bool
+	TusDelivery                 string
+	TusDir                      string
+	TusExpiry                   time.Duration
+	S3                          bool
+	S3AccessKeyID               string
+	S3SecretAccessKey           string
+	S3Region                    string
+	S3VerifySignature           bool
+	S3Expiry                    time.Duration
+	S3Dir                       string
+	RetryAttempts               int
+	RetryBackoff                time.Duration
+	RetryMaxBackoff             time.Duration
+	RetryStatuses               []int
+	RetryDeadline               time.Duration
+	UpstreamTargets             []string
+	UpstreamBalancing           string
+	UpstreamHealthPath          string
+	UpstreamHealthInterval      time.Duration
+	UpstreamEjectThreshold      int
+	UpstreamEjectDuration       time.Duration
+	UpstreamDialTimeout         time.Duration
+	UpstreamTLSTimeout          time.Duration
+	UpstreamResponseTimeout     time.Duration
+	UpstreamTimeout             time.Duration
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamMaxConnsPerHost     int
+	UpstreamIdleConnTimeout     time.Duration
+	UpstreamHTTP2               bool
+	BreakerThreshold            int
+	BreakerCooldown             time.Duration
+	BreakerHalfOpenRequests     int
+	QueueDir                    string
+	QueueRetryInterval          time.Duration
+	QueueResponseStatus         int
+	QueueResponseBody           string
+	QueueMaxBytes               int64
+	Routes                      []Route
+	Profiles                    map[string]ProcessingProfile
+	ConfigReloadInterval        time.Duration
+	StrictConfig                bool
+	DryRun                      bool
+	AdminListenAddr             string
+	ReportHeaders               bool
+	ReportResponseHeaders       bool
+	OverrideSecret              string
+	OverrideAllow               []string
+	ClientRules                 []ClientRule
+
+	// sources records where each setting's value came from, keyed by Env.
+	sources map[string]string
+}
+
+// setting describes one configuration value. Env is its environment
+// variable, Key its name in a config file and Flag() its command-line flag. Set parses and validates a
+// value, Get formats the current one for logging.
+type setting struct {
+	Env    string
+	Key    string
+	IsBool bool
+	Set    func(cfg *Config, v string) error
+	Get    func(cfg *Config) string
+	// Value returns the unmasked value of settings whose Get masks it.
+	Value func(cfg *Config) string
+}
+
+// settings are applied in this order. PROFILES, ROUTES and CLIENT_RULES come
+// last because they inherit from the global values and refer to each other.
+var settings = []setting{
+	intSetting(IMG_MAX_WIDTH, 1, 0, func(cfg *Config) *int { return &cfg.ImgMaxWidth }),
+	intSetting(IMG_MAX_HEIGHT, 1, 0, func(cfg *Config) *int { return &cfg.ImgMaxHeight }),
+	intSetting(IMG_MAX_NARROW_SIDE, 0, 0, func(cfg *Config) *int { return &cfg.ImgMaxNarrowSide }),
+	intSetting(JPEG_QUALITY, 1, 100, func(cfg *Config) *int { return &cfg.JpegQuality }),
+	intSetting(WEBP_QUALITY, 1, 100, func(cfg *Config) *int { return &cfg.WebpQuality }),
+	boolSetting(NORMALIZE_EXTENSIONS, func(cfg *Config) *bool { return &cfg.NormalizeExt }),
+	int64Setting(UPLOAD_MAX_SIZE, 1, func(cfg *Config) *int64 { return &cfg.UploadMaxSize }),
+	int64Setting(UPLOAD_MAX_FILE_SIZE, 0, func(cfg *Config) *int64 { return &cfg.UploadMaxFileSize }),
+	int64Setting(BODY_MAX_SIZE, 0, func(cfg *Config) *int64 { return &cfg.BodyMaxSize }),
+	int64Setting(UPLOAD_MEMORY_LIMIT, 0, func(cfg *Config) *int64 { return &cfg.UploadMemoryLimit }),
+	stringSetting(SPOOL_DIR, func(cfg *Config) *string { return &cfg.SpoolDir }),
+	int64Setting(SPOOL_MAX_SIZE, 0, func(cfg *Config) *int64 { return &cfg.SpoolMaxSize }),
+	{
+		Env: FORWARD_DESTINATION,
+		Set: func(cfg *Config, v string) error {
+			if err := validateUpstreamURL(v); err != nil {
+				return err
+			}
+			cfg.ForwardDestination = v
+			return nil
+		},
+		Get: func(cfg *Config) string { return cfg.ForwardDestination },
+	},
+	stringSetting(FILE_UPLOAD_FIELD, func(cfg *Config) *string { return &cfg.FileUploadField }),
+	pathSetting(LISTEN_PATH, func(cfg *Config) *string { return &cfg.ListenPath }),
+	{
+		Env: CONVERT_TO_FORMAT,
+		Set: func(cfg *Config, v string) error {
+			normalizedFormat, ok := normalizeConvertFormat(v)
+			if !ok {
+				return fmt.Errorf(`valid values: "", "JPEG", "JPG", "WEBP"`)
+			}
+			cfg.ConvertToFormat = normalizedFormat
+			return nil
+		},
+		Get: func(cfg *Config) string { return cfg.ConvertToFormat },
+	},
+	headerNamesSetting(REQUEST_STRIP_HEADERS, func(cfg *Config) *[]string { return &cfg.RequestHeaders.Strip }),
+	headerNamesSetting(RESPONSE_STRIP_HEADERS, func(cfg *Config) *[]string { return &cfg.ResponseHeaders.Strip }),
+	headerNamesSetting(REQUEST_ALLOW_HEADERS, func(cfg *Config) *[]string { return &cfg.RequestHeaders.Allow }),
+	headerNamesSetting(RESPONSE_ALLOW_HEADERS, func(cfg *Config) *[]string { return &cfg.ResponseHeaders.Allow }),
+	headerValuesSetting(REQUEST_SET_HEADERS, func(cfg *Config) *http.Header { return &cfg.RequestHeaders.Set }),
+	headerValuesSetting(REQUEST_ADD_HEADERS, func(cfg *Config) *http.Header { return &cfg.RequestHeaders.Add }),
+	pathSetting(STRIP_PATH_PREFIX, func(cfg *Config) *string { return &cfg.StripPathPrefix }),
+	pathSetting(ADD_PATH_PREFIX, func(cfg *Config) *string { return &cfg.AddPathPrefix }),
+	{
+		Env: PATH_REWRITES,
+		Set: func(cfg *Config, v string) error {
+			var rewrites []PathRewrite
+			var err error
+			if strings.HasPrefix(strings.TrimSpace(v), "[") {
+				var raw []pathRewriteConfig
+				if err = json.Unmarshal([]byte(v), &raw); err == nil {
+					rewrites, err = parsePathRewrites(raw)
+				}
+			} else {
+				rewrites, err = parsePathRewriteList(v)
+			}
+			if err != nil {
+				return err
+			}
+			cfg.PathRewrites = rewrites
+			return nil
+		},
+		Get: func(cfg *Config) string {
+			entries := make([]string, 0, len(cfg.PathRewrites))
+			for _, rw := range cfg.PathRewrites {
+				entries = append(entries, rw.Pattern.String()+" => "+rw.Replacement)
+			}
+			return strings.Join(entries, "; ")
+		},
+	},
+	{
+		Env: FIELD_REWRITES,
+		Set: func(cfg *Config, v string) error {
+			rewrites, err := parseFieldRewrites(v)
+			if err != nil {
+				return err
+			}
+			cfg.FieldRewrites = rewrites
+			return nil
+		},
+		Get: func(cfg *Config) string { return formatFieldRewrites(cfg.FieldRewrites) },
+	},
+	boolSetting(RAW_UPLOADS, func(cfg *Config) *bool { return &cfg.RawUploads }),
+	boolSetting(RAW_RENAME_PATH, func(cfg *Config) *bool { return &cfg.RawRenamePath }),
+	boolSetting(WEBDAV, func(cfg *Config) *bool { return &cfg.WebDAV }),
+	boolSetting(TUS, func(cfg *Config) *bool { return &cfg.Tus }),
+	{
+		Env: TUS_DELIVERY,
+		Set: func(cfg *Config, v string) error {
+			delivery, err := parseTusDelivery(v)
+			if err != nil {
+				return err
+			}
+			cfg.TusDelivery = delivery
+			return nil
+		},
+		Get: func(cfg *Config) string { return cfg.TusDelivery },
+	},
+	stringSetting(TUS_DIR, func(cfg *Config) *string { return &cfg.TusDir }),
+	durationSetting(TUS_EXPIRY, func(cfg *Config) *time.Duration { return &cfg.TusExpiry }),
+	boolSetting(S3, func(cfg *Config) *bool { return &cfg.S3 }),
+	stringSetting(S3_ACCESS_KEY_ID, func(cfg *Config) *string { return &cfg.S3AccessKeyID }),
+	secretSetting(S3_SECRET_ACCESS_KEY, func(cfg *Config) *string { return &cfg.S3SecretAccessKey }),
+	stringSetting(S3_REGION, func(cfg *Config) *string { return &cfg.S3Region }),
+	boolSetting(S3_VERIFY_SIGNATURE, func(cfg *Config) *bool { return &cfg.S3VerifySignature }),
+	durationSetting(S3_EXPIRY, func(cfg *Config) *time.Duration { return &cfg.S3Expiry }),
+	stringSetting(S3_DIR, func(cfg *Config) *string { return &cfg.S3Dir }),
+	{
+		Env: JSON_FIELDS,
+		Set: func(cfg *Config, v string) error {
+			var raw []jsonFieldConfig
+			if err := json.Unmarshal([]byte(v), &raw); err != nil {
+				return err
+			}
+			fields, err := parseJSONFields(raw)
+			if err != nil {
+				return err
+			}
+			cfg.JSONFields = fields
+			return nil
+		},
+		Get: func(cfg *Config) string {
+			if len(cfg.JSONFields) == 0 {
+				return ""
+			}
+			b, _ := json.Marshal(formatJSONFields(cfg.JSONFields))
+			return string(b)
+		},
+	},
+	intSetting(RETRY_ATTEMPTS, 0, 100, func(cfg *Config) *int { return &cfg.RetryAttempts }),
+	durationSetting(RETRY_BACKOFF, func(cfg *Config) *time.Duration { return &cfg.RetryBackoff }),
+	durationSetting(RETRY_MAX_BACKOFF, func(cfg *Config) *time.Duration { return &cfg.RetryMaxBackoff }),
+	{
+		Env: RETRY_STATUSES,
+		Set: func(cfg *Config, v string) error {
+			statuses, err := parseStatusList(v)
+			if err != nil {
+				return err
+			}
+			cfg.RetryStatuses = statuses
+			return nil
+		},
+		Get: func(cfg *Config) string { return formatStatusList(cfg.RetryStatuses) },
+	},
+	durationSetting(RETRY_DEADLINE, func(cfg *Config) *time.Duration { return &cfg.RetryDeadline }),
+	{
+		Env: UPSTREAM_TARGETS,
+		Set: func(cfg *Config, v string) error {
+			targets, err := parseUpstreamTargets(v)
+			if err != nil {
+				return err
+			}
+			cfg.UpstreamTargets = targets
+			return nil
+		},
+		Get: func(cfg *Config) string { return strings.Join(cfg.UpstreamTargets, ",") },
+	},
+	{
+		Env: UPSTREAM_BALANCING,
+		Set: func(cfg *Config, v string) error {
+			balancing, err := parseBalancing(v)
+			if err != nil {
+				return err
+			}
+			cfg.UpstreamBalancing = balancing
+			return nil
+		},
+		Get: func(cfg *Config) string { return cfg.UpstreamBalancing },
+	},
+	{
+		Env: UPSTREAM_HEALTH_PATH,
+		Set: func(cfg *Config, v string) error {
+			if v != "" && !strings.HasPrefix(v, "/") {
+				return fmt.Errorf("must start with /")
+			}
+			cfg.UpstreamHealthPath = v
+			return nil
+		},
+		Get: func(cfg *Config) string { return cfg.UpstreamHealthPath },
+	},
+	durationSetting(UPSTREAM_HEALTH_INTERVAL, func(cfg *Config) *time.Duration { return &cfg.UpstreamHealthInterval }),
+	intSetting(UPSTREAM_EJECT_THRESHOLD, 0, 1000, func(cfg *Config) *int { return &cfg.UpstreamEjectThreshold }),
+	durationSetting(UPSTREAM_EJECT_DURATION, func(cfg *Config) *time.Duration { return &cfg.UpstreamEjectDuration }),
+	durationSetting(UPSTREAM_DIAL_TIMEOUT, func(cfg *Config) *time.Duration { return &cfg.UpstreamDialTimeout }),
+	durationSetting(UPSTREAM_TLS_TIMEOUT, func(cfg *Config) *time.Duration { return &cfg.UpstreamTLSTimeout }),
+	durationSetting(UPSTREAM_RESPONSE_TIMEOUT, func(cfg *Config) *time.Duration { return &cfg.UpstreamResponseTimeout }),
+	durationSetting(UPSTREAM_TIMEOUT, func(cfg *Config) *time.Duration { return &cfg.UpstreamTimeout }),
+	intSetting(UPSTREAM_MAX_IDLE_CONNS, 0, 100000, func(cfg *Config) *int { return &cfg.UpstreamMaxIdleConns }),
+	intSetting(UPSTREAM_MAX_IDLE_CONNS_PER_HOST, 0, 100000, func(cfg *Config) *int { return &cfg.UpstreamMaxIdleConnsPerHost }),
+	intSetting(UPSTREAM_MAX_CONNS_PER_HOST, 0, 100000, func(cfg *Config) *int { return &cfg.UpstreamMaxConnsPerHost }),
+	durationSetting(UPSTREAM_IDLE_CONN_TIMEOUT, func(cfg *Config) *time.Duration { return &cfg.UpstreamIdleConnTimeout }),
+	boolSetting(UPSTREAM_HTTP2, func(cfg *Config) *bool { return &cfg.UpstreamHTTP2 }),
+	intSetting(BREAKER_THRESHOLD, 0, 1000, func(cfg *Config) *int { return &cfg.BreakerThreshold }),
+	durationSetting(BREAKER_COOLDOWN, func(cfg *Config) *time.Duration { return &cfg.BreakerCooldown }),
+	intSetting(BREAKER_HALF_OPEN_REQUESTS, 1, 100, func(cfg *Config) *int { return &cfg.BreakerHalfOpenRequests }),
+	stringSetting(QUEUE_DIR, func(cfg *Config) *string { return &cfg.QueueDir }),
+	durationSetting(QUEUE_RETRY_INTERVAL, func(cfg *Config) *time.Duration { return &cfg.QueueRetryInterval }),
+	intSetting(QUEUE_RESPONSE_STATUS, 200, 299, func(cfg *Config) *int { return &cfg.QueueResponseStatus }),
+	stringSetting(QUEUE_RESPONSE_BODY, func(cfg *Config) *string { return &cfg.QueueResponseBody }),
+	int64Setting(QUEUE_MAX_BYTES, 0, func(cfg *Config) *int64 { return &cfg.QueueMaxBytes }),
+	durationSetting(CONFIG_RELOAD_INTERVAL, func(cfg *Config) *time.Duration { return &cfg.ConfigReloadInterval }),
+	boolSetting(STRICT_CONFIG, func(cfg *Config) *bool { return &cfg.StrictConfig }),
+	boolSetting(DRY_RUN, func(cfg *Config) *bool { return &cfg.DryRun }),
+	stringSetting(ADMIN_LISTEN_ADDR, func(cfg *Config) *string { return &cfg.AdminListenAddr }),
+	boolSetting(REPORT_HEADERS, func(cfg *Config) *bool { return &cfg.ReportHeaders }),
+	boolSetting(REPORT_RESPONSE_HEADERS, func(cfg *Config) *bool { return &cfg.ReportResponseHeaders }),
+	secretSetting(OVERRIDE_SECRET, func(cfg *Config) *string { return &cfg.OverrideSecret }),
+	{
+		Env: OVERRIDE_ALLOW,
+		Set: func(cfg *Config, v string) error {
+			keys, err := parseOverrideKeys(v)
+			if err != nil {
+				return err
+			}
+			cfg.OverrideAllow = keys
+			return nil
+		},
+		Get: func(cfg *Config) string { return strings.Join(cfg.OverrideAllow, ",") },
+	},
+	{
+		Env: PROFILES,
+		Set: func(cfg *Config, v string) error {
+			profiles, err := parseProfiles(v, cfg.defaultProfile())
+			if err != nil {
+				return err
+			}
+			cfg.Profiles = profiles
+			return nil
+		},
+		Get: func(cfg *Config) string { return formatProfiles(cfg.Profiles) },
+	},
+	{
+		Env: ROUTES,
+		Set: func(cfg *Config, v string) error {
+			routes, err := parseRoutes(v, cfg)
+			if err != nil {
+				return err
+			}
+			cfg.Routes = routes
+			return nil
+		},
+		Get: func(cfg *Config) string { return formatRoutes(cfg.Routes) },
+	},
+	{
+		Env: CLIENT_RULES,
+		Set: func(cfg *Config, v string) error {
+			rules, err := parseClientRules(v, cfg)
+			if err != nil {
+				return err
+			}
+			cfg.ClientRules = rules
+			return nil
+		},
+		Get: func(cfg *Config) string { return formatClientRules(cfg.ClientRules) },
+	},
+}
+
+func init() {
+	for i := range settings {
+		settings[i].Key = strings.ToLower(settings[i].Env)
+	}
+}
+
+// Flag is the command-line flag name of a setting, e.g. -jpeg-quality.
+func (s setting) Flag() string {
+	return strings.ReplaceAll(s.Key, "_", "-")
+}
+
+// value returns the setting's value, unmasked. Use Get to show it.
+func (s setting) value(cfg *Config) string {
+	if s.Value != nil {
+		return s.Value(cfg)
+	}
+	return s.Get(cfg)
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ImgMaxWidth:                 DEFAULT_IMG_MAX_WIDTH,
+		ImgMaxHeight:                DEFAULT_IMG_MAX_HEIGHT,
+		ImgMaxNarrowSide:            DEFAULT_IMG_MAX_NARROW_SIDE,
+		JpegQuality:                 DEFAULT_JPEG_QUALITY,
+		WebpQuality:                 DEFAULT_WEBP_QUALITY,
+		NormalizeExt:                DEFAULT_NORMALIZE_EXTENSIONS == 1,
+		UploadMaxSize:               100 << 20,
+		BodyMaxSize:                 100 << 20,
+		RetryBackoff:                200 * time.Millisecond,
+		RetryMaxBackoff:             5 * time.Second,
+		RetryStatuses:               []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		RetryDeadline:               30 * time.Second,
+		UpstreamBalancing:           BALANCE_ROUND_ROBIN,
+		UpstreamHealthInterval:      10 * time.Second,
+		UpstreamEjectThreshold:      3,
+		UpstreamEjectDuration:       30 * time.Second,
+		UpstreamDialTimeout:         10 * time.Second,
+		UpstreamTLSTimeout:          10 * time.Second,
+		UpstreamResponseTimeout:     60 * time.Second,
+		UpstreamTimeout:             30 * time.Minute,
+		UpstreamMaxIdleConns:        100,
+		UpstreamMaxIdleConnsPerHost: 16,
+		UpstreamIdleConnTimeout:     90 * time.Second,
+		UpstreamHTTP2:               true,
+		BreakerCooldown:             30 * time.Second,
+		BreakerHalfOpenRequests:     1,
+		QueueRetryInterval:          30 * time.Second,
+		QueueResponseStatus:         http.StatusAccepted,
+		QueueResponseBody:           `{"status":"queued","id":"{id}"}`,
+		UploadMemoryLimit:           32 << 20,
+		ForwardDestination:          "https://httpbin.org/anything",
+		FileUploadField:             "assetData",
+		ListenPath:                  "/api/assets",
+		ConvertToFormat:             DEFAULT_CONVERT_TO_FORMAT,
+		RequestHeaders:              HeaderRules{Strip: defaultStripHeaders},
+		ResponseHeaders:             HeaderRules{Strip: defaultStripHeaders},
+		OverrideAllow:               []string{"profile"},
+		TusDelivery:                 TUS_DELIVERY_MULTIPART,
+		TusDir:                      filepath.Join(os.TempDir(), "upload-proxy-tus"),
+		TusExpiry:                   24 * time.Hour,
+		S3Region:                    "us-east-1",
+		S3VerifySignature:           true,
+		S3Expiry:                    24 * time.Hour,
+		S3Dir:                       filepath.Join(os.TempDir(), "upload-proxy-s3"),
+	}
 }
 
+// NewConfigFromEnv loads the config file named by CONFIG_FILE, if any, and
+// the environment. A config file that cannot be read is logged and skipped.
 func NewConfigFromEnv() *Config {
-	cfg := &Config{
-		ImgMaxWidth:        DEFAULT_IMG_MAX_WIDTH,
-		ImgMaxHeight:       DEFAULT_IMG_MAX_HEIGHT,
-		ImgMaxNarrowSide:   DEFAULT_IMG_MAX_NARROW_SIDE,
-		JpegQuality:        DEFAULT_JPEG_QUALITY,
-		WebpQuality:        DEFAULT_WEBP_QUALITY,
-		NormalizeExt:       DEFAULT_NORMALIZE_EXTENSIONS == 1,
-		UploadMaxSize:      100 << 20,
-		ForwardDestination: "https://httpbin.org/anything",
-		FileUploadField:    "assetData",
-		ListenPath:         "/api/assets",
-		ConvertToFormat:    DEFAULT_CONVERT_TO_FORMAT,
-	}
-
-	if v := os.Getenv(IMG_MAX_WIDTH); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			cfg.ImgMaxWidth = n
-		} else {
-			log.Printf("Invalid %s=%q, using %d", IMG_MAX_WIDTH, v, cfg.ImgMaxWidth)
-		}
+	cfg, err := LoadConfig(os.Getenv(CONFIG_FILE))
+	if err != nil {
+		log.Printf("Ignoring config file: %v", err)
+		cfg, _ = LoadConfig("")
 	}
+	return cfg
+}
 
-	if v := os.Getenv(IMG_MAX_HEIGHT); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			cfg.ImgMaxHeight = n
-		} else {
-			log.Printf("Invalid %s=%q, using %d", IMG_MAX_HEIGHT, v, cfg.ImgMaxHeight)
-		}
+// LoadConfig builds the configuration with the precedence
+// defaults < config file < environment variables.
+// Invalid values are logged and the lower-precedence value is kept.
+func LoadConfig(path string) (*Config, error) {
+	cfg, problems, err := loadConfig(path, nil)
+	if err != nil {
+		return nil, err
 	}
+	for _, problem := range problems {
+		log.Println(problem)
+	}
+	return cfg, nil
+}
 
-	if v := os.Getenv(IMG_MAX_NARROW_SIDE); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
-			cfg.ImgMaxNarrowSide = n
-		} else {
-			log.Printf("Invalid %s=%q, using %d", IMG_MAX_NARROW_SIDE, v, cfg.ImgMaxNarrowSide)
+// loadConfig is LoadConfig without logging. Command-line flags, keyed by
+// Env, take precedence over everything else. It returns every invalid or
+// unknown value as a problem; err is only set if the file cannot be read.
+func loadConfig(path string, flagValues map[string]string) (*Config, []error, error) {
+	fileValues := map[string]string{}
+	if path != "" {
+		var err error
+		fileValues, err = readConfigFile(path)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
-	if v := os.Getenv(JPEG_QUALITY); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 100 {
-			cfg.JpegQuality = n
-		} else {
-			log.Printf("Invalid %s=%q, using %d", JPEG_QUALITY, v, cfg.JpegQuality)
+	var problems []error
+	cfg := defaultConfig()
+	cfg.sources = make(map[string]string, len(settings))
+	for _, s := range settings {
+		cfg.sources[s.Env] = "default"
+		if v, ok := fileValues[s.Key]; ok {
+			delete(fileValues, s.Key)
+			if err := s.Set(cfg, v); err != nil {
+				problems = append(problems, fmt.Errorf("Invalid %s=%q in %s, using %q: %v", s.Key, v, path, s.Get(cfg), err))
+			} else {
+				cfg.sources[s.Env] = "file " + path
+			}
+		}
+		if v := os.Getenv(s.Env); v != "" {
+			if err := s.Set(cfg, v); err != nil {
+				problems = append(problems, fmt.Errorf("Invalid %s=%q, using %q: %v", s.Env, v, s.Get(cfg), err))
+			} else {
+				cfg.sources[s.Env] = "environment"
+			}
+		}
+		if v, ok := flagValues[s.Env]; ok {
+			if err := s.Set(cfg, v); err != nil {
+				problems = append(problems, fmt.Errorf("Invalid -%s=%q, using %q: %v", s.Flag(), v, s.Get(cfg), err))
+			} else {
+				cfg.sources[s.Env] = "flag"
+			}
 		}
 	}
 
-	if v := os.Getenv(WEBP_QUALITY); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 100 {
-			cfg.WebpQuality = n
-		} else {
-			log.Printf("Invalid %s=%q, using %d", WEBP_QUALITY, v, cfg.WebpQuality)
-		}
+	unknown := make([]string, 0, len(fileValues))
+	for key := range fileValues {
+		unknown = append(unknown, key)
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		problems = append(problems, fmt.Errorf("Unknown setting %q in %s", key, path))
 	}
 
-	if v := os.Getenv(NORMALIZE_EXTENSIONS); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && (n == 0 || n == 1) {
-			cfg.NormalizeExt = (n == 1)
-		} else {
-			log.Printf("Invalid %s=%q, using %t", NORMALIZE_EXTENSIONS, v, cfg.NormalizeExt)
-		}
+	if cfg.usesS3() && (cfg.S3AccessKeyID == "" || cfg.S3SecretAccessKey == "") {
+		problems = append(problems, errS3Credentials)
 	}
 
-	if v := os.Getenv(UPLOAD_MAX_SIZE); v != "" {
-		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
-			cfg.UploadMaxSize = n
-		} else {
-			log.Printf("Invalid %s=%q, using %d", UPLOAD_MAX_SIZE, v, cfg.UploadMaxSize)
-		}
+	cfg.ImgMaxPixels = int64(cfg.ImgMaxWidth) * int64(cfg.ImgMaxHeight)
+
+	return cfg, problems, nil
+}
+
+func intSetting(env string, min, max int, field func(*Config) *int) setting {
+	return setting{
+		Env: env,
+		Set: func(cfg *Config, v string) error {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return err
+			}
+			if n < min || (max > 0 && n > max) {
+				if max > 0 {
+					return fmt.Errorf("must be between %d and %d", min, max)
+				}
+				return fmt.Errorf("must be at least %d", min)
+			}
+			*field(cfg) = n
+			return nil
+		},
+		Get: func(cfg *Config) string { return strconv.Itoa(*field(cfg)) },
 	}
+}
 
-	if v := os.Getenv(FORWARD_DESTINATION); v != "" {
-		cfg.ForwardDestination = v
+func int64Setting(env string, min int64, field func(*Config) *int64) setting {
+	return setting{
+		Env: env,
+		Set: func(cfg *Config, v string) error {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return err
+			}
+			if n < min {
+				return fmt.Errorf("must be at least %d", min)
+			}
+			*field(cfg) = n
+			return nil
+		},
+		Get: func(cfg *Config) string { return strconv.FormatInt(*field(cfg), 10) },
 	}
+}
 
-	if v := os.Getenv(FILE_UPLOAD_FIELD); v != "" {
-		cfg.FileUploadField = v
+// boolSetting accepts 1 and 0, matching the documented environment values.
+func boolSetting(env string, field func(*Config) *bool) setting {
+	return setting{
+		Env:    env,
+		IsBool: true,
+		Set: func(cfg *Config, v string) error {
+			switch strings.TrimSpace(v) {
+			case "1":
+				*field(cfg) = true
+			case "0":
+				*field(cfg) = false
+			default:
+				return fmt.Errorf("must be 0 or 1")
+			}
+			return nil
+		},
+		Get: func(cfg *Config) string {
+			if *field(cfg) {
+				return "1"
+			}
+			return "0"
+		},
 	}
+}
 
-	if v := os.Getenv(LISTEN_PATH); v != "" {
-		cfg.ListenPath = v
+func durationSetting(env string, field func(*Config) *time.Duration) setting {
+	return setting{
+		Env: env,
+		Set: func(cfg *Config, v string) error {
+			d, err := time.ParseDuration(strings.TrimSpace(v))
+			if err != nil {
+				return err
+			}
+			if d < 0 {
+				return fmt.Errorf("must not be negative")
+			}
+			*field(cfg) = d
+			return nil
+		},
+		Get: func(cfg *Config) string { return field(cfg).String() },
 	}
+}
 
-	if v := os.Getenv(CONVERT_TO_FORMAT); v != "" {
-		normalizedFormat := strings.ToUpper(strings.TrimSpace(v))
-		if normalizedFormat == "JPG" {
-			normalizedFormat = "JPEG"
-		}
-		if normalizedFormat == "" || normalizedFormat == "JPEG" || normalizedFormat == "WEBP" {
-			cfg.ConvertToFormat = normalizedFormat
-		} else {
-			log.Printf("Invalid %s=%q, using %q (valid values: \"\", \"JPEG\", \"JPG\", \"WEBP\")",
-				CONVERT_TO_FORMAT, v, cfg.ConvertToFormat)
-		}
+// pathSetting accepts URL paths, which must start with a slash.
+func pathSetting(env string, field func(*Config) *string) setting {
+	return setting{
+		Env: env,
+		Set: func(cfg *Config, v string) error {
+			if !strings.HasPrefix(v, "/") {
+				return fmt.Errorf("must start with /")
+			}
+			*field(cfg) = v
+			return nil
+		},
+		Get: func(cfg *Config) string { return *field(cfg) },
 	}
+}
 
-	cfg.ImgMaxPixels = int64(cfg.ImgMaxWidth) * int64(cfg.ImgMaxHeight)
+func stringSetting(env string, field func(*Config) *string) setting {
+	return setting{
+		Env: env,
+		Set: func(cfg *Config, v string) error {
+			*field(cfg) = v
+			return nil
+		},
+		Get: func(cfg *Config) string { return *field(cfg) },
+	}
+}
 
+// secretSetting is a string setting that Get shows as "***".
+func secretSetting(env string, field func(*Config) *string) setting {
+	s := stringSetting(env, field)
+	s.Get = func(cfg *Config) string {
+		if *field(cfg) == "" {
+			return ""
+		}
+		return "***"
+	}
+	s.Value = func(cfg *Config) string { return *field(cfg) }
+	return s
+}
 
-	return cfg
+func headerNamesSetting(env string, field func(*Config) *[]string) setting {
+	return setting{
+		Env: env,
+		Set: func(cfg *Config, v string) error {
+			*field(cfg) = parseHeaderNames(v)
+			return nil
+		},
+		Get: func(cfg *Config) string { return strings.Join(*field(cfg), ",") },
+	}
+}
+
+// headerValuesSetting accepts "Name: value; Name: value" or a JSON object.
+// Values are not shown by Get since they are typically credentials.
+func headerValuesSetting(env string, field func(*Config) *http.Header) setting {
+	return setting{
+		Env: env,
+		Set: func(cfg *Config, v string) error {
+			var h http.Header
+			var err error
+			if strings.HasPrefix(strings.TrimSpace(v), "{") {
+				var raw map[string]string
+				if err = json.Unmarshal([]byte(v), &raw); err == nil {
+					h = http.Header{}
+					for name, value := range raw {
+						h.Set(name, value)
+					}
+				}
+			} else {
+				h, err = parseHeaderValues(v)
+			}
+			if err != nil {
+				return err
+			}
+			*field(cfg) = h
+			return nil
+		},
+		Get: func(cfg *Config) string {
+			names := make([]string, 0, len(*field(cfg)))
+			for name := range *field(cfg) {
+				names = append(names, name+": ***")
+			}
+			sort.Strings(names)
+			return strings.Join(names, "; ")
+		},
+		Value: func(cfg *Config) string {
+			values := make([]string, 0, len(*field(cfg)))
+			for name, v := range *field(cfg) {
+				values = append(values, name+": "+strings.Join(v, ", "))
+			}
+			sort.Strings(values)
+			return strings.Join(values, "; ")
+		},
+	}
 }
 
+// validateUpstreamURL makes sure an upstream is an absolute http(s) URL, so
+// a typo fails loudly instead of sending uploads somewhere unexpected.
+func validateUpstreamURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("must include a host")
+	}
+	return nil
+}
 
+// normalizeConvertFormat accepts "", "JPEG", "JPG" and "WEBP" in any case
+// and returns the canonical spelling.
+func normalizeConvertFormat(v string) (string, bool) {
+	normalizedFormat := strings.ToUpper(strings.TrimSpace(v))
+	if normalizedFormat == "JPG" {
+		normalizedFormat = "JPEG"
+	}
+	if normalizedFormat == "" || normalizedFormat == "JPEG" || normalizedFormat == "WEBP" {
+		return normalizedFormat, true
+	}
+	return "", false
+}
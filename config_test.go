@@ -271,6 +271,104 @@ func TestNewConfigFromEnv_NarrowSideZeroAllowed(t *testing.T) {
 	}
 }
 
+func TestNewConfigFromEnv_HeaderRules(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	cfg := NewConfigFromEnv()
+	if !containsHeader(cfg.RequestHeaders.Strip, "Origin") {
+		t.Errorf("RequestHeaders.Strip = %v, want default list containing Origin", cfg.RequestHeaders.Strip)
+	}
+
+	os.Setenv("REQUEST_STRIP_HEADERS", "cf-ray")
+	os.Setenv("RESPONSE_STRIP_HEADERS", "none")
+	os.Setenv("REQUEST_ALLOW_HEADERS", "Authorization, Origin")
+	os.Setenv("REQUEST_SET_HEADERS", "X-Api-Key: secret")
+	os.Setenv("REQUEST_ADD_HEADERS", "not a header")
+
+	cfg = NewConfigFromEnv()
+
+	if len(cfg.RequestHeaders.Strip) != 1 || cfg.RequestHeaders.Strip[0] != "Cf-Ray" {
+		t.Errorf("RequestHeaders.Strip = %v, want [Cf-Ray]", cfg.RequestHeaders.Strip)
+	}
+	if len(cfg.ResponseHeaders.Strip) != 0 {
+		t.Errorf("ResponseHeaders.Strip = %v, want empty", cfg.ResponseHeaders.Strip)
+	}
+	if len(cfg.RequestHeaders.Allow) != 2 {
+		t.Errorf("RequestHeaders.Allow = %v, want 2 entries", cfg.RequestHeaders.Allow)
+	}
+	if cfg.RequestHeaders.Set.Get("X-Api-Key") != "secret" {
+		t.Errorf("RequestHeaders.Set = %v, want X-Api-Key: secret", cfg.RequestHeaders.Set)
+	}
+	if cfg.RequestHeaders.Add != nil {
+		t.Errorf("RequestHeaders.Add = %v, want nil for invalid value", cfg.RequestHeaders.Add)
+	}
+}
+
+func TestNewConfigFromEnv_RoutesAndProfiles(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	os.Setenv("JPEG_QUALITY", "70")
+	os.Setenv("PROFILES", `{"phone": {"max_width": 1280}}`)
+	os.Setenv("ROUTES", `[{"path": "/api/assets", "profile": "phone"}]`)
+
+	cfg := NewConfigFromEnv()
+
+	if cfg.Profiles["phone"].JpegQuality != 70 {
+		t.Errorf("phone JpegQuality = %d, want 70 inherited from JPEG_QUALITY", cfg.Profiles["phone"].JpegQuality)
+	}
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Profile != "phone" {
+		t.Errorf("Routes = %+v, want one route using the phone profile", cfg.Routes)
+	}
+
+	os.Setenv("ROUTES", `[{"path": "/api/assets", "profile": "tablet"}]`)
+	cfg = NewConfigFromEnv()
+	if len(cfg.Routes) != 0 {
+		t.Errorf("Routes = %+v, want none for route with unknown profile", cfg.Routes)
+	}
+}
+
+func TestNewConfigFromEnv_PathRules(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	os.Setenv("STRIP_PATH_PREFIX", "/upload-proxy")
+	os.Setenv("ADD_PATH_PREFIX", "/api")
+	os.Setenv("PATH_REWRITES", "([ => /x")
+
+	cfg := NewConfigFromEnv()
+
+	route := cfg.defaultRoute()
+	if route.StripPrefix != "/upload-proxy" || route.AddPrefix != "/api" {
+		t.Errorf("default route prefixes = %q/%q, want /upload-proxy and /api", route.StripPrefix, route.AddPrefix)
+	}
+	if len(route.Rewrites) != 0 {
+		t.Errorf("Rewrites = %v, want none for invalid PATH_REWRITES", route.Rewrites)
+	}
+}
+
+func TestNewConfigFromEnv_InvalidURLsAndPaths(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	os.Setenv("FORWARD_DESTINATION", "immich-server:3001/api/assets")
+	os.Setenv("LISTEN_PATH", "api/assets")
+	os.Setenv("ROUTES", `[{"path": "/x", "upstream": "ftp://files"}]`)
+
+	cfg := NewConfigFromEnv()
+
+	if cfg.ForwardDestination != "https://httpbin.org/anything" {
+		t.Errorf("ForwardDestination = %q, want default for invalid URL", cfg.ForwardDestination)
+	}
+	if cfg.ListenPath != "/api/assets" {
+		t.Errorf("ListenPath = %q, want default for path without leading slash", cfg.ListenPath)
+	}
+	if len(cfg.Routes) != 0 {
+		t.Errorf("Routes = %+v, want none for route with invalid upstream", cfg.Routes)
+	}
+}
+
 func clearAllTestEnvVars() {
 	envVars := []string{
 		"IMG_MAX_WIDTH",
@@ -280,10 +378,80 @@ func clearAllTestEnvVars() {
 		"WEBP_QUALITY",
 		"NORMALIZE_EXTENSIONS",
 		"UPLOAD_MAX_SIZE",
+		"UPLOAD_MAX_FILE_SIZE",
+		"BODY_MAX_SIZE",
+		"UPLOAD_MEMORY_LIMIT",
+		"SPOOL_DIR",
+		"SPOOL_MAX_SIZE",
 		"FORWARD_DESTINATION",
 		"FILE_UPLOAD_FIELD",
 		"LISTEN_PATH",
 		"CONVERT_TO_FORMAT",
+		"REQUEST_STRIP_HEADERS",
+		"RESPONSE_STRIP_HEADERS",
+		"REQUEST_ALLOW_HEADERS",
+		"RESPONSE_ALLOW_HEADERS",
+		"REQUEST_SET_HEADERS",
+		"REQUEST_ADD_HEADERS",
+		"STRIP_PATH_PREFIX",
+		"ADD_PATH_PREFIX",
+		"PATH_REWRITES",
+		"FIELD_REWRITES",
+		"RAW_UPLOADS",
+		"RAW_RENAME_PATH",
+		"JSON_FIELDS",
+		"WEBDAV",
+		"TUS",
+		"TUS_DELIVERY",
+		"TUS_DIR",
+		"TUS_EXPIRY",
+		"S3",
+		"S3_ACCESS_KEY_ID",
+		"S3_SECRET_ACCESS_KEY",
+		"S3_REGION",
+		"S3_VERIFY_SIGNATURE",
+		"S3_DIR",
+		"S3_EXPIRY",
+		"PROFILES",
+		"ROUTES",
+		"CONFIG_FILE",
+		"CONFIG_RELOAD_INTERVAL",
+		"STRICT_CONFIG",
+		"DRY_RUN",
+		"ADMIN_LISTEN_ADDR",
+		"REPORT_HEADERS",
+		"REPORT_RESPONSE_HEADERS",
+		"OVERRIDE_SECRET",
+		"OVERRIDE_ALLOW",
+		"CLIENT_RULES",
+		"RETRY_ATTEMPTS",
+		"RETRY_BACKOFF",
+		"RETRY_MAX_BACKOFF",
+		"RETRY_STATUSES",
+		"RETRY_DEADLINE",
+		"QUEUE_MAX_BYTES",
+		"UPSTREAM_EJECT_THRESHOLD",
+		"UPSTREAM_EJECT_DURATION",
+		"UPSTREAM_DIAL_TIMEOUT",
+		"UPSTREAM_TLS_TIMEOUT",
+		"UPSTREAM_RESPONSE_TIMEOUT",
+		"UPSTREAM_TIMEOUT",
+		"UPSTREAM_MAX_IDLE_CONNS",
+		"UPSTREAM_MAX_IDLE_CONNS_PER_HOST",
+		"UPSTREAM_MAX_CONNS_PER_HOST",
+		"UPSTREAM_IDLE_CONN_TIMEOUT",
+		"UPSTREAM_HTTP2",
+		"UPSTREAM_TARGETS",
+		"UPSTREAM_BALANCING",
+		"UPSTREAM_HEALTH_PATH",
+		"UPSTREAM_HEALTH_INTERVAL",
+		"BREAKER_THRESHOLD",
+		"BREAKER_COOLDOWN",
+		"BREAKER_HALF_OPEN_REQUESTS",
+		"QUEUE_DIR",
+		"QUEUE_RETRY_INTERVAL",
+		"QUEUE_RESPONSE_STATUS",
+		"QUEUE_RESPONSE_BODY",
 	}
 	
 	for _, envVar := range envVars {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads a YAML, TOML or JSON config file into the same string
+// form the environment variables use, keyed by lower case setting name.
+// Nested values such as routes and profiles are passed on as JSON.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file type, use .yaml, .yml, .toml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		s, err := configValueString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		values[strings.ToLower(strings.ReplaceAll(key, "-", "_"))] = s
+	}
+	return values, nil
+}
+
+func configValueString(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case bool:
+		if val {
+			return "1", nil
+		}
+		return "0", nil
+	case int:
+		return strconv.Itoa(val), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case uint64:
+		return strconv.FormatUint(val, 10), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case []interface{}:
+		// Lists of plain values use the comma separated form of the
+		// environment variables, anything nested is passed on as JSON.
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return configValueJSON(v)
+			}
+			s, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return configValueJSON(v)
+	}
+}
+
+func configValueJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
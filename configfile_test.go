@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig_YAML(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	path := writeTestConfigFile(t, "proxy.yaml", `
+img_max_width: 2560
+jpeg_quality: 80
+normalize_extensions: false
+convert_to_format: jpg
+forward_destination: http://immich:3001/api/assets
+request_strip_headers: [Cf-Ray, Cf-Visitor]
+request_set_headers:
+  X-Api-Key: secret
+path_rewrites:
+  - match: ^/old/
+    replace: /new/
+profiles:
+  phone:
+    max_width: 1280
+routes:
+  - name: immich
+    path: /api/assets
+    profile: phone
+`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if cfg.ImgMaxWidth != 2560 {
+		t.Errorf("ImgMaxWidth = %d, want 2560", cfg.ImgMaxWidth)
+	}
+	if cfg.JpegQuality != 80 {
+		t.Errorf("JpegQuality = %d, want 80", cfg.JpegQuality)
+	}
+	if cfg.NormalizeExt {
+		t.Error("NormalizeExt = true, want false")
+	}
+	if cfg.ConvertToFormat != "JPEG" {
+		t.Errorf("ConvertToFormat = %q, want %q", cfg.ConvertToFormat, "JPEG")
+	}
+	if cfg.ForwardDestination != "http://immich:3001/api/assets" {
+		t.Errorf("ForwardDestination = %q", cfg.ForwardDestination)
+	}
+	if len(cfg.RequestHeaders.Strip) != 2 {
+		t.Errorf("RequestHeaders.Strip = %v, want 2 entries", cfg.RequestHeaders.Strip)
+	}
+	if cfg.RequestHeaders.Set.Get("X-Api-Key") != "secret" {
+		t.Errorf("RequestHeaders.Set = %v", cfg.RequestHeaders.Set)
+	}
+	if len(cfg.PathRewrites) != 1 || cfg.PathRewrites[0].Replacement != "/new/" {
+		t.Errorf("PathRewrites = %v", cfg.PathRewrites)
+	}
+	if cfg.Profiles["phone"].MaxWidth != 1280 || cfg.Profiles["phone"].JpegQuality != 80 {
+		t.Errorf("phone profile = %+v", cfg.Profiles["phone"])
+	}
+	if len(cfg.Routes) != 1 || cfg.Routes[0].ForwardDestination != cfg.ForwardDestination {
+		t.Errorf("Routes = %+v", cfg.Routes)
+	}
+}
+
+func TestLoadConfig_TOML(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	path := writeTestConfigFile(t, "proxy.toml", `
+img_max_height = 720
+upload_max_size = 209715200
+
+[profiles.originals]
+max_width = 100000
+max_height = 100000
+
+[[routes]]
+name = "wiki"
+path = "/wiki"
+file_fields = ["upload"]
+profile = "originals"
+`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if cfg.ImgMaxHeight != 720 {
+		t.Errorf("ImgMaxHeight = %d, want 720", cfg.ImgMaxHeight)
+	}
+	if cfg.UploadMaxSize != 209715200 {
+		t.Errorf("UploadMaxSize = %d, want 209715200", cfg.UploadMaxSize)
+	}
+	if len(cfg.Routes) != 1 || cfg.Routes[0].FileUploadFields[0] != "upload" {
+		t.Errorf("Routes = %+v", cfg.Routes)
+	}
+	if cfg.Profiles["originals"].MaxHeight != 100000 {
+		t.Errorf("originals profile = %+v", cfg.Profiles["originals"])
+	}
+}
+
+func TestLoadConfig_EnvOverridesFile(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	path := writeTestConfigFile(t, "proxy.yml", `
+jpeg_quality: 80
+webp_quality: 70
+img_max_width: 0
+`)
+	os.Setenv("JPEG_QUALITY", "60")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if cfg.JpegQuality != 60 {
+		t.Errorf("JpegQuality = %d, want 60 from environment", cfg.JpegQuality)
+	}
+	if cfg.WebpQuality != 70 {
+		t.Errorf("WebpQuality = %d, want 70 from file", cfg.WebpQuality)
+	}
+	if cfg.ImgMaxWidth != DEFAULT_IMG_MAX_WIDTH {
+		t.Errorf("ImgMaxWidth = %d, want default for invalid file value", cfg.ImgMaxWidth)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+	if _, err := LoadConfig(writeTestConfigFile(t, "proxy.ini", "a=b")); err == nil {
+		t.Error("Expected error for unsupported extension")
+	}
+	if _, err := LoadConfig(writeTestConfigFile(t, "proxy.yaml", "routes: [")); err == nil {
+		t.Error("Expected error for malformed YAML")
+	}
+}
+
+func TestNewConfigFromEnv_ConfigFile(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	os.Setenv("CONFIG_FILE", writeTestConfigFile(t, "proxy.json", `{"listen_path": "/upload"}`))
+	cfg := NewConfigFromEnv()
+	if cfg.ListenPath != "/upload" {
+		t.Errorf("ListenPath = %q, want %q", cfg.ListenPath, "/upload")
+	}
+
+	os.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	cfg = NewConfigFromEnv()
+	if cfg.ListenPath != "/api/assets" {
+		t.Errorf("ListenPath = %q, want default when config file is missing", cfg.ListenPath)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fieldSources are the values a form field can be rewritten to. Each one
+// describes the file as it is forwarded.
+var fieldSources = map[string]func(u uploadResult) string{
+	"extension": func(u uploadResult) string { return filepath.Ext(u.Filename) },
+	"filename":  func(u uploadResult) string { return u.Filename },
+	"mime":      func(u uploadResult) string { return u.MimeType },
+	"size":      func(u uploadResult) string { return strconv.Itoa(u.size()) },
+	"sha1":      func(u uploadResult) string { return u.digest(sha1.New()) },
+	"sha256":    func(u uploadResult) string { return u.digest(sha256.New()) },
+	"width":     func(u uploadResult) string { return dimensionValue(u.Dimensions.Width) },
+	"height":    func(u uploadResult) string { return dimensionValue(u.Dimensions.Height) },
+}
+
+func dimensionValue(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// rewriteFormValue returns the value for form field key. Fields listed in
+// rewrites describe the first uploaded file; all others keep their value, as
+// do fields whose source is unknown for the file, like the width of a
+// document.
+func rewriteFormValue(key, value string, rewrites map[string]string, uploads []uploadResult) string {
+	source, ok := rewrites[key]
+	if !ok || len(uploads) == 0 {
+		return value
+	}
+	if rewritten := fieldSources[source](uploads[0]); rewritten != "" {
+		return rewritten
+	}
+	return value
+}
+
+// parseFieldRewrites accepts "field=source, field=source" or a JSON object.
+func parseFieldRewrites(v string) (map[string]string, error) {
+	rewrites := map[string]string{}
+	if strings.HasPrefix(strings.TrimSpace(v), "{") {
+		if err := json.Unmarshal([]byte(v), &rewrites); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, entry := range strings.Split(v, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			field, source, found := strings.Cut(entry, "=")
+			if !found || strings.TrimSpace(field) == "" {
+				return nil, fmt.Errorf("invalid field rewrite %q, expected \"field=source\"", entry)
+			}
+			rewrites[strings.TrimSpace(field)] = strings.TrimSpace(source)
+		}
+	}
+	if err := validateFieldRewrites(rewrites); err != nil {
+		return nil, err
+	}
+	return rewrites, nil
+}
+
+func validateFieldRewrites(rewrites map[string]string) error {
+	for field, source := range rewrites {
+		if _, ok := fieldSources[source]; !ok {
+			names := make([]string, 0, len(fieldSources))
+			for name := range fieldSources {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("field %q: unknown source %q, valid: %s", field, source, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+func formatFieldRewrites(rewrites map[string]string) string {
+	entries := make([]string, 0, len(rewrites))
+	for field, source := range rewrites {
+		entries = append(entries, field+"="+source)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ", ")
+}
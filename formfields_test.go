@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseFieldRewrites(t *testing.T) {
+	rewrites, err := parseFieldRewrites("fileExtension=extension, fileSize = size")
+	if err != nil {
+		t.Fatalf("parseFieldRewrites failed: %v", err)
+	}
+	if rewrites["fileExtension"] != "extension" || rewrites["fileSize"] != "size" {
+		t.Errorf("rewrites = %v", rewrites)
+	}
+	if got := formatFieldRewrites(rewrites); got != "fileExtension=extension, fileSize=size" {
+		t.Errorf("formatFieldRewrites = %q", got)
+	}
+
+	rewrites, err = parseFieldRewrites(`{"checksum": "sha256"}`)
+	if err != nil || rewrites["checksum"] != "sha256" {
+		t.Errorf("JSON form = %v, %v", rewrites, err)
+	}
+
+	for _, v := range []string{"fileSize=bytes", "fileSize", `{"a": 1}`} {
+		if _, err := parseFieldRewrites(v); err == nil {
+			t.Errorf("parseFieldRewrites(%q) expected error", v)
+		}
+	}
+}
+
+func TestRewriteFormValue(t *testing.T) {
+	rewrites := map[string]string{"width": "width", "fileSize": "size"}
+	document := []uploadResult{{Filename: "notes.txt", Data: []byte("notes"), Outcome: "not_image"}}
+	if got := rewriteFormValue("width", "1600", rewrites, document); got != "1600" {
+		t.Errorf("width = %q, want the client's value for a file without dimensions", got)
+	}
+	if got := rewriteFormValue("fileSize", "100", rewrites, document); got != "5" {
+		t.Errorf("fileSize = %q, want 5", got)
+	}
+	if got := rewriteFormValue("deviceId", "WEB", rewrites, document); got != "WEB" {
+		t.Errorf("deviceId = %q, want WEB", got)
+	}
+}
+
+func TestReformatMultipartFieldRewrites(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("fileExtension", ".jpeg")
+	writer.WriteField("fileSize", strconv.Itoa(len(pngData)))
+	writer.WriteField("checksum", "original")
+	writer.WriteField("width", "1600")
+	writer.WriteField("deviceId", "WEB")
+	part, _ := writer.CreateFormFile("assetData", "photo.png")
+	part.Write(pngData)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/assets", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	cfg := &Config{
+		FileUploadField: "assetData",
+		ListenPath:      "/api/assets",
+		ImgMaxWidth:     400,
+		ImgMaxHeight:    400,
+		UploadMaxSize:   32 << 20,
+		FieldRewrites: map[string]string{
+			"fileExtension": "extension",
+			"fileSize":      "size",
+			"checksum":      "sha1",
+			"width":         "width",
+			"missing":       "size",
+		},
+	}
+
+	contentType, rebuilt, _, err := reformatMultipart(httptest.NewRecorder(), req, cfg, cfg.matchRoute(req))
+	if err != nil {
+		t.Fatalf("reformatMultipart failed: %v", err)
+	}
+	resultBody := readRequestBody(t, rebuilt)
+
+	result := httptest.NewRequest("POST", "/", resultBody)
+	result.Header.Set("Content-Type", contentType)
+	if err := result.ParseMultipartForm(32 << 20); err != nil {
+		t.Fatalf("Failed to parse result: %v", err)
+	}
+	f, _ := result.MultipartForm.File["assetData"][0].Open()
+	forwarded, _ := io.ReadAll(f)
+	f.Close()
+	sum := sha1.Sum(forwarded)
+
+	want := map[string]string{
+		"fileExtension": ".png",
+		"fileSize":      strconv.Itoa(len(forwarded)),
+		"checksum":      hex.EncodeToString(sum[:]),
+		"width":         "400",
+		"deviceId":      "WEB",
+	}
+	for field, value := range want {
+		if got := result.FormValue(field); got != value {
+			t.Errorf("%s = %q, want %q", field, got, value)
+		}
+	}
+	if _, ok := result.MultipartForm.Value["missing"]; ok {
+		t.Error("Rewrites should not add fields the client did not send")
+	}
+}
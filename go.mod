@@ -2,4 +2,8 @@ module github.com/JamesCullum/multipart-upload-proxy
 
 go 1.22
 
-require github.com/h2non/bimg v1.1.9
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/h2non/bimg v1.1.9
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Hop-by-hop headers only make sense for a single connection, so they are
+// always dropped regardless of the configured rules.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// defaultStripHeaders is what the proxy stripped before the lists became
+// configurable, and is used for both directions unless overridden.
+var defaultStripHeaders = []string{
+	"Accept-Encoding",
+	"Host",
+	"Cf-Ipcountry",
+	"Cf-Connecting-Ip",
+	"X-Forwarded-Proto",
+	"X-Forwarded-For",
+	"Cf-Ray",
+	"Cf-Visitor",
+	"Cf-Warp-Tag-Id",
+	"Content-Type",
+	"Origin",
+	"X-Amzn-Trace-Id",
+}
+
+// HeaderRules decides which headers are copied in one direction of the proxy
+// and which static headers are injected afterwards.
+type HeaderRules struct {
+	// Allow, when non-empty, is the only set of headers that is copied.
+	Allow []string
+	// Strip lists headers that are never copied.
+	Strip []string
+	// Set overrides any copied value, Add appends to it.
+	Set http.Header
+	Add http.Header
+}
+
+func (hr HeaderRules) allows(name string) bool {
+	if containsHeader(hopHeaders, name) || containsHeader(hr.Strip, name) {
+		return false
+	}
+	return len(hr.Allow) == 0 || containsHeader(hr.Allow, name)
+}
+
+// Apply copies the allowed headers from src to dst and injects the static ones.
+func (hr HeaderRules) Apply(dst, src http.Header) {
+	copyHeader(dst, src, hr)
+	for k, vv := range hr.Set {
+		dst.Del(k)
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+	for k, vv := range hr.Add {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func copyHeader(dst, src http.Header, rules HeaderRules) {
+	for k, vv := range src {
+		if !rules.allows(k) {
+			continue
+		}
+
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func containsHeader(list []string, name string) bool {
+	for _, h := range list {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHeaderNames parses a comma separated list of header names. The value
+// "none" yields an empty list so the defaults can be switched off entirely.
+func parseHeaderNames(v string) []string {
+	names := []string{}
+	if strings.EqualFold(strings.TrimSpace(v), "none") {
+		return names
+	}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// parseHeaderValues parses "Name: value; Other-Name: value" into a header map.
+func parseHeaderValues(v string) (http.Header, error) {
+	h := http.Header{}
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, found := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", entry)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, nil
+}
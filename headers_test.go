@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRulesApply(t *testing.T) {
+	src := http.Header{
+		"Connection":   {"keep-alive"},
+		"Origin":       {"https://photos.example.com"},
+		"Cf-Ray":       {"abc123"},
+		"X-Api-Key":    {"client-key"},
+		"X-Custom":     {"one"},
+		"Content-Type": {"multipart/form-data"},
+	}
+
+	tests := []struct {
+		name     string
+		rules    HeaderRules
+		expected http.Header
+	}{
+		{
+			name:  "Default strip list",
+			rules: HeaderRules{Strip: defaultStripHeaders},
+			expected: http.Header{
+				"X-Api-Key": {"client-key"},
+				"X-Custom":  {"one"},
+			},
+		},
+		{
+			name:  "Custom strip list keeps Origin but still drops hop-by-hop",
+			rules: HeaderRules{Strip: []string{"cf-ray", "content-type"}},
+			expected: http.Header{
+				"Origin":    {"https://photos.example.com"},
+				"X-Api-Key": {"client-key"},
+				"X-Custom":  {"one"},
+			},
+		},
+		{
+			name:  "Allow list",
+			rules: HeaderRules{Allow: []string{"Origin", "X-Custom", "Connection"}},
+			expected: http.Header{
+				"Origin":   {"https://photos.example.com"},
+				"X-Custom": {"one"},
+			},
+		},
+		{
+			name: "Set overrides and Add appends",
+			rules: HeaderRules{
+				Strip: defaultStripHeaders,
+				Set:   http.Header{"X-Api-Key": {"upstream-key"}},
+				Add:   http.Header{"X-Custom": {"two"}},
+			},
+			expected: http.Header{
+				"X-Api-Key": {"upstream-key"},
+				"X-Custom":  {"one", "two"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := http.Header{}
+			tt.rules.Apply(dst, src)
+			if !reflect.DeepEqual(dst, tt.expected) {
+				t.Errorf("Apply() = %v, want %v", dst, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseHeaderNames(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"origin, cf-ray ,", []string{"Origin", "Cf-Ray"}},
+		{"none", []string{}},
+		{"NONE", []string{}},
+	}
+
+	for _, tt := range tests {
+		result := parseHeaderNames(tt.input)
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("parseHeaderNames(%q) = %v, want %v", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestParseHeaderValues(t *testing.T) {
+	h, err := parseHeaderValues("X-Api-Key: secret; Authorization: Bearer a:b ;")
+	if err != nil {
+		t.Fatalf("parseHeaderValues returned error: %v", err)
+	}
+	if h.Get("X-Api-Key") != "secret" {
+		t.Errorf("X-Api-Key = %q, want %q", h.Get("X-Api-Key"), "secret")
+	}
+	if h.Get("Authorization") != "Bearer a:b" {
+		t.Errorf("Authorization = %q, want %q", h.Get("Authorization"), "Bearer a:b")
+	}
+
+	if _, err := parseHeaderValues("X-Api-Key secret"); err == nil {
+		t.Error("Expected error for entry without colon")
+	}
+}
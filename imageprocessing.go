@@ -21,13 +21,24 @@ type ImageProcessingSettings struct {
 }
 
 type ImageProcessingResult struct {
-	ProcessedData   []byte
-	WasCompressed   bool
-	WasResized      bool
-	NewDimensions   ImageSize
+	ProcessedData      []byte
+	WasCompressed      bool
+	WasResized         bool
+	OriginalDimensions ImageSize
+	NewDimensions      ImageSize
+	// SkipReason explains why the original image was kept, if it was.
+	SkipReason      string
 	ProcessingError error
 }
 
+const (
+	SKIP_REASON_TRANSPARENCY     = "transparency"
+	SKIP_REASON_WITHIN_LIMITS    = "within-limits"
+	SKIP_REASON_LARGER_OUTPUT    = "larger-output"
+	SKIP_REASON_PROCESSING_ERROR = "processing-error"
+	SKIP_REASON_DRY_RUN          = "dry-run"
+)
+
 func detectImageTransparency(imageData []byte) (bool, error) {
 	image := bimg.NewImage(imageData)
 	metadata, err := image.Metadata()
@@ -48,6 +59,7 @@ func processImageWithStrategy(originalData []byte, settings ImageProcessingSetti
 				WasCompressed:   false,
 				WasResized:      false,
 				NewDimensions:   ImageSize{},
+				SkipReason:      SKIP_REASON_TRANSPARENCY,
 				ProcessingError: nil,
 			}, nil
 		}
@@ -60,6 +72,7 @@ func processImageWithStrategy(originalData []byte, settings ImageProcessingSetti
 			WasCompressed:   false,
 			WasResized:      false,
 			NewDimensions:   ImageSize{},
+			SkipReason:      SKIP_REASON_PROCESSING_ERROR,
 			ProcessingError: err,
 		}, err
 	}
@@ -72,10 +85,13 @@ func processImageWithStrategy(originalData []byte, settings ImageProcessingSetti
 			WasCompressed:   false,
 			WasResized:      false,
 			NewDimensions:   ImageSize{},
+			SkipReason:      SKIP_REASON_PROCESSING_ERROR,
 			ProcessingError: err,
 		}, err
 	}
 
+	originalDimensions := ImageSize{Width: oldImageSize.Width, Height: oldImageSize.Height}
+
 	// Calculate resize dimensions
 	newDimensions := calculateResizeDimensions(
 		ImageSize{Width: oldImageSize.Width, Height: oldImageSize.Height},
@@ -89,11 +105,13 @@ func processImageWithStrategy(originalData []byte, settings ImageProcessingSetti
 		if !needsResize {
 			// No processing needed
 			return &ImageProcessingResult{
-				ProcessedData:   rotatedData,
-				WasCompressed:   false,
-				WasResized:      false,
-				NewDimensions:   ImageSize{Width: oldImageSize.Width, Height: oldImageSize.Height},
-				ProcessingError: nil,
+				ProcessedData:      rotatedData,
+				WasCompressed:      false,
+				WasResized:         false,
+				OriginalDimensions: originalDimensions,
+				NewDimensions:      originalDimensions,
+				SkipReason:         SKIP_REASON_WITHIN_LIMITS,
+				ProcessingError:    nil,
 			}, nil
 		}
 
@@ -106,19 +124,22 @@ func processImageWithStrategy(originalData []byte, settings ImageProcessingSetti
 		processedData, err := workingImage.Process(options)
 		if err != nil {
 			return &ImageProcessingResult{
-				ProcessedData:   rotatedData,
-				WasCompressed:   false,
-				WasResized:      false,
-				NewDimensions:   ImageSize{Width: oldImageSize.Width, Height: oldImageSize.Height},
-				ProcessingError: err,
+				ProcessedData:      rotatedData,
+				WasCompressed:      false,
+				WasResized:         false,
+				OriginalDimensions: originalDimensions,
+				NewDimensions:      originalDimensions,
+				SkipReason:         SKIP_REASON_PROCESSING_ERROR,
+				ProcessingError:    err,
 			}, err
 		}
 
 		return &ImageProcessingResult{
-			ProcessedData: processedData,
-			WasCompressed: false, // We didn't change format, just resized
-			WasResized:    true,  // We did resize the image
-			NewDimensions: newDimensions,
+			ProcessedData:      processedData,
+			WasCompressed:      false, // We didn't change format, just resized
+			WasResized:         true,  // We did resize the image
+			OriginalDimensions: originalDimensions,
+			NewDimensions:      newDimensions,
 		}, nil
 	}
 
@@ -151,11 +172,13 @@ func processImageWithStrategy(originalData []byte, settings ImageProcessingSetti
 	processedData, err := workingImage.Process(options)
 	if err != nil {
 		return &ImageProcessingResult{
-			ProcessedData:   rotatedData,  // Return rotated data even if processing fails
-			WasCompressed:   false,
-			NewDimensions:   ImageSize{Width: oldImageSize.Width, Height: oldImageSize.Height},
-			WasResized:      false,
-			ProcessingError: err,
+			ProcessedData:      rotatedData,  // Return rotated data even if processing fails
+			WasCompressed:      false,
+			OriginalDimensions: originalDimensions,
+			NewDimensions:      originalDimensions,
+			WasResized:         false,
+			SkipReason:         SKIP_REASON_PROCESSING_ERROR,
+			ProcessingError:    err,
 		}, err
 	}
 
@@ -164,19 +187,23 @@ func processImageWithStrategy(originalData []byte, settings ImageProcessingSetti
 	wasResized := newDimensions.Width != oldImageSize.Width || newDimensions.Height != oldImageSize.Height
 	
 	var finalData []byte
+	var skipReason string
 	if wasCompressed {
 		finalData = processedData
 		log.Printf("Conversion to %s successful: %d → %d bytes", convertFormat, len(rotatedData), len(processedData))
 	} else {
 		finalData = rotatedData  // Use rotated data (preserves EXIF rotation)
+		skipReason = SKIP_REASON_LARGER_OUTPUT
 		log.Printf("Conversion to %s skipped - would increase size: %d → %d bytes", convertFormat, len(rotatedData), len(processedData))
 	}
 
 	return &ImageProcessingResult{
-		ProcessedData: finalData,
-		WasCompressed: wasCompressed,
-		WasResized:    wasResized,
-		NewDimensions: newDimensions,
+		ProcessedData:      finalData,
+		WasCompressed:      wasCompressed,
+		WasResized:         wasResized,
+		OriginalDimensions: originalDimensions,
+		NewDimensions:      newDimensions,
+		SkipReason:         skipReason,
 	}, nil
 }
 
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSONField locates base64 or data URI encoded images in JSON request
+// bodies. MimeField and FilenameField name sibling keys of the image that
+// are updated along with it.
+type JSONField struct {
+	Path          jsonPath
+	MimeField     string
+	FilenameField string
+}
+
+// jsonFieldConfig is the serialized form used by JSON_FIELDS and routes.
+type jsonFieldConfig struct {
+	Path          string `json:"path"`
+	MimeField     string `json:"mime_field,omitempty"`
+	FilenameField string `json:"filename_field,omitempty"`
+}
+
+// jsonPath is a small JSONPath subset: $.key, $.list[0] and $.list[*],
+// ending in an object key.
+type jsonPath struct {
+	raw      string
+	segments []jsonPathSegment
+}
+
+type jsonPathSegment struct {
+	key      string
+	index    int
+	wildcard bool
+}
+
+func parseJSONPath(v string) (jsonPath, error) {
+	p := jsonPath{raw: v}
+	rest := strings.TrimSpace(v)
+	if !strings.HasPrefix(rest, "$") {
+		return p, fmt.Errorf("JSON path %q must start with $", v)
+	}
+	rest = rest[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return p, fmt.Errorf("JSON path %q has an empty key", v)
+			}
+			p.segments = append(p.segments, jsonPathSegment{key: key, index: -1})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return p, fmt.Errorf("JSON path %q has an unterminated [", v)
+			}
+			inner := rest[1:end]
+			if inner == "*" {
+				p.segments = append(p.segments, jsonPathSegment{index: -1, wildcard: true})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return p, fmt.Errorf("JSON path %q has an invalid index %q", v, inner)
+				}
+				p.segments = append(p.segments, jsonPathSegment{index: index})
+			}
+			rest = rest[end+1:]
+		default:
+			return p, fmt.Errorf("JSON path %q: unexpected %q", v, rest[0])
+		}
+	}
+	if len(p.segments) == 0 || p.segments[len(p.segments)-1].key == "" {
+		return p, fmt.Errorf("JSON path %q must end in an object key", v)
+	}
+	return p, nil
+}
+
+func (p jsonPath) String() string {
+	return p.raw
+}
+
+// visit calls fn with the object and key of every value the path matches.
+func (p jsonPath) visit(node interface{}, fn func(obj map[string]interface{}, key string)) {
+	visitJSONPath(node, p.segments, fn)
+}
+
+func visitJSONPath(node interface{}, segments []jsonPathSegment, fn func(obj map[string]interface{}, key string)) {
+	seg := segments[0]
+	switch {
+	case seg.key != "":
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return
+		}
+		if len(segments) == 1 {
+			if _, exists := obj[seg.key]; exists {
+				fn(obj, seg.key)
+			}
+			return
+		}
+		visitJSONPath(obj[seg.key], segments[1:], fn)
+	case seg.wildcard:
+		list, _ := node.([]interface{})
+		for _, item := range list {
+			visitJSONPath(item, segments[1:], fn)
+		}
+	default:
+		list, _ := node.([]interface{})
+		if seg.index < len(list) {
+			visitJSONPath(list[seg.index], segments[1:], fn)
+		}
+	}
+}
+
+// isJSONRequest accepts application/json and +json media types.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// processJSONUpload processes the images embedded in a JSON body. The body
+// is only re-encoded if an image changed; otherwise it is returned as is.
+func processJSONUpload(w http.ResponseWriter, route *Route, profile ProcessingProfile, data []byte) ([]byte, []uploadResult) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		log.Printf("Forwarding JSON body unprocessed, cannot decode it: %v", err)
+		return data, nil
+	}
+
+	var uploads []uploadResult
+	changed := false
+	for _, field := range route.JSONFields {
+		field.Path.visit(doc, func(obj map[string]interface{}, key string) {
+			encoded, ok := obj[key].(string)
+			if !ok {
+				return
+			}
+			upload, value, ok := processEmbeddedImage(w, field, obj, encoded, profile)
+			if !ok {
+				return
+			}
+			uploads = append(uploads, upload)
+			if value == encoded {
+				return
+			}
+			obj[key] = value
+			if field.MimeField != "" {
+				if _, exists := obj[field.MimeField]; exists {
+					obj[field.MimeField] = upload.MimeType
+				}
+			}
+			if field.FilenameField != "" {
+				if _, exists := obj[field.FilenameField]; exists {
+					obj[field.FilenameField] = upload.Filename
+				}
+			}
+			changed = true
+		})
+	}
+	if !changed {
+		return data, uploads
+	}
+
+	out := &bytes.Buffer{}
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		log.Printf("Forwarding JSON body unprocessed, cannot encode it: %v", err)
+		return data, uploads
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), uploads
+}
+
+// processEmbeddedImage decodes one base64 or data URI value, processes it
+// and returns the value to write back in the same encoding.
+func processEmbeddedImage(w http.ResponseWriter, field JSONField, obj map[string]interface{}, encoded string, profile ProcessingProfile) (uploadResult, string, bool) {
+	var mimeType string
+	isDataURI := strings.HasPrefix(encoded, "data:")
+	payload := encoded
+	if isDataURI {
+		header, rest, found := strings.Cut(encoded[len("data:"):], ",")
+		if !found || !strings.HasSuffix(header, ";base64") {
+			return uploadResult{}, "", false
+		}
+		mimeType, payload = strings.TrimSuffix(header, ";base64"), rest
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		log.Printf("Skipping %s, not valid base64: %v", field.Path, err)
+		return uploadResult{}, "", false
+	}
+
+	if mimeType == "" && field.MimeField != "" {
+		mimeType, _ = obj[field.MimeField].(string)
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	filename := "upload"
+	if field.FilenameField != "" {
+		if name, ok := obj[field.FilenameField].(string); ok && name != "" {
+			filename = name
+		}
+	}
+
+	log.Printf("Incoming JSON image upload: %s (%s)", field.Path, mimeType)
+	upload := processUpload(data, filename, mimeType, profile)
+	recordUpload(upload, profile.DryRun)
+	if profile.DryRun {
+		return applyDryRun(w, field.Path.String(), upload, data, filename, mimeType), encoded, true
+	}
+	if bytes.Equal(upload.Data, data) {
+		return upload, encoded, true
+	}
+
+	value := base64.StdEncoding.EncodeToString(upload.Data)
+	if isDataURI {
+		value = "data:" + upload.MimeType + ";base64," + value
+	}
+	return upload, value, true
+}
+
+// parseJSONFields decodes the JSON_FIELDS setting and route json_fields.
+func parseJSONFields(raw []jsonFieldConfig) ([]JSONField, error) {
+	fields := make([]JSONField, 0, len(raw))
+	for _, fc := range raw {
+		p, err := parseJSONPath(fc.Path)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, JSONField{Path: p, MimeField: fc.MimeField, FilenameField: fc.FilenameField})
+	}
+	return fields, nil
+}
+
+func formatJSONFields(fields []JSONField) []jsonFieldConfig {
+	raw := make([]jsonFieldConfig, 0, len(fields))
+	for _, f := range fields {
+		raw = append(raw, jsonFieldConfig{Path: f.Path.String(), MimeField: f.MimeField, FilenameField: f.FilenameField})
+	}
+	return raw
+}
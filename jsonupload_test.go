@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	p, err := parseJSONPath("$.images[*].data")
+	if err != nil {
+		t.Fatalf("parseJSONPath failed: %v", err)
+	}
+	want := []jsonPathSegment{{key: "images", index: -1}, {index: -1, wildcard: true}, {key: "data", index: -1}}
+	if len(p.segments) != len(want) {
+		t.Fatalf("segments = %+v", p.segments)
+	}
+	for i := range want {
+		if p.segments[i] != want[i] {
+			t.Errorf("segment %d = %+v, want %+v", i, p.segments[i], want[i])
+		}
+	}
+
+	for _, v := range []string{"", "image.data", "$", "$.list[0]", "$.a..b", "$.a[x].b", "$.a[1", "$a"} {
+		if _, err := parseJSONPath(v); err == nil {
+			t.Errorf("parseJSONPath(%q) expected error", v)
+		}
+	}
+}
+
+func TestProcessJSONUpload(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(pngData)
+
+	fields, err := parseJSONFields([]jsonFieldConfig{
+		{Path: "$.avatar.data"},
+		{Path: "$.photos[*].content", MimeField: "mime", FilenameField: "name"},
+	})
+	if err != nil {
+		t.Fatalf("parseJSONFields failed: %v", err)
+	}
+	route := &Route{JSONFields: fields}
+	profile := ProcessingProfile{
+		ImageProcessingSettings: ImageProcessingSettings{MaxWidth: 400, MaxHeight: 400},
+		NormalizeExt:            true,
+	}
+
+	body := `{"user": "a<b", "count": 12345678901234567890, "avatar": {"data": "data:image/png;base64,` + encoded + `"},
+		"photos": [{"name": "a.png", "mime": "image/png", "content": "` + encoded + `"}, {"name": "b.txt", "content": "aGVsbG8="}]}`
+
+	out, uploads := processJSONUpload(httptest.NewRecorder(), route, profile, []byte(body))
+	if len(uploads) != 3 {
+		t.Fatalf("Expected 3 processed values, got %d", len(uploads))
+	}
+
+	var doc struct {
+		User   string      `json:"user"`
+		Count  json.Number `json:"count"`
+		Avatar struct {
+			Data string `json:"data"`
+		} `json:"avatar"`
+		Photos []struct {
+			Name    string `json:"name"`
+			Mime    string `json:"mime"`
+			Content string `json:"content"`
+		} `json:"photos"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("Result is not valid JSON: %v", err)
+	}
+	if doc.User != "a<b" || doc.Count != "12345678901234567890" {
+		t.Errorf("Other values should be preserved, got %q and %q", doc.User, doc.Count)
+	}
+	if !strings.HasPrefix(doc.Avatar.Data, "data:image/png;base64,") || len(doc.Avatar.Data) >= len(encoded) {
+		t.Error("Data URI image should be replaced with a smaller one")
+	}
+	resized, err := base64.StdEncoding.DecodeString(doc.Photos[0].Content)
+	if err != nil || len(resized) >= len(pngData) {
+		t.Errorf("Base64 image should be replaced with a smaller one (%v)", err)
+	}
+	if doc.Photos[0].Name != "a.png" || doc.Photos[0].Mime != "image/png" {
+		t.Errorf("name = %q, mime = %q", doc.Photos[0].Name, doc.Photos[0].Mime)
+	}
+	if doc.Photos[1].Content != "aGVsbG8=" {
+		t.Error("Non-image values should be left alone")
+	}
+
+	unchanged := []byte(`{"avatar": {"data": "aGVsbG8="}, "x": [ 1, 2 ]}`)
+	out, _ = processJSONUpload(httptest.NewRecorder(), route, profile, unchanged)
+	if !bytes.Equal(out, unchanged) {
+		t.Errorf("Body without changes should be forwarded byte for byte, got %s", out)
+	}
+}
+
+func TestIsJSONRequest(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/json":                 true,
+		"application/json; charset=utf-8":  true,
+		"application/vnd.api+json":         true,
+		"text/plain":                       false,
+		"multipart/form-data; boundary=xx": false,
+	} {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Content-Type", contentType)
+		if got := isJSONRequest(req); got != want {
+			t.Errorf("isJSONRequest(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
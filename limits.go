@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errFileTooLarge is returned when a multipart file exceeds
+// UPLOAD_MAX_FILE_SIZE.
+var errFileTooLarge = errors.New("file exceeds the size limit")
+
+// limitBody caps r.Body at limit bytes; 0 means no limit. A request that
+// announces a larger Content-Length is rejected before anything is read.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	if limit <= 0 {
+		return true
+	}
+	if r.ContentLength > limit {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// isTooLarge reports whether reading a request failed because of a size
+// limit.
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr) || errors.Is(err, errFileTooLarge) || errors.Is(err, errFormValuesTooLarge)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestSizeLimits(t *testing.T) {
+	forwarded := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL
+	cfg.SpoolDir = t.TempDir()
+	cfg.UploadMemoryLimit = 100
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	// Form values are kept in memory, up to formValueAllowance bytes on top
+	// of UPLOAD_MEMORY_LIMIT.
+	valuesBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(valuesBody)
+	writer.WriteField("description", strings.Repeat("v", formValueAllowance+200))
+	part, _ := writer.CreateFormFile("assetData", "video.mp4")
+	part.Write(data)
+	writer.Close()
+	largeValues := httptest.NewRequest("POST", "/api/assets", valuesBody)
+	largeValues.Header.Set("Content-Type", writer.FormDataContentType())
+
+	// Without a Content-Length the limit is only noticed while reading.
+	unknownLength := func(req *http.Request) *http.Request {
+		req.ContentLength = -1
+		req.Body = io.NopCloser(req.Body)
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(cfg *Config)
+		req    *http.Request
+		status int
+	}{
+		{"multipart within limits", func(cfg *Config) {}, spoolRequest(t, data), http.StatusOK},
+		{"multipart over UPLOAD_MAX_SIZE", func(cfg *Config) { cfg.UploadMaxSize = 500 }, spoolRequest(t, data), http.StatusRequestEntityTooLarge},
+		{"streamed multipart over UPLOAD_MAX_SIZE", func(cfg *Config) { cfg.UploadMaxSize = 500 }, unknownLength(spoolRequest(t, data)), http.StatusRequestEntityTooLarge},
+		{"file over UPLOAD_MAX_FILE_SIZE", func(cfg *Config) { cfg.UploadMaxFileSize = 999 }, spoolRequest(t, data), http.StatusRequestEntityTooLarge},
+		{"file at UPLOAD_MAX_FILE_SIZE", func(cfg *Config) { cfg.UploadMaxFileSize = 1000 }, spoolRequest(t, data), http.StatusOK},
+		{"form values over their allowance", func(cfg *Config) {}, largeValues, http.StatusRequestEntityTooLarge},
+		{"raw body over BODY_MAX_SIZE", func(cfg *Config) { cfg.BodyMaxSize = 500 }, unknownLength(httptest.NewRequest("PUT", "/api/assets", bytes.NewReader(data))), http.StatusRequestEntityTooLarge},
+		{"raw body within BODY_MAX_SIZE", func(cfg *Config) { cfg.BodyMaxSize = 1000 }, httptest.NewRequest("PUT", "/api/assets", bytes.NewReader(data)), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := *cfg
+			tt.setup(&cfg)
+			forwarded = 0
+
+			rec := httptest.NewRecorder()
+			proxyHandler(rec, tt.req, &cfg)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status == http.StatusRequestEntityTooLarge && forwarded != 0 {
+				t.Error("Oversize request was forwarded")
+			}
+			assertSpoolEmpty(t, cfg.SpoolDir)
+		})
+	}
+}
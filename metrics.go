@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a counter or gauge with a fixed set of label names. All metrics
+// are written in the Prometheus text format by writeMetrics.
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var allMetrics []*metric
+
+func newMetric(name, kind, help string, labels ...string) *metric {
+	m := &metric{name: name, kind: kind, help: help, labels: labels, values: map[string]float64{}}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+// labelSeparator cannot appear in valid UTF-8, so joined label values are
+// unambiguous.
+const labelSeparator = "\xff"
+
+func (m *metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[strings.Join(labelValues, labelSeparator)] += v
+}
+
+func (m *metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[strings.Join(labelValues, labelSeparator)] = v
+}
+
+// Value returns the current value for the given labels, mainly for tests.
+func (m *metric) Value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[strings.Join(labelValues, labelSeparator)]
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strconv.FormatFloat(m.values[key], 'g', -1, 64)
+		if len(m.labels) == 0 {
+			fmt.Fprintf(w, "%s %s\n", m.name, value)
+			continue
+		}
+		pairs := make([]string, len(m.labels))
+		for i, labelValue := range strings.Split(key, labelSeparator) {
+			if i < len(pairs) {
+				pairs[i] = m.labels[i] + `="` + labelEscaper.Replace(labelValue) + `"`
+			}
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", m.name, strings.Join(pairs, ","), value)
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+var (
+	uploadFiles = newMetric("upload_proxy_files_total", "counter",
+		"Uploaded files by processing outcome.", "outcome", "dry_run")
+	uploadBytesIn = newMetric("upload_proxy_file_bytes_in_total", "counter",
+		"Size of uploaded files before processing.", "dry_run")
+	uploadBytesOut = newMetric("upload_proxy_file_bytes_out_total", "counter",
+		"Size of uploaded files after processing. In dry-run mode, the size they would have had.", "dry_run")
+)
+
+func recordUpload(u uploadResult, dryRun bool) {
+	mode := strconv.FormatBool(dryRun)
+	uploadFiles.Add(1, u.Outcome, mode)
+	uploadBytesIn.Add(float64(u.OriginalSize), mode)
+	uploadBytesOut.Add(float64(u.size()), mode)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricWrite(t *testing.T) {
+	m := &metric{name: "test_total", kind: "counter", help: "Test counter.", labels: []string{"a", "b"}, values: map[string]float64{}}
+	m.Add(1, "x", `quo"te`)
+	m.Add(2, "x", `quo"te`)
+	m.Add(0.5, "w", "v")
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := "# HELP test_total Test counter.\n" +
+		"# TYPE test_total counter\n" +
+		"test_total{a=\"w\",b=\"v\"} 0.5\n" +
+		"test_total{a=\"x\",b=\"quo\\\"te\"} 3\n"
+	if buf.String() != want {
+		t.Errorf("write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	g := &metric{name: "test_gauge", kind: "gauge", help: "Test gauge.", values: map[string]float64{}}
+	g.Set(4)
+	g.Set(2)
+	buf.Reset()
+	g.write(&buf)
+	if !strings.HasSuffix(buf.String(), "test_gauge 2\n") {
+		t.Errorf("gauge output = %q", buf.String())
+	}
+}
+
+func TestAdminMetricsEndpoint(t *testing.T) {
+	recordUpload(uploadResult{Outcome: "unchanged", OriginalSize: 10, Data: make([]byte, 10)}, false)
+
+	recorder := httptest.NewRecorder()
+	adminHandler(newConfigHolder("", nil, defaultConfig())).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d", recorder.Code)
+	}
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"# TYPE upload_proxy_files_total counter",
+		`upload_proxy_files_total{outcome="unchanged",dry_run="false"}`,
+		`upload_proxy_file_bytes_in_total{dry_run="false"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+}
@@ -11,117 +11,132 @@ import (
 	"strings"
 )
 
-func reformatMultipart(w http.ResponseWriter, r *http.Request, cfg *Config) (string, *bytes.Buffer, error) {
-	r.ParseMultipartForm(cfg.UploadMaxSize)
-	file, handler, err := r.FormFile(cfg.FileUploadField)
+// reformatMultipart rebuilds a multipart upload with the processed files and
+// returns its content type, body and what happened to each file. The body
+// refers to the files instead of copying them, and files that are not images
+// are read from the upload when it is sent, so the body must be closed.
+func reformatMultipart(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route) (string, *requestBody, []uploadResult, error) {
+	form, err := readSpooledForm(r, cfg)
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
-	defer file.Close()
+	contentType, body, forwarded, err := rebuildMultipart(w, r, cfg, route, form)
+	if err != nil {
+		form.RemoveAll()
+		return "", nil, nil, err
+	}
+	body.cleanup = form.RemoveAll
+	return contentType, body, forwarded, nil
+}
 
-	byteContainer, err := io.ReadAll(file)
+func rebuildMultipart(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route, form *spooledForm) (string, *requestBody, []uploadResult, error) {
+	// Resolved after parsing so client rules can match form fields, and
+	// before the fields are copied so override parameters are dropped.
+	profile, err := cfg.requestProfile(r, route)
 	if err != nil {
-		log.Printf("Failed to read file: %v", err)
-		return "", nil, err
+		return "", nil, nil, err
 	}
 
-	settings := ImageProcessingSettings{
-		MaxWidth:        cfg.ImgMaxWidth,
-		MaxHeight:       cfg.ImgMaxHeight,
-		MaxNarrowSide:   cfg.ImgMaxNarrowSide,
-		JpegQuality:     cfg.JpegQuality,
-		WebpQuality:     cfg.WebpQuality,
-		ConvertToFormat: cfg.ConvertToFormat,
+	var files []*spooledFile
+	var fileFields []string
+	for _, field := range route.FileUploadFields {
+		for _, fh := range form.File[field] {
+			files = append(files, fh)
+			fileFields = append(fileFields, field)
+		}
+	}
+	if len(files) == 0 {
+		return "", nil, nil, http.ErrMissingFile
 	}
 
-	result, err := processImageWithStrategy(byteContainer, settings)
-
-	var wasImageProcessed bool
-	var actuallyCompressed bool
-	var wasResized bool
-
-	if err == nil {
-		wasImageProcessed = true
-		actuallyCompressed = result.WasCompressed
-		wasResized = result.WasResized
-		byteContainer = result.ProcessedData
-	} else {
-		log.Printf("Image processing error: %v", err)
-		wasImageProcessed = false
-		actuallyCompressed = false
-		wasResized = false
+	// Files are processed first so that form fields can describe the result.
+	// Only images are read into memory; other files are forwarded from the
+	// upload as they are.
+	forwarded := make([]uploadResult, 0, len(files))
+	for i, handler := range files {
+		mimeType := handler.Header.Get("Content-Type")
+		var upload uploadResult
+		var byteContainer []byte
+		if isImageFile(handler, mimeType) {
+			byteContainer, err = handler.ReadAll()
+			if err != nil {
+				log.Printf("Failed to read file: %v", err)
+				return "", nil, nil, err
+			}
+			upload = processUpload(byteContainer, handler.Filename, mimeType, profile)
+		} else {
+			upload = passThrough(handler, mimeType)
+		}
+		recordUpload(upload, profile.DryRun)
+		if profile.DryRun {
+			upload = applyDryRun(w, fileFields[i], upload, byteContainer, handler.Filename, mimeType)
+		}
+		forwarded = append(forwarded, upload)
 	}
 
-	body := &bytes.Buffer{}
+	body := &requestBody{}
 	writer := multipart.NewWriter(body)
 	for formKey := range r.Form {
 		formValue := r.Form.Get(formKey)
+		if rewritten := rewriteFormValue(formKey, formValue, route.FieldRewrites, forwarded); rewritten != formValue {
+			log.Printf("Rewrote form field %s: %q -> %q", formKey, formValue, rewritten)
+			formValue = rewritten
+		}
 		fw, _ := writer.CreateFormField(formKey)
 		io.Copy(fw, strings.NewReader(formValue))
 	}
 
-	var finalFilename string
-	var finalMimeType string
-
-	convertFormat := cfg.ConvertToFormat
-
-	if wasImageProcessed && actuallyCompressed {
-		switch convertFormat {
-		case "JPEG":
-			finalMimeType = JPEG_MIME_TYPE
-			if cfg.NormalizeExt {
-				finalFilename = changeExtensionToJPG(handler.Filename)
-				log.Printf("Converted to JPEG with normalized filename: %s -> %s", handler.Filename, finalFilename)
-			} else {
-				finalFilename = handler.Filename
-				log.Printf("Converted to JPEG but keeping original filename: %s", finalFilename)
-			}
-		case "WEBP":
-			finalMimeType = WEBP_MIME_TYPE
-			if cfg.NormalizeExt {
-				finalFilename = changeExtensionToWebP(handler.Filename)
-				log.Printf("Converted to WebP with normalized filename: %s -> %s", handler.Filename, finalFilename)
-			} else {
-				finalFilename = handler.Filename
-				log.Printf("Converted to WebP but keeping original filename: %s", finalFilename)
-			}
-		default:
-			// Fallback (shouldn't happen)
-			finalMimeType = JPEG_MIME_TYPE
-			finalFilename = handler.Filename
-			log.Printf("Unknown convert format, defaulting to JPEG MIME: %s", finalFilename)
-		}
-	} else if wasImageProcessed && !actuallyCompressed {
-		finalFilename = handler.Filename
-		finalMimeType = handler.Header.Get("Content-Type")
-		if finalMimeType == "" {
-			finalMimeType = DEFAULT_MIME_TYPE
-		}
-		if convertFormat == "" {
-			if wasResized {
-				log.Printf("Image resized but format conversion disabled: %s (%s)", finalFilename, finalMimeType)
-			} else {
-				log.Printf("Image processed but no changes needed: %s (%s)", finalFilename, finalMimeType)
-			}
+	for i, upload := range forwarded {
+		// The part writer writes straight to body, so the file can be
+		// added to it without a copy.
+		CreateFormFileWithMime(writer, fileFields[i], upload.Filename, upload.MimeType)
+		if upload.source != nil {
+			body.addFile(upload.source)
 		} else {
-			log.Printf("Image processed but original kept (better compression): %s (%s)", finalFilename, finalMimeType)
+			body.add(upload.Data)
 		}
-	} else {
-		finalFilename = handler.Filename
-		finalMimeType = handler.Header.Get("Content-Type")
-		if finalMimeType == "" {
-			finalMimeType = DEFAULT_MIME_TYPE
-		}
-		log.Printf("Non-image file or processing failed, keeping original: %s (%s)", finalFilename, finalMimeType)
 	}
-
-	fw, _ := CreateFormFileWithMime(writer, cfg.FileUploadField, finalFilename, finalMimeType)
-	io.Copy(fw, bytes.NewReader(byteContainer))
 	writer.Close()
 
 	contentType := writer.FormDataContentType()
 
-	return contentType, body, nil
+	return contentType, body, forwarded, nil
+}
+
+// heifBrands are the ISO media brands of HEIF and AVIF images.
+var heifBrands = []string{"heic", "heix", "hevc", "heim", "heis", "hevm", "hevs", "mif1", "msf1", "avif", "avis"}
+
+// isImageFile reports whether an uploaded file should go through image
+// processing, by its declared type or its first bytes. Clients often send
+// images as application/octet-stream.
+func isImageFile(f *spooledFile, mimeType string) bool {
+	if strings.HasPrefix(strings.ToLower(mimeType), "image/") {
+		return true
+	}
+	file, err := f.Open()
+	if err != nil {
+		// Let ReadAll report the error.
+		return true
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+
+	if strings.HasPrefix(http.DetectContentType(head), "image/") {
+		return true
+	}
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return true
+	}
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		for _, brand := range heifBrands {
+			if string(head[8:12]) == brand {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Overrides are sent as X-Upload-Proxy-<Key> headers or upload_proxy_<key>
+// query parameters, e.g. X-Upload-Proxy-Max-Width or upload_proxy_max_width.
+const (
+	OVERRIDE_SECRET_HEADER = "X-Upload-Proxy-Secret"
+	overrideHeaderPrefix   = "X-Upload-Proxy-"
+	overrideQueryPrefix    = "upload_proxy_"
+)
+
+// overrideKeys are the names that can be overridden per request. Apart from
+// profile, they match the profile keys.
+var overrideKeys = []string{
+	"profile",
+	"max_width",
+	"max_height",
+	"max_narrow_side",
+	"jpeg_quality",
+	"webp_quality",
+	"convert_to_format",
+	"normalize_extensions",
+	"dry_run",
+}
+
+var errOverrideDenied = errors.New("processing override denied")
+
+// requestProfile returns the processing profile for a request on route,
+// taking client rules into account. If OVERRIDE_SECRET is set, the request
+// may adjust it with the overrides listed in OVERRIDE_ALLOW. Override headers
+// and query parameters are removed from the request either way so they are
+// not forwarded.
+func (cfg *Config) requestProfile(r *http.Request, route *Route) (ProcessingProfile, error) {
+	profile := cfg.clientProfile(r, route)
+	values, secret := takeOverrides(r)
+	if cfg.OverrideSecret == "" || len(values) == 0 {
+		return profile, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.OverrideSecret)) != 1 {
+		return profile, fmt.Errorf("%w: missing or invalid %s", errOverrideDenied, OVERRIDE_SECRET_HEADER)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if !containsString(cfg.OverrideAllow, key) {
+			return profile, fmt.Errorf("%w: %s is not allowed", errOverrideDenied, key)
+		}
+		keys = append(keys, key+"="+values[key])
+	}
+	sort.Strings(keys)
+
+	if name, ok := values["profile"]; ok {
+		named, found := cfg.Profiles[name]
+		if !found {
+			return profile, fmt.Errorf("unknown profile %q", name)
+		}
+		profile = named
+	}
+
+	pc, err := overrideProfileConfig(values)
+	if err != nil {
+		return profile, err
+	}
+	if profile, err = pc.apply(profile); err != nil {
+		return profile, err
+	}
+
+	log.Printf("Applying processing overrides: %s", strings.Join(keys, ", "))
+	return profile, nil
+}
+
+// takeOverrides collects override values and the secret from the request and
+// removes them from its headers, query string and parsed form. Headers take
+// precedence over query parameters.
+func takeOverrides(r *http.Request) (map[string]string, string) {
+	values := map[string]string{}
+	query := r.URL.Query()
+	queryChanged := false
+
+	take := func(key string) (string, bool) {
+		header := http.CanonicalHeaderKey(overrideHeaderPrefix + strings.ReplaceAll(key, "_", "-"))
+		param := overrideQueryPrefix + key
+		headerValue, inHeader := r.Header[header]
+		queryValue, inQuery := query[param]
+		r.Header.Del(header)
+		if inQuery {
+			query.Del(param)
+			queryChanged = true
+		}
+		if r.Form != nil {
+			r.Form.Del(param)
+		}
+		switch {
+		case inHeader && len(headerValue) > 0:
+			return headerValue[0], true
+		case inQuery && len(queryValue) > 0:
+			return queryValue[0], true
+		}
+		return "", false
+	}
+
+	for _, key := range overrideKeys {
+		if v, ok := take(key); ok {
+			values[key] = v
+		}
+	}
+	secret, _ := take("secret")
+
+	if queryChanged {
+		r.URL.RawQuery = query.Encode()
+	}
+	return values, secret
+}
+
+// overrideProfileConfig converts override values to a profileConfig, so they
+// are validated exactly like profiles.
+func overrideProfileConfig(values map[string]string) (profileConfig, error) {
+	var pc profileConfig
+	ints := map[string]**int{
+		"max_width":       &pc.MaxWidth,
+		"max_height":      &pc.MaxHeight,
+		"max_narrow_side": &pc.MaxNarrowSide,
+		"jpeg_quality":    &pc.JpegQuality,
+		"webp_quality":    &pc.WebpQuality,
+	}
+	bools := map[string]**bool{
+		"normalize_extensions": &pc.NormalizeExt,
+		"dry_run":              &pc.DryRun,
+	}
+
+	for key, v := range values {
+		if field, ok := ints[key]; ok {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return pc, fmt.Errorf("invalid %s %q", key, v)
+			}
+			*field = &n
+		}
+		if field, ok := bools[key]; ok {
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return pc, fmt.Errorf("invalid %s %q", key, v)
+			}
+			*field = &b
+		}
+	}
+	if v, ok := values["convert_to_format"]; ok {
+		pc.ConvertToFormat = &v
+	}
+	return pc, nil
+}
+
+// parseOverrideKeys parses the OVERRIDE_ALLOW list.
+func parseOverrideKeys(v string) ([]string, error) {
+	keys := []string{}
+	for _, key := range strings.Split(v, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		if !containsString(overrideKeys, key) {
+			return nil, fmt.Errorf("unknown override %q, valid: %s", key, strings.Join(overrideKeys, ", "))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testOverridesConfig(t *testing.T) *Config {
+	cfg := testRoutesConfig(t)
+	cfg.OverrideSecret = "s3cret"
+	cfg.OverrideAllow = []string{"profile", "max_width", "convert_to_format"}
+	return cfg
+}
+
+func TestRequestProfileOverrides(t *testing.T) {
+	cfg := testOverridesConfig(t)
+
+	req := httptest.NewRequest("POST", "/api/assets?upload_proxy_max_width=4000&upload_proxy_secret=s3cret&keep=1", nil)
+	req.Header.Set("X-Upload-Proxy-Convert-To-Format", "webp")
+	profile, err := cfg.requestProfile(req, cfg.matchRoute(req))
+	if err != nil {
+		t.Fatalf("requestProfile failed: %v", err)
+	}
+	if profile.MaxWidth != 4000 || profile.ConvertToFormat != "WEBP" {
+		t.Errorf("profile = %+v, want max width 4000 and WEBP", profile)
+	}
+	if profile.MaxHeight != 720 {
+		t.Errorf("Other settings should come from the route's profile, got max height %d", profile.MaxHeight)
+	}
+	if req.URL.RawQuery != "keep=1" {
+		t.Errorf("Override parameters should be removed from the query, got %q", req.URL.RawQuery)
+	}
+	if req.Header.Get("X-Upload-Proxy-Convert-To-Format") != "" {
+		t.Error("Override headers should be removed")
+	}
+
+	req = httptest.NewRequest("POST", "/api/assets", nil)
+	req.Header.Set(OVERRIDE_SECRET_HEADER, "s3cret")
+	req.Header.Set("X-Upload-Proxy-Profile", "originals")
+	profile, err = cfg.requestProfile(req, cfg.matchRoute(req))
+	if err != nil {
+		t.Fatalf("requestProfile failed: %v", err)
+	}
+	if profile.MaxWidth != 100000 {
+		t.Errorf("Expected the originals profile, got %+v", profile)
+	}
+	if req.Header.Get(OVERRIDE_SECRET_HEADER) != "" {
+		t.Error("Secret header should be removed")
+	}
+}
+
+func TestRequestProfileOverridesDenied(t *testing.T) {
+	cfg := testOverridesConfig(t)
+
+	tests := []struct {
+		name   string
+		url    string
+		denied bool
+	}{
+		{"missing secret", "/api/assets?upload_proxy_max_width=9000", true},
+		{"wrong secret", "/api/assets?upload_proxy_max_width=9000&upload_proxy_secret=guess", true},
+		{"not allowed", "/api/assets?upload_proxy_jpeg_quality=100&upload_proxy_secret=s3cret", true},
+		{"invalid value", "/api/assets?upload_proxy_max_width=-5&upload_proxy_secret=s3cret", false},
+		{"unknown profile", "/api/assets?upload_proxy_profile=nope&upload_proxy_secret=s3cret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.url, nil)
+			_, err := cfg.requestProfile(req, cfg.matchRoute(req))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if errors.Is(err, errOverrideDenied) != tt.denied {
+				t.Errorf("errors.Is(%v, errOverrideDenied) = %v, want %v", err, !tt.denied, tt.denied)
+			}
+		})
+	}
+}
+
+func TestRequestProfileOverridesDisabled(t *testing.T) {
+	cfg := testRoutesConfig(t)
+
+	req := httptest.NewRequest("POST", "/api/assets?upload_proxy_max_width=9000", nil)
+	profile, err := cfg.requestProfile(req, cfg.matchRoute(req))
+	if err != nil {
+		t.Fatalf("requestProfile failed: %v", err)
+	}
+	if profile.MaxWidth != 1280 {
+		t.Errorf("Overrides should be ignored without OVERRIDE_SECRET, got max width %d", profile.MaxWidth)
+	}
+	if req.URL.RawQuery != "" {
+		t.Errorf("Override parameters should be removed without OVERRIDE_SECRET, got %q", req.URL.RawQuery)
+	}
+}
+
+func TestProxyHandlerStripsOverridesWithoutSecret(t *testing.T) {
+	var forwarded *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL + "/api/assets"
+
+	req := httptest.NewRequest("POST", "/api/assets?upload_proxy_max_width=9000&keep=1", strings.NewReader("{}"))
+	req.Header.Set(OVERRIDE_SECRET_HEADER, "guess")
+	req.Header.Set("X-Upload-Proxy-Max-Width", "9000")
+	proxyHandler(httptest.NewRecorder(), req, cfg)
+
+	if forwarded == nil {
+		t.Fatal("Request was not forwarded")
+	}
+	if forwarded.Header.Get(OVERRIDE_SECRET_HEADER) != "" || forwarded.Header.Get("X-Upload-Proxy-Max-Width") != "" {
+		t.Errorf("Override headers were forwarded: %v", forwarded.Header)
+	}
+	if forwarded.URL.RawQuery != "keep=1" {
+		t.Errorf("Forwarded query = %q, want the override parameter removed", forwarded.URL.RawQuery)
+	}
+}
+
+func TestParseOverrideKeys(t *testing.T) {
+	keys, err := parseOverrideKeys("profile, MAX_WIDTH,")
+	if err != nil || len(keys) != 2 || keys[1] != "max_width" {
+		t.Errorf("parseOverrideKeys = %v, %v", keys, err)
+	}
+	if _, err := parseOverrideKeys("profile,upload_max_size"); err == nil {
+		t.Error("Expected error for a key that cannot be overridden")
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// processJob is one file found on the command line or while walking a
+// directory. rel is its path relative to the argument it was found under.
+type processJob struct {
+	path string
+	rel  string
+}
+
+type processSummary struct {
+	mu          sync.Mutex
+	files       int
+	changed     int
+	failed      int
+	skipped     int
+	bytesBefore int64
+	bytesAfter  int64
+}
+
+func (s *processSummary) add(before, after int, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files++
+	s.bytesBefore += int64(before)
+	s.bytesAfter += int64(after)
+	if changed {
+		s.changed++
+	}
+}
+
+func (s *processSummary) fail() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed++
+}
+
+func (s *processSummary) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped++
+}
+
+// errOutputExists is returned instead of overwriting an output or backup
+// file, which may come from an earlier run or another input with the same
+// output name.
+var errOutputExists = errors.New("already exists")
+
+// runProcess applies the same processing as an upload to local files or
+// whole directory trees. Results go to an output tree, or replace the
+// originals when -in-place is given.
+func runProcess(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("process", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: multipart-upload-proxy process (-out DIR | -in-place) [flags] FILE|DIR...")
+		flags.PrintDefaults()
+	}
+	cf := newConfigFlags(flags)
+	outDir := flags.String("out", "", "Directory to write processed files to, mirroring the input tree")
+	inPlace := flags.Bool("in-place", false, "Replace the original files instead of writing to -out")
+	backupSuffix := flags.String("backup-suffix", ".orig", "With -in-place, keep originals under this suffix (empty to disable backups)")
+	parallel := flags.Int("parallel", runtime.NumCPU(), "Number of files processed at the same time")
+	profileName := flags.String("profile", "", "Named profile to use instead of the global settings")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (*outDir == "") == !*inPlace || flags.NArg() == 0 || *parallel < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, ok := cf.load(stderr)
+	if !ok {
+		return 1
+	}
+
+	profile := cfg.defaultProfile()
+	if *profileName != "" {
+		var found bool
+		if profile, found = cfg.Profiles[*profileName]; !found {
+			fmt.Fprintf(stderr, "Unknown profile %q\n", *profileName)
+			return 1
+		}
+	}
+
+	summary := &processSummary{}
+	var outMu sync.Mutex
+	report := func(w io.Writer, format string, a ...interface{}) {
+		outMu.Lock()
+		defer outMu.Unlock()
+		fmt.Fprintf(w, format, a...)
+	}
+
+	jobs := make(chan processJob)
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				var dest string
+				if !*inPlace {
+					dest = filepath.Join(*outDir, filepath.Dir(job.rel))
+				}
+				before, after, outPath, err := processFile(job.path, dest, *backupSuffix, profile)
+				if errors.Is(err, errOutputExists) {
+					summary.skip()
+					report(stderr, "%s: skipped, %v\n", job.path, err)
+					continue
+				}
+				if err != nil {
+					summary.fail()
+					report(stderr, "%s: %v\n", job.path, err)
+					continue
+				}
+				summary.add(before, after, filepath.Base(outPath) != filepath.Base(job.path) || before != after)
+				report(stdout, "%s -> %s: %d -> %d bytes\n", job.path, outPath, before, after)
+			}
+		}()
+	}
+
+	for _, arg := range flags.Args() {
+		if err := collectProcessJobs(arg, *backupSuffix, jobs); err != nil {
+			summary.fail()
+			report(stderr, "%s: %v\n", arg, err)
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	saved := summary.bytesBefore - summary.bytesAfter
+	var percent float64
+	if summary.bytesBefore > 0 {
+		percent = float64(saved) * 100 / float64(summary.bytesBefore)
+	}
+	fmt.Fprintf(stdout, "Processed %d file(s), %d changed, %d failed: %d -> %d bytes, saved %d bytes (%.1f%%)\n",
+		summary.files, summary.changed, summary.failed, summary.bytesBefore, summary.bytesAfter, saved, percent)
+	if summary.skipped > 0 {
+		fmt.Fprintf(stdout, "Skipped %d file(s) whose output or backup already exists\n", summary.skipped)
+	}
+
+	if summary.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// collectProcessJobs sends a file, or every regular file below a directory,
+// to jobs. Backups from an earlier in-place run are skipped.
+func collectProcessJobs(root, backupSuffix string, jobs chan<- processJob) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		jobs <- processJob{path: root, rel: filepath.Base(root)}
+		return nil
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if backupSuffix != "" && strings.HasSuffix(path, backupSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		jobs <- processJob{path: path, rel: rel}
+		return nil
+	})
+}
+
+// processFile runs one file through the pipeline. With an empty outDir the
+// result replaces the original, which is first renamed to path+backupSuffix.
+// It returns the size before and after and where the result was written.
+// Existing files are never overwritten: errOutputExists is returned
+// instead. In dry-run mode nothing is written.
+func processFile(path, outDir, backupSuffix string, profile ProcessingProfile) (int, int, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	upload := processUpload(data, filepath.Base(path), http.DetectContentType(data), profile)
+	filename, processed := upload.Filename, upload.Data
+
+	if profile.DryRun {
+		if outDir == "" {
+			outDir = filepath.Dir(path)
+		}
+		return len(data), len(processed), filepath.Join(outDir, filename), nil
+	}
+
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, 0o755); err != nil {
+			return 0, 0, "", err
+		}
+		outPath := filepath.Join(outDir, filename)
+		if err := writeNewFile(outPath, processed); err != nil {
+			return 0, 0, "", err
+		}
+		return len(data), len(processed), outPath, nil
+	}
+
+	outPath := filepath.Join(filepath.Dir(path), filename)
+	if outPath == path && bytes.Equal(processed, data) {
+		return len(data), len(processed), path, nil
+	}
+
+	// Write next to the original first, so a failure never leaves neither.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".processing-*")
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(processed)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	// The backup and a renamed output are claimed before anything is moved,
+	// so that neither an earlier backup nor another file is replaced.
+	var claimed []string
+	release := func() {
+		for _, p := range claimed {
+			os.Remove(p)
+		}
+	}
+	if backupSuffix != "" {
+		if err := claimPath(path + backupSuffix); err != nil {
+			return 0, 0, "", err
+		}
+		claimed = append(claimed, path+backupSuffix)
+	}
+	if outPath != path {
+		if err := claimPath(outPath); err != nil {
+			release()
+			return 0, 0, "", err
+		}
+		claimed = append(claimed, outPath)
+	}
+
+	if backupSuffix != "" {
+		if err := os.Rename(path, path+backupSuffix); err != nil {
+			release()
+			return 0, 0, "", err
+		}
+	}
+	if err := os.Rename(tmp.Name(), outPath); err != nil {
+		// Put the original back; if that fails, the backup is all that is
+		// left of it and must be kept.
+		if backupSuffix == "" || os.Rename(path+backupSuffix, path) == nil {
+			release()
+		}
+		return 0, 0, "", err
+	}
+	// Without a backup, the original of a renamed output is only removed
+	// once the result is in place.
+	if backupSuffix == "" && outPath != path {
+		if err := os.Remove(path); err != nil {
+			return 0, 0, "", err
+		}
+	}
+	return len(data), len(processed), outPath, nil
+}
+
+// claimPath creates an empty file at path, failing with errOutputExists if
+// there already is one. It is replaced by a rename afterwards.
+func claimPath(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s %w", path, errOutputExists)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeNewFile writes data to path unless a file is already there.
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s %w", path, errOutputExists)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunProcess(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "notes.txt")
+	os.WriteFile(input, []byte("not an image"), 0o644)
+	outDir := filepath.Join(dir, "out")
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"process", "-out", outDir, input}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("process exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	data, err := os.ReadFile(filepath.Join(outDir, "notes.txt"))
+	if err != nil {
+		t.Fatalf("Expected output file: %v", err)
+	}
+	if string(data) != "not an image" {
+		t.Errorf("Non-image file should be copied unchanged, got %q", data)
+	}
+	if !strings.Contains(stdout.String(), "12 -> 12 bytes") {
+		t.Errorf("stdout = %q", stdout.String())
+	}
+}
+
+func TestRunProcess_Errors(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+
+	if code := runCLI([]string{"process", filepath.Join(dir, "a.jpg")}, &stdout, &stderr); code != 2 {
+		t.Errorf("missing -out exit code = %d, want 2", code)
+	}
+	if code := runCLI([]string{"process", "-out", dir, "-profile", "nope", filepath.Join(dir, "a.jpg")}, &stdout, &stderr); code != 1 {
+		t.Errorf("unknown profile exit code = %d, want 1", code)
+	}
+	if code := runCLI([]string{"process", "-out", dir, filepath.Join(dir, "missing.jpg")}, &stdout, &stderr); code != 1 {
+		t.Errorf("missing input exit code = %d, want 1", code)
+	}
+}
+
+func TestRunProcess_Directory(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in")
+	os.MkdirAll(filepath.Join(input, "2023", "june"), 0o755)
+	os.WriteFile(filepath.Join(input, "a.txt"), []byte("first"), 0o644)
+	os.WriteFile(filepath.Join(input, "2023", "june", "b.txt"), []byte("second"), 0o644)
+	outDir := filepath.Join(dir, "out")
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"process", "-out", outDir, "-parallel", "2", input}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("process exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	for rel, want := range map[string]string{"a.txt": "first", "2023/june/b.txt": "second"} {
+		data, err := os.ReadFile(filepath.Join(outDir, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Errorf("Expected %s in output tree: %v", rel, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", rel, data, want)
+		}
+	}
+	if !strings.Contains(stdout.String(), "Processed 2 file(s), 0 changed, 0 failed: 11 -> 11 bytes, saved 0 bytes") {
+		t.Errorf("Unexpected summary: %q", stdout.String())
+	}
+}
+
+func TestRunProcess_InPlace(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "photo.png")
+	notes := filepath.Join(dir, "notes.txt")
+	os.WriteFile(photo, pngData, 0o644)
+	os.WriteFile(notes, []byte("unchanged"), 0o644)
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"process", "-in-place", "-img-max-width", "200", dir}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("process exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	backup, err := os.ReadFile(photo + ".orig")
+	if err != nil {
+		t.Fatalf("Expected backup of the original: %v", err)
+	}
+	if !bytes.Equal(backup, pngData) {
+		t.Error("Backup should hold the original bytes")
+	}
+	processed, err := os.ReadFile(photo)
+	if err != nil {
+		t.Fatalf("Expected processed file at the original path: %v", err)
+	}
+	if len(processed) >= len(pngData) {
+		t.Errorf("Processed image should be smaller: %d >= %d bytes", len(processed), len(pngData))
+	}
+	if _, err := os.Stat(notes + ".orig"); !os.IsNotExist(err) {
+		t.Error("Unchanged files should not be backed up")
+	}
+
+	// A second run must not pick up the backups.
+	stdout.Reset()
+	if code := runCLI([]string{"process", "-in-place", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("second run exit code = %d, stderr: %s", code, stderr.String())
+	}
+	if strings.Contains(stdout.String(), ".orig") {
+		t.Errorf("Backups should be skipped, got %q", stdout.String())
+	}
+}
+
+func TestRunProcess_InPlaceBackupSuffix(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "photo.png")
+	os.WriteFile(photo, pngData, 0o644)
+
+	// Backups are recognised by the whole suffix, not only by an extension.
+	var stdout, stderr bytes.Buffer
+	for i := 0; i < 2; i++ {
+		stdout.Reset()
+		if code := runCLI([]string{"process", "-in-place", "-backup-suffix", "~", "-img-max-width", "200", dir}, &stdout, &stderr); code != 0 {
+			t.Fatalf("run %d exit code = %d, stderr: %s", i+1, code, stderr.String())
+		}
+	}
+	if strings.Contains(stdout.String(), "photo.png~") {
+		t.Errorf("Backups should be skipped, got %q", stdout.String())
+	}
+	if backup, _ := os.ReadFile(photo + "~"); !bytes.Equal(backup, pngData) {
+		t.Error("Backup should hold the original bytes")
+	}
+}
+
+func TestRunProcess_InPlaceKeepsBackup(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "photo.png")
+	os.WriteFile(photo, pngData, 0o644)
+
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"process", "-in-place", "-img-max-width", "400", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("first run exit code = %d, stderr: %s", code, stderr.String())
+	}
+	firstOutput, _ := os.ReadFile(photo)
+
+	// Processing the result again would move it onto the backup of the
+	// original, so the file is skipped.
+	stdout.Reset()
+	stderr.Reset()
+	if code := runCLI([]string{"process", "-in-place", "-img-max-width", "200", photo}, &stdout, &stderr); code != 0 {
+		t.Fatalf("second run exit code = %d, stderr: %s", code, stderr.String())
+	}
+	if backup, _ := os.ReadFile(photo + ".orig"); !bytes.Equal(backup, pngData) {
+		t.Errorf("Backup was replaced: %d bytes, original %d", len(backup), len(pngData))
+	}
+	if output, _ := os.ReadFile(photo); !bytes.Equal(output, firstOutput) {
+		t.Error("Skipped file was changed")
+	}
+	if !strings.Contains(stderr.String(), "skipped") || !strings.Contains(stdout.String(), "Skipped 1 file(s)") {
+		t.Errorf("Skip not reported: stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestRunProcess_OutputCollision(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a", "notes.txt")
+	second := filepath.Join(dir, "b", "notes.txt")
+	os.MkdirAll(filepath.Dir(first), 0o755)
+	os.MkdirAll(filepath.Dir(second), 0o755)
+	os.WriteFile(first, []byte("first"), 0o644)
+	os.WriteFile(second, []byte("second"), 0o644)
+	outDir := filepath.Join(dir, "out")
+
+	// Both inputs map to out/notes.txt; the second one must not replace the
+	// first.
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"process", "-out", outDir, "-parallel", "1", first, second}, &stdout, &stderr); code != 0 {
+		t.Fatalf("process exit code = %d, stderr: %s", code, stderr.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(outDir, "notes.txt")); string(data) != "first" {
+		t.Errorf("notes.txt = %q, want the first input", data)
+	}
+	if !strings.Contains(stderr.String(), second+": skipped") {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Processed 1 file(s)") || !strings.Contains(stdout.String(), "Skipped 1 file(s) whose output or backup already exists") {
+		t.Errorf("Unexpected summary: %q", stdout.String())
+	}
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
-	"time"
 )
 
 const (
@@ -39,6 +40,11 @@ const NORMALIZE_EXTENSIONS = "NORMALIZE_EXTENSIONS"
 
 
 const UPLOAD_MAX_SIZE = "UPLOAD_MAX_SIZE"
+const UPLOAD_MAX_FILE_SIZE = "UPLOAD_MAX_FILE_SIZE"
+const BODY_MAX_SIZE = "BODY_MAX_SIZE"
+const UPLOAD_MEMORY_LIMIT = "UPLOAD_MEMORY_LIMIT"
+const SPOOL_DIR = "SPOOL_DIR"
+const SPOOL_MAX_SIZE = "SPOOL_MAX_SIZE"
 const IMG_MAX_PIXELS = "IMG_MAX_PIXELS"
 
 
@@ -47,6 +53,84 @@ const FILE_UPLOAD_FIELD = "FILE_UPLOAD_FIELD"
 const LISTEN_PATH = "LISTEN_PATH"
 const CONVERT_TO_FORMAT = "CONVERT_TO_FORMAT"
 
+const REQUEST_STRIP_HEADERS = "REQUEST_STRIP_HEADERS"
+const RESPONSE_STRIP_HEADERS = "RESPONSE_STRIP_HEADERS"
+const REQUEST_ALLOW_HEADERS = "REQUEST_ALLOW_HEADERS"
+const RESPONSE_ALLOW_HEADERS = "RESPONSE_ALLOW_HEADERS"
+const REQUEST_SET_HEADERS = "REQUEST_SET_HEADERS"
+const REQUEST_ADD_HEADERS = "REQUEST_ADD_HEADERS"
+
+const STRIP_PATH_PREFIX = "STRIP_PATH_PREFIX"
+const ADD_PATH_PREFIX = "ADD_PATH_PREFIX"
+const PATH_REWRITES = "PATH_REWRITES"
+const FIELD_REWRITES = "FIELD_REWRITES"
+
+const RAW_UPLOADS = "RAW_UPLOADS"
+const RAW_RENAME_PATH = "RAW_RENAME_PATH"
+const JSON_FIELDS = "JSON_FIELDS"
+const WEBDAV = "WEBDAV"
+const TUS = "TUS"
+const TUS_DELIVERY = "TUS_DELIVERY"
+const TUS_DIR = "TUS_DIR"
+const TUS_EXPIRY = "TUS_EXPIRY"
+const S3 = "S3"
+const S3_ACCESS_KEY_ID = "S3_ACCESS_KEY_ID"
+const S3_SECRET_ACCESS_KEY = "S3_SECRET_ACCESS_KEY"
+const S3_REGION = "S3_REGION"
+const S3_VERIFY_SIGNATURE = "S3_VERIFY_SIGNATURE"
+const S3_DIR = "S3_DIR"
+const S3_EXPIRY = "S3_EXPIRY"
+
+const ROUTES = "ROUTES"
+const PROFILES = "PROFILES"
+
+const RETRY_ATTEMPTS = "RETRY_ATTEMPTS"
+const RETRY_BACKOFF = "RETRY_BACKOFF"
+const RETRY_MAX_BACKOFF = "RETRY_MAX_BACKOFF"
+const RETRY_STATUSES = "RETRY_STATUSES"
+const RETRY_DEADLINE = "RETRY_DEADLINE"
+
+const UPSTREAM_TARGETS = "UPSTREAM_TARGETS"
+const UPSTREAM_BALANCING = "UPSTREAM_BALANCING"
+const UPSTREAM_HEALTH_PATH = "UPSTREAM_HEALTH_PATH"
+const UPSTREAM_HEALTH_INTERVAL = "UPSTREAM_HEALTH_INTERVAL"
+const UPSTREAM_EJECT_THRESHOLD = "UPSTREAM_EJECT_THRESHOLD"
+const UPSTREAM_EJECT_DURATION = "UPSTREAM_EJECT_DURATION"
+
+const UPSTREAM_DIAL_TIMEOUT = "UPSTREAM_DIAL_TIMEOUT"
+const UPSTREAM_TLS_TIMEOUT = "UPSTREAM_TLS_TIMEOUT"
+const UPSTREAM_RESPONSE_TIMEOUT = "UPSTREAM_RESPONSE_TIMEOUT"
+const UPSTREAM_TIMEOUT = "UPSTREAM_TIMEOUT"
+const UPSTREAM_MAX_IDLE_CONNS = "UPSTREAM_MAX_IDLE_CONNS"
+const UPSTREAM_MAX_IDLE_CONNS_PER_HOST = "UPSTREAM_MAX_IDLE_CONNS_PER_HOST"
+const UPSTREAM_MAX_CONNS_PER_HOST = "UPSTREAM_MAX_CONNS_PER_HOST"
+const UPSTREAM_IDLE_CONN_TIMEOUT = "UPSTREAM_IDLE_CONN_TIMEOUT"
+const UPSTREAM_HTTP2 = "UPSTREAM_HTTP2"
+
+const BREAKER_THRESHOLD = "BREAKER_THRESHOLD"
+const BREAKER_COOLDOWN = "BREAKER_COOLDOWN"
+const BREAKER_HALF_OPEN_REQUESTS = "BREAKER_HALF_OPEN_REQUESTS"
+
+const QUEUE_DIR = "QUEUE_DIR"
+const QUEUE_RETRY_INTERVAL = "QUEUE_RETRY_INTERVAL"
+const QUEUE_RESPONSE_STATUS = "QUEUE_RESPONSE_STATUS"
+const QUEUE_RESPONSE_BODY = "QUEUE_RESPONSE_BODY"
+const QUEUE_MAX_BYTES = "QUEUE_MAX_BYTES"
+
+const CONFIG_FILE = "CONFIG_FILE"
+const CONFIG_RELOAD_INTERVAL = "CONFIG_RELOAD_INTERVAL"
+const STRICT_CONFIG = "STRICT_CONFIG"
+
+const DRY_RUN = "DRY_RUN"
+const ADMIN_LISTEN_ADDR = "ADMIN_LISTEN_ADDR"
+
+const REPORT_HEADERS = "REPORT_HEADERS"
+const REPORT_RESPONSE_HEADERS = "REPORT_RESPONSE_HEADERS"
+
+const OVERRIDE_SECRET = "OVERRIDE_SECRET"
+const OVERRIDE_ALLOW = "OVERRIDE_ALLOW"
+const CLIENT_RULES = "CLIENT_RULES"
+
 
 var client *http.Client
 
@@ -56,125 +140,193 @@ Test with
 curl --header "X-Test: hello" -F "deviceAssetId=web-input.jpg-1672571948584" -F "deviceId=WEB" -F "createdAt=2016-12-02T10:10:20.000Z" -F "modifiedAt=2023-01-01T11:19:08.584Z" -F "isFavorite=false" -F "duration=0:00:00.000000" -F "fileExtension=.jpg" -F "assetData=@example.jpg" http://localhost:6743/upload
 */
 func main() {
-	cfg := NewConfigFromEnv()
-	
-	log.Println(IMG_MAX_WIDTH+": ", cfg.ImgMaxWidth)
-	log.Println(IMG_MAX_HEIGHT+": ", cfg.ImgMaxHeight) 
-	log.Println(IMG_MAX_NARROW_SIDE+": ", cfg.ImgMaxNarrowSide)
-	log.Println(JPEG_QUALITY+": ", cfg.JpegQuality)
-	log.Println(WEBP_QUALITY+": ", cfg.WebpQuality)
-	if cfg.NormalizeExt {
-		log.Println(NORMALIZE_EXTENSIONS+": ", 1)
-	} else {
-		log.Println(NORMALIZE_EXTENSIONS+": ", 0)
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve runs the proxy until the listener fails.
+func serve(holder *configHolder) int {
+	cfg := holder.Load()
+
+	if holder.path != "" {
+		log.Println(CONFIG_FILE+": ", holder.path)
+	}
+	for _, s := range settings {
+		log.Println(s.Env+": ", s.Get(cfg))
 	}
-	log.Println(UPLOAD_MAX_SIZE+": ", cfg.UploadMaxSize)
 	log.Println(IMG_MAX_PIXELS+": ", cfg.ImgMaxPixels)
-	log.Println(FORWARD_DESTINATION+": ", cfg.ForwardDestination)
-	log.Println(FILE_UPLOAD_FIELD+": ", cfg.FileUploadField)
-	log.Println(LISTEN_PATH+": ", cfg.ListenPath)
-	log.Println(CONVERT_TO_FORMAT+": ", cfg.ConvertToFormat)
 
-	client = &http.Client{
-		Timeout: time.Second * 60,
-	}
+	transport.configure(cfg)
+	client = &http.Client{Transport: transport}
+
+	serveAdmin(cfg.AdminListenAddr, holder)
+	holder.watchSignals()
+	holder.watchQueue()
+	holder.watchUpstreams()
+	holder.watchFile(cfg.ConfigReloadInterval, nil)
 
 	handlerWithConfig := func(w http.ResponseWriter, r *http.Request) {
-		proxyHandler(w, r, cfg)
+		proxyHandler(w, r, holder.Load())
 	}
 
-	http.HandleFunc(cfg.ListenPath, handlerWithConfig)
-	if cfg.ListenPath != "/" {
-		http.HandleFunc("/", handlerWithConfig)
+	// Routing happens in proxyHandler so that reloaded routes take effect.
+	http.HandleFunc("/", handlerWithConfig)
+	if err := http.ListenAndServe(":6743", nil); err != nil {
+		log.Println(err)
+		return 1
 	}
-	http.ListenAndServe(":6743", nil)
+	return 0
 }
 
 func proxyHandler(w http.ResponseWriter, r *http.Request, cfg *Config) {
-	body := &bytes.Buffer{}
+	var body *requestBody
 	contentType := r.Header.Get("Content-Type")
+	var uploads []uploadResult
+
+	// The route is resolved once: processing may rename r.URL.Path, and the
+	// renamed request must still go through the route it arrived on.
+	route := cfg.matchRoute(r)
+	if isTusRequest(r, route) {
+		tusHandler(w, r, cfg, route)
+		return
+	} else if isS3Request(r, route) {
+		s3Handler(w, r, cfg, route)
+		return
+	}
+	if rejectOpenCircuit(w, r, cfg, route) {
+		return
+	}
 
 	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
 		log.Println("Incoming file upload")
+		if !limitBody(w, r, cfg.UploadMaxSize) {
+			return
+		}
 
 		var err error
-		contentType, body, err = reformatMultipart(w, r, cfg)
+		contentType, body, uploads, err = reformatMultipart(w, r, cfg, route)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), requestErrorStatus(err))
 			return
 		}
+		defer body.Close()
 	} else {
+		// Overrides are checked and removed even if the body is not processed.
+		profile, err := cfg.requestProfile(r, route)
+		if err != nil {
+			http.Error(w, err.Error(), requestErrorStatus(err))
+			return
+		}
+		if !limitBody(w, r, cfg.BodyMaxSize) {
+			return
+		}
 		byteBody, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), requestErrorStatus(err))
 			return
 		}
-		body = bytes.NewBuffer(byteBody)
+		if mimeType, ok := rawUploadType(r, route, byteBody); ok {
+			upload := processRawUpload(w, r, route, profile, byteBody, mimeType)
+			uploads = []uploadResult{upload}
+			byteBody = upload.Data
+			contentType = upload.MimeType
+		} else if len(route.JSONFields) > 0 && isJSONRequest(r) {
+			byteBody, uploads = processJSONUpload(w, route, profile, byteBody)
+		}
+		body = newRequestBody(byteBody)
+	}
+
+	target, err := route.upstreamURL(r.URL)
+	if err != nil {
+		log.Println("Invalid upstream URL:", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
 	}
 
 	// Forward request
-	proxyReq, _ := http.NewRequest(r.Method, cfg.ForwardDestination, body)
-	copyHeader(proxyReq.Header, r.Header)
-	proxyReq.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	proxyReq, _ := newBodyRequest(r.Method, target.String(), body)
+	cfg.RequestHeaders.Apply(proxyReq.Header, r.Header)
+	proxyReq.Header.Set("Content-Length", strconv.FormatInt(body.Len(), 10))
 	proxyReq.Header.Set("Content-Type", contentType)
-
-	if r.URL.Path != cfg.ListenPath {
-		log.Println("Request hit proxy but not the intended path, proxying to copied path")
-		proxyReq.URL.Path = r.URL.Path
-		proxyReq.URL.RawQuery = r.URL.RawQuery
+	if route.WebDAV {
+		if err := rewriteDestination(proxyReq.Header, route); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// Report headers from the client are dropped even if nothing was
+	// processed, so the upstream can trust them.
+	if cfg.ReportHeaders {
+		addReportHeaders(proxyReq.Header, uploads)
 	}
 
-	proxyResp, err := client.Do(proxyReq)
+	proxyResp, err := sendUpstream(cfg, proxyReq)
+	if cfg.QueueDir != "" && uploads != nil && (err != nil || containsStatus(cfg.RetryStatuses, proxyResp.StatusCode)) {
+		reason := err
+		if reason == nil {
+			reason = fmt.Errorf("upstream returned %s", proxyResp.Status)
+		}
+		q, qerr := queueBody(cfg, proxyReq, body, reason)
+		if qerr == nil {
+			if proxyResp != nil {
+				proxyResp.Body.Close()
+			}
+			log.Printf("Upstream unavailable, queued request %s: %v", q.ID, reason)
+			respondQueued(w, cfg, q)
+			return
+		}
+		log.Println("Cannot queue request:", qerr)
+		if errors.Is(qerr, errQueueFull) {
+			if proxyResp != nil {
+				proxyResp.Body.Close()
+			}
+			http.Error(w, qerr.Error(), http.StatusInsufficientStorage)
+			return
+		}
+	}
+	if errors.Is(err, errCircuitOpen) {
+		writeCircuitOpen(w, upstreamRetryAfter(cfg, target))
+		return
+	}
 	if err != nil {
 		log.Println("ProxyResp Error:", err)
 		http.Error(w, err.Error(), http.StatusFailedDependency)
 		return
 	}
+	defer proxyResp.Body.Close()
 
-	copyHeader(w.Header(), proxyResp.Header)
+	var respBody io.Reader = proxyResp.Body
+	if route.WebDAV {
+		respBody = webdavAfterResponse(r, route, target, proxyReq.Header.Get("Destination"), uploads, proxyResp)
+	}
+
+	cfg.ResponseHeaders.Apply(w.Header(), proxyResp.Header)
+	if cfg.ReportResponseHeaders && uploads != nil {
+		addReportHeaders(w.Header(), uploads)
+	}
 	w.WriteHeader(proxyResp.StatusCode)
-	io.Copy(w, proxyResp.Body)
+	io.Copy(w, respBody)
 }
 
-var ignoreHeaders = []string{
-	"Connection",
-	"Keep-Alive",
-	"Proxy-Authenticate",
-	"Proxy-Authorization",
-	"Te",
-	"Trailers",
-	"Transfer-Encoding",
-	"Upgrade",
-	"Accept-Encoding",
-	"Host",
-	"Cf-Ipcountry",
-	"Cf-Connecting-Ip",
-	"X-Forwarded-Proto",
-	"X-Forwarded-For",
-	"Cf-Ray",
-	"Cf-Visitor",
-	"Cf-Warp-Tag-Id",
-	"Content-Type",
-	"Origin",
-	"X-Amzn-Trace-Id",
+// queueBody stores proxyReq with body in QUEUE_DIR.
+func queueBody(cfg *Config, proxyReq *http.Request, body *requestBody, reason error) (queuedRequest, error) {
+	payload, err := body.Open()
+	if err != nil {
+		return queuedRequest{}, err
+	}
+	defer payload.Close()
+	return enqueueRequest(cfg.QueueDir, cfg.QueueMaxBytes, proxyReq, payload, reason)
 }
 
-func copyHeader(dst, src http.Header) {
-	for k, vv := range src {
-		ignoreThisHeader := false
-		for _, ignoreHeader := range ignoreHeaders {
-			if strings.ToLower(k) == strings.ToLower(ignoreHeader) {
-				ignoreThisHeader = true
-				break
-			}
-		}
-		if ignoreThisHeader {
-			continue
-		}
-
-		for _, v := range vv {
-			dst.Add(k, v)
-		}
+// requestErrorStatus maps errors from reading a request to a status code.
+func requestErrorStatus(err error) int {
+	if errors.Is(err, errOverrideDenied) {
+		return http.StatusForbidden
+	}
+	if isTooLarge(err) {
+		return http.StatusRequestEntityTooLarge
 	}
+	if errors.Is(err, errSpoolFull) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusBadRequest
 }
-
@@ -954,10 +954,11 @@ func TestMIMEConsistencyWithBytes(t *testing.T) {
 	}
 
 	// Call reformatMultipart
-	_, resultBody, err := reformatMultipart(httptest.NewRecorder(), req, cfg)
+	_, rebuilt, _, err := reformatMultipart(httptest.NewRecorder(), req, cfg, cfg.matchRoute(req))
 	if err != nil {
 		t.Fatalf("reformatMultipart failed: %v", err)
 	}
+	resultBody := readRequestBody(t, rebuilt)
 
 	// Parse the result multipart form to check content
 	// For now, let's verify the current behavior by checking if we can detect the issue
@@ -1078,10 +1079,11 @@ func TestEXIFRotationPersistence(t *testing.T) {
 	}
 
 	// Test the complete reformatMultipart to ensure rotation is preserved
-	_, resultBody, err := reformatMultipart(httptest.NewRecorder(), req, cfg)
+	_, rebuilt, _, err := reformatMultipart(httptest.NewRecorder(), req, cfg, cfg.matchRoute(req))
 	if err != nil {
 		t.Fatalf("reformatMultipart failed: %v", err)
 	}
+	resultBody := readRequestBody(t, rebuilt)
 
 	t.Logf("Result form size: %d bytes", len(resultBody.Bytes()))
 
@@ -1853,10 +1855,11 @@ func TestResizeLogMessages(t *testing.T) {
 			}
 
 			// Call reformatMultipart to trigger the log
-			_, _, err = reformatMultipart(httptest.NewRecorder(), req, cfg)
+			_, rebuilt, _, err := reformatMultipart(httptest.NewRecorder(), req, cfg, cfg.matchRoute(req))
 			if err != nil {
 				t.Fatalf("reformatMultipart failed: %v", err)
 			}
+			rebuilt.Close()
 
 			// Check log output
 			logOutput := logBuffer.String()
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queuedRequest is an upstream request that is stored in QUEUE_DIR until the
+// upstream is reachable again. The body is kept next to it.
+type queuedRequest struct {
+	ID        string      `json:"id"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header,omitempty"`
+	Size      int64       `json:"size"`
+	Created   time.Time   `json:"created"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"last_error,omitempty"`
+}
+
+// queueFailedDir holds requests the upstream answered with an error on
+// replay. They are kept for inspection and never replayed again.
+const queueFailedDir = "failed"
+
+var queueLength = newMetric("upload_proxy_queued_requests", "gauge",
+	"Requests in QUEUE_DIR, by state.", "state")
+
+// errQueueFull is returned when QUEUE_MAX_BYTES would be exceeded.
+var errQueueFull = errors.New("queue is full")
+
+// queueMu serializes enqueueing while QUEUE_MAX_BYTES is set, so that
+// concurrent requests cannot exceed it together.
+var queueMu sync.Mutex
+
+// enqueueRequest stores req with its body. IDs sort in the order requests
+// were queued, which is the order they are replayed in. With a limit, the
+// bodies of queued and failed requests may not exceed limit bytes together.
+func enqueueRequest(dir string, limit int64, req *http.Request, body io.Reader, reason error) (queuedRequest, error) {
+	random := make([]byte, 4)
+	rand.Read(random)
+	now := time.Now()
+	q := queuedRequest{
+		ID:        fmt.Sprintf("%019d-%s", now.UnixNano(), hex.EncodeToString(random)),
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Header:    req.Header,
+		Created:   now,
+		Attempts:  1,
+		LastError: reason.Error(),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return q, err
+	}
+	var room int64 = -1
+	if limit > 0 {
+		queueMu.Lock()
+		defer queueMu.Unlock()
+		if room = limit - queueBytes(dir); room < 0 {
+			return q, errQueueFull
+		}
+		// One byte over is enough to know it does not fit.
+		body = io.LimitReader(body, room+1)
+	}
+	size, err := writeQueuedBody(filepath.Join(dir, q.ID+".body"), body)
+	if err != nil {
+		return q, err
+	}
+	if room >= 0 && size > room {
+		os.Remove(filepath.Join(dir, q.ID+".body"))
+		return q, errQueueFull
+	}
+	q.Size = size
+	if err := writeQueuedRequest(dir, q); err != nil {
+		os.Remove(filepath.Join(dir, q.ID+".body"))
+		return q, err
+	}
+	updateQueueMetrics(dir)
+	return q, nil
+}
+
+func writeQueuedBody(path string, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return n, err
+}
+
+// writeQueuedRequest replaces the metadata file atomically, so a crash never
+// leaves a half-written entry behind.
+func writeQueuedRequest(dir string, q queuedRequest) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, q.ID+".json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, q.ID+".json"))
+}
+
+// listQueue returns the requests in dir, oldest first.
+func listQueue(dir string) []queuedRequest {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Strings(paths)
+	queue := make([]queuedRequest, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var q queuedRequest
+		if err := json.Unmarshal(data, &q); err != nil {
+			log.Printf("Skipping unreadable queue entry %s: %v", path, err)
+			continue
+		}
+		queue = append(queue, q)
+	}
+	return queue
+}
+
+// replayQueue sends queued requests in order. It stops at the first one
+// that still cannot be delivered, so the order is kept.
+func replayQueue(cfg *Config) {
+	for _, q := range listQueue(cfg.QueueDir) {
+		if !replayRequest(cfg, q) {
+			break
+		}
+	}
+	updateQueueMetrics(cfg.QueueDir)
+}
+
+// replayRequest reports whether q left the queue.
+func replayRequest(cfg *Config, q queuedRequest) bool {
+	dir := cfg.QueueDir
+	body, err := os.ReadFile(filepath.Join(dir, q.ID+".body"))
+	if err != nil {
+		log.Printf("Dropping queued request %s without body: %v", q.ID, err)
+		os.Remove(filepath.Join(dir, q.ID+".json"))
+		return true
+	}
+	req, err := http.NewRequest(q.Method, q.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Dropping invalid queued request %s: %v", q.ID, err)
+		removeQueuedRequest(dir, q.ID)
+		return true
+	}
+	req.Header = q.Header
+
+	q.Attempts++
+	resp, err := sendUpstream(cfg, req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if containsStatus(cfg.RetryStatuses, resp.StatusCode) {
+			err = fmt.Errorf("upstream returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		q.LastError = err.Error()
+		writeQueuedRequest(dir, q)
+		log.Printf("Queued request %s still not delivered after %d attempts: %v", q.ID, q.Attempts, err)
+		return false
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		log.Printf("Delivered queued request %s: %s %s -> %s", q.ID, q.Method, q.URL, resp.Status)
+		removeQueuedRequest(dir, q.ID)
+		return true
+	}
+	q.LastError = "upstream returned " + resp.Status
+	log.Printf("Queued request %s rejected by upstream with %s, moving it to %s", q.ID, resp.Status, queueFailedDir)
+	failed := filepath.Join(dir, queueFailedDir)
+	if err := os.MkdirAll(failed, 0700); err != nil {
+		log.Println("Cannot move failed queue entry:", err)
+		return false
+	}
+	os.Rename(filepath.Join(dir, q.ID+".body"), filepath.Join(failed, q.ID+".body"))
+	writeQueuedRequest(failed, q)
+	os.Remove(filepath.Join(dir, q.ID+".json"))
+	return true
+}
+
+func removeQueuedRequest(dir, id string) {
+	os.Remove(filepath.Join(dir, id+".json"))
+	os.Remove(filepath.Join(dir, id+".body"))
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// queueBytes returns the size of the bodies of the queued and failed
+// requests in dir.
+func queueBytes(dir string) int64 {
+	var total int64
+	for _, list := range [][]queuedRequest{listQueue(dir), listQueue(filepath.Join(dir, queueFailedDir))} {
+		for _, q := range list {
+			total += q.Size
+		}
+	}
+	return total
+}
+
+func updateQueueMetrics(dir string) {
+	queueLength.Set(float64(len(listQueue(dir))), "queued")
+	queueLength.Set(float64(len(listQueue(filepath.Join(dir, queueFailedDir)))), "failed")
+}
+
+// watchQueue replays the queue in the background. QUEUE_DIR and
+// QUEUE_RETRY_INTERVAL are read from the current config on every round.
+func (h *configHolder) watchQueue() {
+	go func() {
+		for {
+			cfg := h.Load()
+			if cfg.QueueDir != "" {
+				replayQueue(cfg)
+			}
+			interval := cfg.QueueRetryInterval
+			if interval < time.Second {
+				interval = time.Second
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// respondQueued tells the client its request was stored.
+func respondQueued(w http.ResponseWriter, cfg *Config, q queuedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Upload-Proxy-Queued", q.ID)
+	w.WriteHeader(cfg.QueueResponseStatus)
+	io.WriteString(w, strings.ReplaceAll(cfg.QueueResponseBody, "{id}", q.ID))
+}
+
+// queueStatus is the admin view of the queue.
+type queueStatus struct {
+	Queued []queuedRequest `json:"queued"`
+	Failed []queuedRequest `json:"failed"`
+}
+
+func serveQueue(w http.ResponseWriter, cfg *Config) {
+	if cfg.QueueDir == "" {
+		http.Error(w, "queue is disabled", http.StatusNotFound)
+		return
+	}
+	status := queueStatus{
+		Queued: listQueue(cfg.QueueDir),
+		Failed: listQueue(filepath.Join(cfg.QueueDir, queueFailedDir)),
+	}
+	// Headers can carry credentials, so they are left out.
+	for _, list := range [][]queuedRequest{status.Queued, status.Failed} {
+		for i := range list {
+			list[i].Header = nil
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listenOn reopens the address of a closed test server.
+func listenOn(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("cannot reuse test server address:", err)
+	}
+	return l
+}
+
+func TestQueueWhenUpstreamDown(t *testing.T) {
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Header.Get("Authorization")+" "+string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	useClient(t, upstream.Client())
+	target := upstream.URL
+	upstream.Close()
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = target
+	cfg.QueueDir = t.TempDir()
+
+	// Requests are queued while the upstream is unreachable.
+	for i := 0; i < 2; i++ {
+		req := spoolRequest(t, []byte("video"))
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, req, cfg)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202: %s", rec.Code, rec.Body.String())
+		}
+		id := rec.Header().Get("X-Upload-Proxy-Queued")
+		if want := `{"status":"queued","id":"` + id + `"}`; id == "" || rec.Body.String() != want {
+			t.Errorf("body = %q, want %q", rec.Body.String(), want)
+		}
+	}
+	queued := listQueue(cfg.QueueDir)
+	if len(queued) != 2 || queued[0].ID >= queued[1].ID {
+		t.Fatalf("queue = %+v, want 2 entries in order", queued)
+	}
+
+	// Nothing is lost while the upstream is still down.
+	replayQueue(cfg)
+	if queued := listQueue(cfg.QueueDir); len(queued) != 2 || queued[0].Attempts != 2 || queued[0].LastError == "" {
+		t.Errorf("queue after failed replay = %+v", queued)
+	}
+
+	// Once it is back the processed requests are delivered with their headers.
+	upstream = httptest.NewUnstartedServer(upstream.Config.Handler)
+	upstream.Listener.Close()
+	upstream.Listener = listenOn(t, strings.TrimPrefix(target, "http://"))
+	upstream.Start()
+	defer upstream.Close()
+
+	replayQueue(cfg)
+	if len(received) != 2 {
+		t.Fatalf("%d requests delivered, want 2", len(received))
+	}
+	for _, r := range received {
+		if !strings.HasPrefix(r, "Bearer token ") || !strings.Contains(r, "video") {
+			t.Errorf("delivered %q", r)
+		}
+	}
+	if files, _ := os.ReadDir(cfg.QueueDir); len(files) != 0 {
+		t.Errorf("%d file(s) left in the queue", len(files))
+	}
+}
+
+func TestQueueRejectedRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.QueueDir = t.TempDir()
+	req, _ := http.NewRequest("POST", upstream.URL+"/api/assets", strings.NewReader("processed"))
+	req.Header.Set("Authorization", "Bearer token")
+	q, err := enqueueRequest(cfg.QueueDir, 0, req, strings.NewReader("processed"), io.ErrUnexpectedEOF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request the upstream rejects is kept aside and not replayed again.
+	replayQueue(cfg)
+	if queued := listQueue(cfg.QueueDir); len(queued) != 0 {
+		t.Errorf("%d request(s) still queued", len(queued))
+	}
+	failed := listQueue(filepath.Join(cfg.QueueDir, queueFailedDir))
+	if len(failed) != 1 || failed[0].ID != q.ID || !strings.Contains(failed[0].LastError, "400") {
+		t.Fatalf("failed = %+v", failed)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.QueueDir, queueFailedDir, q.ID+".body")); err != nil {
+		t.Error(err)
+	}
+
+	// The admin view lists it without headers.
+	rec := httptest.NewRecorder()
+	adminHandler(newConfigHolder("", nil, cfg)).ServeHTTP(rec, httptest.NewRequest("GET", "/queue", nil))
+	var status queueStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Queued) != 0 || len(status.Failed) != 1 || status.Failed[0].ID != q.ID {
+		t.Errorf("admin view = %s", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "Bearer") {
+		t.Error("admin view exposes request headers")
+	}
+
+	rec = httptest.NewRecorder()
+	adminHandler(newConfigHolder("", nil, defaultConfig())).ServeHTTP(rec, httptest.NewRequest("GET", "/queue", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d with the queue disabled, want 404", rec.Code)
+	}
+}
+
+func TestQueueOnlyUploads(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	useClient(t, upstream.Client())
+	upstream.Close()
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL
+	cfg.QueueDir = t.TempDir()
+
+	// Plain requests fail as before; only processed uploads are queued.
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest("GET", "/api/assets", nil), cfg)
+	if rec.Code != http.StatusFailedDependency {
+		t.Errorf("status = %d, want 424", rec.Code)
+	}
+	if queued := listQueue(cfg.QueueDir); len(queued) != 0 {
+		t.Errorf("%d request(s) queued", len(queued))
+	}
+}
+
+func TestQueueOnRetryStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL
+	cfg.QueueDir = t.TempDir()
+
+	// An upstream that answers but is not available keeps the upload too.
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, spoolRequest(t, []byte("video")), cfg)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", rec.Code, rec.Body.String())
+	}
+	queued := listQueue(cfg.QueueDir)
+	if len(queued) != 1 || !strings.Contains(queued[0].LastError, "503") {
+		t.Fatalf("queue = %+v, want 1 entry failed with 503", queued)
+	}
+
+	// Once QUEUE_MAX_BYTES is reached, uploads are refused.
+	cfg.QueueMaxBytes = queued[0].Size + 10
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, spoolRequest(t, []byte("video")), cfg)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("status = %d, want 507 with a full queue", rec.Code)
+	}
+	if queued := listQueue(cfg.QueueDir); len(queued) != 1 {
+		t.Errorf("%d request(s) queued, want 1", len(queued))
+	}
+	if files, _ := filepath.Glob(filepath.Join(cfg.QueueDir, "*.body")); len(files) != 1 {
+		t.Errorf("%d body file(s) in the queue, want 1", len(files))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// isRawImageUpload reports whether the request body is a single image, as
+// sent by WebDAV clients, S3-style APIs and many REST APIs.
+func isRawImageUpload(r *http.Request) bool {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "image/")
+}
+
+// rawUploadType returns the image type of a request body that the route
+// processes as a whole, if any.
+func rawUploadType(r *http.Request, route *Route, body []byte) (string, bool) {
+	if route.WebDAV {
+		if mimeType, ok := isWebDAVImagePut(r, body); ok {
+			return mimeType, true
+		}
+	}
+	if route.RawUploads && isRawImageUpload(r) {
+		mimeType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return mimeType, true
+	}
+	return "", false
+}
+
+// processRawUpload runs a raw request body of type mimeType through the
+// pipeline. The file name is taken from the last path segment. If the route
+// renames paths and the file was renamed, r.URL is updated so the upstream
+// gets the new name.
+func processRawUpload(w http.ResponseWriter, r *http.Request, route *Route, profile ProcessingProfile, data []byte, mimeType string) uploadResult {
+	filename := path.Base(r.URL.Path)
+	if filename == "/" || filename == "." {
+		filename = "upload"
+	}
+
+	log.Printf("Incoming raw image upload: %s (%s)", filename, mimeType)
+	upload := processUpload(data, filename, mimeType, profile)
+	recordUpload(upload, profile.DryRun)
+
+	if profile.DryRun {
+		return applyDryRun(w, "body", upload, data, filename, mimeType)
+	}
+
+	if route.RenamePath && upload.Filename != filename {
+		renamed := path.Join(path.Dir(r.URL.Path), upload.Filename)
+		log.Printf("Renaming upload path: %s -> %s", r.URL.Path, renamed)
+		r.URL.Path = renamed
+		r.URL.RawPath = ""
+	}
+	return upload
+}
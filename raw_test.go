@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHandlerRawUpload(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	var gotPath, gotType string
+	var gotBody []byte
+	var gotLength int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotType, gotLength = r.URL.Path, r.Header.Get("Content-Type"), r.ContentLength
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL
+	cfg.ListenPath = "/dav"
+	cfg.StripPathPrefix = "/dav"
+	cfg.ImgMaxWidth = 400
+	cfg.ImgMaxHeight = 400
+
+	put := func() *http.Request {
+		req := httptest.NewRequest("PUT", "/dav/photos/photo.png", bytes.NewReader(pngData))
+		req.Header.Set("Content-Type", "image/png")
+		return req
+	}
+
+	proxyHandler(httptest.NewRecorder(), put(), cfg)
+	if !bytes.Equal(gotBody, pngData) {
+		t.Error("Raw bodies should be forwarded untouched unless RAW_UPLOADS is enabled")
+	}
+
+	cfg.RawUploads = true
+	proxyHandler(httptest.NewRecorder(), put(), cfg)
+	if len(gotBody) == 0 || len(gotBody) >= len(pngData) {
+		t.Errorf("Expected a smaller processed body, got %d bytes (original %d)", len(gotBody), len(pngData))
+	}
+	if gotLength != int64(len(gotBody)) {
+		t.Errorf("Content-Length = %d, want %d", gotLength, len(gotBody))
+	}
+	if gotType != "image/png" || gotPath != "/photos/photo.png" {
+		t.Errorf("Content-Type = %q, path = %q", gotType, gotPath)
+	}
+
+	cfg.ConvertToFormat = "JPEG"
+	cfg.JpegQuality = 30
+	cfg.RawRenamePath = true
+	proxyHandler(httptest.NewRecorder(), put(), cfg)
+	if gotType != JPEG_MIME_TYPE {
+		t.Errorf("Content-Type = %q, want %q", gotType, JPEG_MIME_TYPE)
+	}
+	if gotPath != "/photos/photo.JPG" {
+		t.Errorf("path = %q, want the renamed file", gotPath)
+	}
+}
+
+func TestIsRawImageUpload(t *testing.T) {
+	tests := []struct {
+		method      string
+		contentType string
+		want        bool
+	}{
+		{"PUT", "image/jpeg", true},
+		{"POST", "image/heic; charset=binary", true},
+		{"GET", "image/jpeg", false},
+		{"PUT", "application/octet-stream", false},
+		{"PUT", "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/x.jpg", nil)
+		req.Header.Set("Content-Type", tt.contentType)
+		if got := isRawImageUpload(req); got != tt.want {
+			t.Errorf("isRawImageUpload(%s %q) = %v, want %v", tt.method, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestProxyHandlerRawUploadKeepsRoute(t *testing.T) {
+	jpegData, err := createTestImage(1600, 1200, 95)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	var gotPath string
+	photos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer photos.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Renamed upload went to the route of its new name: %s", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer other.Close()
+	useClient(t, photos.Client())
+
+	cfg := defaultConfig()
+	cfg.ImgMaxWidth = 400
+	cfg.ImgMaxHeight = 400
+	cfg.ConvertToFormat = "WEBP"
+	cfg.NormalizeExt = true
+	routes, err := parseRoutes(`[
+		{"path": "/photos", "upstream": "`+photos.URL+`", "raw_uploads": true, "rename_path": true},
+		{"path": "/photos/photo.WEBP", "upstream": "`+other.URL+`"}
+	]`, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Routes = routes
+
+	// The upload is renamed to photo.WEBP, which matches the second route,
+	// but it arrived on the first one.
+	req := httptest.NewRequest("PUT", "/photos/photo.jpg", bytes.NewReader(jpegData))
+	req.Header.Set("Content-Type", "image/jpeg")
+	proxyHandler(httptest.NewRecorder(), req, cfg)
+	if gotPath != "/photos/photo.WEBP" {
+		t.Errorf("path = %q, want the renamed file on the original route", gotPath)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configHolder hands out the current configuration. Each request loads the
+// config once when it starts, so a reload only affects new requests and
+// in-flight ones finish with the config they started with.
+type configHolder struct {
+	path       string
+	flagValues map[string]string
+	current    atomic.Pointer[Config]
+	modTime    time.Time
+}
+
+func newConfigHolder(path string, flagValues map[string]string, cfg *Config) *configHolder {
+	h := &configHolder{path: path, flagValues: flagValues}
+	h.current.Store(cfg)
+	h.modTime = h.fileModTime()
+	return h
+}
+
+func (h *configHolder) Load() *Config {
+	return h.current.Load()
+}
+
+// Reload reads the configuration again and swaps it in. A config with any
+// invalid or unknown value is rejected and the running one is kept.
+func (h *configHolder) Reload() error {
+	cfg, problems, err := loadConfig(h.path, h.flagValues)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		return fmt.Errorf("%d invalid setting(s), keeping current config", len(problems))
+	}
+
+	old := h.current.Swap(cfg)
+	transport.configure(cfg)
+	changes := diffConfig(old, cfg)
+	if len(changes) == 0 {
+		log.Println("Config reloaded, no changes")
+	}
+	for _, change := range changes {
+		log.Println("Config changed:", change)
+	}
+	return nil
+}
+
+// diffConfig lists the settings whose effective value differs.
+func diffConfig(old, cfg *Config) []string {
+	var changes []string
+	for _, s := range settings {
+		// Secrets are compared unmasked but only shown masked.
+		if s.value(old) != s.value(cfg) {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", s.Env, s.Get(old), s.Get(cfg)))
+		}
+	}
+	return changes
+}
+
+func (h *configHolder) fileModTime() time.Time {
+	if h.path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (h *configHolder) reloadAndLog(reason string) {
+	log.Printf("Reloading config (%s)", reason)
+	if err := h.Reload(); err != nil {
+		log.Printf("Config reload failed: %v", err)
+	}
+}
+
+// watchSignals reloads the config on SIGHUP.
+func (h *configHolder) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			h.reloadAndLog("SIGHUP")
+		}
+	}()
+}
+
+// watchFile polls the config file and reloads it when its modification time
+// changes, until stop is closed.
+func (h *configHolder) watchFile(interval time.Duration, stop <-chan struct{}) {
+	if h.path == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			modTime := h.fileModTime()
+			if modTime.IsZero() || modTime.Equal(h.modTime) {
+				continue
+			}
+			h.modTime = modTime
+			h.reloadAndLog(h.path + " changed")
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigHolderReload(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	path := writeTestConfigFile(t, "proxy.yaml", "jpeg_quality: 80\n")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	holder := newConfigHolder(path, nil, cfg)
+
+	inFlight := holder.Load()
+
+	os.WriteFile(path, []byte("jpeg_quality: 60\nimg_max_width: 1280\n"), 0o600)
+	if err := holder.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	if holder.Load().JpegQuality != 60 || holder.Load().ImgMaxWidth != 1280 {
+		t.Errorf("reloaded config = %d/%d, want 60/1280", holder.Load().JpegQuality, holder.Load().ImgMaxWidth)
+	}
+	if inFlight.JpegQuality != 80 {
+		t.Errorf("in-flight config JpegQuality = %d, want it to stay 80", inFlight.JpegQuality)
+	}
+
+	os.WriteFile(path, []byte("jpeg_quality: 500\n"), 0o600)
+	if err := holder.Reload(); err == nil {
+		t.Error("Expected reload with invalid value to fail")
+	}
+	os.WriteFile(path, []byte("jpeg_quality: [\n"), 0o600)
+	if err := holder.Reload(); err == nil {
+		t.Error("Expected reload with malformed file to fail")
+	}
+	if holder.Load().JpegQuality != 60 {
+		t.Errorf("JpegQuality = %d, want 60 kept after failed reloads", holder.Load().JpegQuality)
+	}
+}
+
+func TestConfigHolderWatchFile(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	path := writeTestConfigFile(t, "proxy.yaml", "jpeg_quality: 80\n")
+	cfg, _ := LoadConfig(path)
+	holder := newConfigHolder(path, nil, cfg)
+	stop := make(chan struct{})
+	defer close(stop)
+	holder.watchFile(10*time.Millisecond, stop)
+
+	os.WriteFile(path, []byte("jpeg_quality: 70\n"), 0o600)
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for holder.Load().JpegQuality != 70 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if holder.Load().JpegQuality != 70 {
+		t.Errorf("JpegQuality = %d, want 70 after file change", holder.Load().JpegQuality)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	old := defaultConfig()
+	cfg := defaultConfig()
+	cfg.JpegQuality = 50
+	cfg.RequestHeaders.Strip = []string{"Cf-Ray"}
+
+	changes := diffConfig(old, cfg)
+	if len(changes) != 2 {
+		t.Fatalf("diffConfig = %v, want 2 changes", changes)
+	}
+	if changes[0] != `JPEG_QUALITY: "90" -> "50"` {
+		t.Errorf("changes[0] = %q", changes[0])
+	}
+
+	// A changed secret is reported without its value.
+	old.OverrideSecret = "first"
+	cfg = defaultConfig()
+	cfg.OverrideSecret = "second"
+	changes = diffConfig(old, cfg)
+	if len(changes) != 1 || changes[0] != `OVERRIDE_SECRET: "***" -> "***"` {
+		t.Errorf("diffConfig = %q, want the masked secret change", changes)
+	}
+	cfg.OverrideSecret = "first"
+	old.RequestHeaders.Set = http.Header{"Authorization": {"Bearer old"}}
+	cfg.RequestHeaders.Set = http.Header{"Authorization": {"Bearer new"}}
+	changes = diffConfig(old, cfg)
+	if len(changes) != 1 || strings.Contains(changes[0], "Bearer") {
+		t.Errorf("diffConfig = %q, want the masked header change", changes)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Report headers describe what the proxy did to each uploaded file. With
+// several files, every header has one value per file in upload order.
+const (
+	REPORT_ORIGINAL_SIZE_HEADER       = "X-Upload-Proxy-Original-Size"
+	REPORT_SIZE_HEADER                = "X-Upload-Proxy-Size"
+	REPORT_ORIGINAL_DIMENSIONS_HEADER = "X-Upload-Proxy-Original-Dimensions"
+	REPORT_DIMENSIONS_HEADER          = "X-Upload-Proxy-Dimensions"
+	REPORT_ORIGINAL_TYPE_HEADER       = "X-Upload-Proxy-Original-Type"
+	REPORT_TYPE_HEADER                = "X-Upload-Proxy-Type"
+	REPORT_OUTCOME_HEADER             = "X-Upload-Proxy-Outcome"
+	REPORT_SKIP_REASON_HEADER         = "X-Upload-Proxy-Skip-Reason"
+)
+
+var reportHeaders = []string{
+	REPORT_ORIGINAL_SIZE_HEADER,
+	REPORT_SIZE_HEADER,
+	REPORT_ORIGINAL_DIMENSIONS_HEADER,
+	REPORT_DIMENSIONS_HEADER,
+	REPORT_ORIGINAL_TYPE_HEADER,
+	REPORT_TYPE_HEADER,
+	REPORT_OUTCOME_HEADER,
+	REPORT_SKIP_REASON_HEADER,
+}
+
+// addReportHeaders replaces any report headers in h with the ones for
+// uploads, so a client cannot pass its own values on to the upstream.
+func addReportHeaders(h http.Header, uploads []uploadResult) {
+	for _, name := range reportHeaders {
+		h.Del(name)
+	}
+	for _, u := range uploads {
+		skipReason := u.SkipReason
+		if skipReason == "" {
+			skipReason = "none"
+		}
+		h.Add(REPORT_ORIGINAL_SIZE_HEADER, strconv.Itoa(u.OriginalSize))
+		h.Add(REPORT_SIZE_HEADER, strconv.Itoa(u.size()))
+		h.Add(REPORT_ORIGINAL_DIMENSIONS_HEADER, formatDimensions(u.OriginalDimensions))
+		h.Add(REPORT_DIMENSIONS_HEADER, formatDimensions(u.Dimensions))
+		h.Add(REPORT_ORIGINAL_TYPE_HEADER, u.OriginalMimeType)
+		h.Add(REPORT_TYPE_HEADER, u.MimeType)
+		h.Add(REPORT_OUTCOME_HEADER, u.Outcome)
+		h.Add(REPORT_SKIP_REASON_HEADER, skipReason)
+	}
+}
+
+// formatDimensions returns "WIDTHxHEIGHT", or "unknown" for files that could
+// not be read as images.
+func formatDimensions(size ImageSize) string {
+	if size.Width <= 0 || size.Height <= 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dx%d", size.Width, size.Height)
+}
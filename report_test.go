@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAddReportHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set(REPORT_SIZE_HEADER, "spoofed")
+
+	addReportHeaders(h, []uploadResult{
+		{
+			MimeType:           JPEG_MIME_TYPE,
+			Data:               make([]byte, 100),
+			OriginalMimeType:   "image/png",
+			OriginalSize:       400,
+			OriginalDimensions: ImageSize{Width: 4000, Height: 3000},
+			Dimensions:         ImageSize{Width: 1920, Height: 1440},
+			Outcome:            "converted",
+		},
+		{
+			MimeType:         "text/plain",
+			Data:             make([]byte, 5),
+			OriginalMimeType: "text/plain",
+			OriginalSize:     5,
+			Outcome:          "not_image",
+			SkipReason:       SKIP_REASON_PROCESSING_ERROR,
+		},
+	})
+
+	want := map[string][]string{
+		REPORT_ORIGINAL_SIZE_HEADER:       {"400", "5"},
+		REPORT_SIZE_HEADER:                {"100", "5"},
+		REPORT_ORIGINAL_DIMENSIONS_HEADER: {"4000x3000", "unknown"},
+		REPORT_DIMENSIONS_HEADER:          {"1920x1440", "unknown"},
+		REPORT_ORIGINAL_TYPE_HEADER:       {"image/png", "text/plain"},
+		REPORT_TYPE_HEADER:                {"image/jpeg", "text/plain"},
+		REPORT_OUTCOME_HEADER:             {"converted", "not_image"},
+		REPORT_SKIP_REASON_HEADER:         {"none", "processing-error"},
+	}
+	for name, values := range want {
+		if !reflect.DeepEqual(h.Values(name), values) {
+			t.Errorf("%s = %q, want %q", name, h.Values(name), values)
+		}
+	}
+}
+
+func TestProxyHandlerReportHeaders(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	newUpload := func() *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("assetData", "notes.txt")
+		part.Write([]byte("not an image"))
+		writer.Close()
+		req := httptest.NewRequest("POST", "/api/assets", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req
+	}
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL + "/api/assets"
+
+	recorder := httptest.NewRecorder()
+	proxyHandler(recorder, newUpload(), cfg)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+	if upstreamHeader.Get(REPORT_OUTCOME_HEADER) != "" || recorder.Header().Get(REPORT_OUTCOME_HEADER) != "" {
+		t.Error("Report headers should be off by default")
+	}
+
+	cfg.ReportHeaders = true
+	cfg.ReportResponseHeaders = true
+	recorder = httptest.NewRecorder()
+	proxyHandler(recorder, newUpload(), cfg)
+	if got := upstreamHeader.Get(REPORT_OUTCOME_HEADER); got != "not_image" {
+		t.Errorf("upstream %s = %q, want not_image", REPORT_OUTCOME_HEADER, got)
+	}
+	if got := upstreamHeader.Get(REPORT_ORIGINAL_SIZE_HEADER); got != "12" {
+		t.Errorf("upstream %s = %q, want 12", REPORT_ORIGINAL_SIZE_HEADER, got)
+	}
+	if got := recorder.Header().Get(REPORT_SIZE_HEADER); got != "12" {
+		t.Errorf("response %s = %q, want 12", REPORT_SIZE_HEADER, got)
+	}
+}
+
+func TestProxyHandlerReportHeadersWithoutUploads(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL + "/api/assets"
+	cfg.ReportHeaders = true
+
+	// A request without files must not pass spoofed report headers on.
+	req := httptest.NewRequest("POST", "/api/assets", bytes.NewBufferString(`{"name":"album"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(REPORT_OUTCOME_HEADER, "converted")
+	req.Header.Set(REPORT_SIZE_HEADER, "1")
+	recorder := httptest.NewRecorder()
+	proxyHandler(recorder, req, cfg)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+	for _, name := range reportHeaders {
+		if got := upstreamHeader.Values(name); len(got) != 0 {
+			t.Errorf("upstream %s = %q, want it removed", name, got)
+		}
+	}
+}
+
+func TestProxyHandlerReportHeadersDryRun(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL + "/api/assets"
+	cfg.ImgMaxWidth = 200
+	cfg.ImgMaxHeight = 200
+	cfg.DryRun = true
+	cfg.ReportHeaders = true
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("assetData", "photo.png")
+	part.Write(pngData)
+	writer.Close()
+	req := httptest.NewRequest("POST", "/api/assets", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	proxyHandler(recorder, req, cfg)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	// The report describes the original file that was forwarded.
+	want := map[string]string{
+		REPORT_SIZE_HEADER:        strconv.Itoa(len(pngData)),
+		REPORT_DIMENSIONS_HEADER:  "1600x1200",
+		REPORT_OUTCOME_HEADER:     "unchanged",
+		REPORT_SKIP_REASON_HEADER: SKIP_REASON_DRY_RUN,
+	}
+	for name, value := range want {
+		if got := upstreamHeader.Get(name); got != value {
+			t.Errorf("upstream %s = %q, want %q", name, got, value)
+		}
+	}
+	if got := upstreamHeader.Get(REPORT_TYPE_HEADER); got != upstreamHeader.Get(REPORT_ORIGINAL_TYPE_HEADER) {
+		t.Errorf("upstream %s = %q, want the original type", REPORT_TYPE_HEADER, got)
+	}
+	if report := recorder.Header().Get(dryRunHeader); !strings.Contains(report, "dimensions=200x150") {
+		t.Errorf("%s = %q, want what would have happened", dryRunHeader, report)
+	}
+}
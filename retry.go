@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idempotentMethods may be retried after any connection error. Other
+// methods are only retried if the connection was never made, or if they
+// carry an Idempotency-Key.
+var idempotentMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, "PROPFIND", "MOVE", "COPY"}
+
+// sendUpstream sends req with the global client and retries it as
+// RETRY_ATTEMPTS, RETRY_STATUSES and RETRY_DEADLINE allow. The body must be
+// replayable through req.GetBody, which http.NewRequest and newBodyRequest
+// set up for the bodies the proxy sends. Each attempt goes to a target picked by
+// pickTarget. While its circuit breaker is open, errCircuitOpen is returned
+// without sending anything.
+func sendUpstream(cfg *Config, req *http.Request) (*http.Response, error) {
+	deadline := time.Now().Add(cfg.RetryDeadline)
+	backoff := cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		target := pickTarget(cfg, req.URL)
+		out := withTarget(req, target)
+		breaker := breakerFor(out.URL)
+		if err := breaker.allow(cfg, time.Now()); err != nil {
+			circuitRejected.Add(1, breaker.upstream)
+			return nil, err
+		}
+		out, timeoutDone := withTimeout(out, cfg.UpstreamTimeout)
+		done := target.begin()
+		resp, err := client.Do(out)
+		timeoutDone(resp)
+		done(resp)
+		breaker.observe(cfg, req, resp, err, time.Now())
+		target.observe(cfg, req, resp, err, time.Now())
+		reason := retryReason(cfg, req, resp, err)
+		if reason == "" {
+			return resp, err
+		}
+		if attempt > cfg.RetryAttempts {
+			if cfg.RetryAttempts > 0 {
+				log.Printf("Upstream attempt %d failed (%s), giving up", attempt, reason)
+			}
+			return resp, err
+		}
+		wait := jitter(backoff)
+		if cfg.RetryDeadline > 0 && time.Now().Add(wait).After(deadline) {
+			log.Printf("Upstream attempt %d failed (%s), retry deadline reached", attempt, reason)
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+
+		log.Printf("Upstream attempt %d of %d failed (%s), retrying in %s", attempt, cfg.RetryAttempts+1, reason, wait)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		if backoff *= 2; cfg.RetryMaxBackoff > 0 && backoff > cfg.RetryMaxBackoff {
+			backoff = cfg.RetryMaxBackoff
+		}
+	}
+}
+
+// retryReason describes why an attempt should be retried, or returns "".
+func retryReason(cfg *Config, req *http.Request, resp *http.Response, err error) string {
+	if err != nil {
+		if errors.Is(err, req.Context().Err()) && req.Context().Err() != nil {
+			return ""
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return err.Error()
+		}
+		if idempotent(req) {
+			return err.Error()
+		}
+		return ""
+	}
+	// The upstream, or a gateway in front of it, may have acted on the
+	// request before answering with an error, too.
+	if containsStatus(cfg.RetryStatuses, resp.StatusCode) && idempotent(req) {
+		return "status " + strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// idempotent reports whether req may be sent again after the upstream
+// might already have received it.
+func idempotent(req *http.Request) bool {
+	return containsString(idempotentMethods, req.Method) || req.Header.Get("Idempotency-Key") != ""
+}
+
+// jitter returns a random wait between half and all of d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseStatusList parses comma separated HTTP status codes.
+func parseStatusList(v string) ([]int, error) {
+	statuses := []int{}
+	for _, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		status, err := strconv.Atoi(field)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid status code %q", field)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func formatStatusList(statuses []int) string {
+	fields := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		fields = append(fields, strconv.Itoa(status))
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useClient makes sendUpstream use c for the rest of the test and restores
+// the previous client afterwards.
+func useClient(t *testing.T, c *http.Client) {
+	saved := client
+	client = c
+	t.Cleanup(func() { client = saved })
+	resetUpstreamState(t)
+}
+
+// resetUpstreamState drops the circuit breakers and balancer targets a test
+// created once it is done, so the next test starts with closed breakers and
+// healthy targets.
+func resetUpstreamState(t *testing.T) {
+	t.Cleanup(func() {
+		breakersMu.Lock()
+		breakers = map[string]*circuitBreaker{}
+		breakersMu.Unlock()
+		targetsMu.Lock()
+		targets = map[string]*upstreamTarget{}
+		targetsMu.Unlock()
+	})
+}
+
+func retryConfig() *Config {
+	cfg := defaultConfig()
+	cfg.RetryAttempts = 3
+	cfg.RetryBackoff = time.Millisecond
+	cfg.RetryMaxBackoff = 5 * time.Millisecond
+	return cfg
+}
+
+func TestSendUpstreamRetriesStatuses(t *testing.T) {
+	var bodies []string
+	failures := 2
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := retryConfig()
+
+	req, _ := http.NewRequest("PUT", upstream.URL, bytes.NewBufferString("processed"))
+	resp, err := sendUpstream(cfg, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || len(bodies) != 3 {
+		t.Errorf("status %d after %d attempts, want 201 after 3", resp.StatusCode, len(bodies))
+	}
+	for i, body := range bodies {
+		if body != "processed" {
+			t.Errorf("attempt %d sent body %q", i+1, body)
+		}
+	}
+
+	// Once the attempts are used up the last response is returned.
+	bodies, failures = nil, 10
+	req, _ = http.NewRequest("PUT", upstream.URL, bytes.NewBufferString("processed"))
+	resp, err = sendUpstream(cfg, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || len(bodies) != 4 {
+		t.Errorf("status %d after %d attempts, want 503 after 4", resp.StatusCode, len(bodies))
+	}
+
+	// No retry is started that would end after the deadline.
+	bodies = nil
+	cfg.RetryBackoff = time.Second
+	cfg.RetryDeadline = 100 * time.Millisecond
+	req, _ = http.NewRequest("PUT", upstream.URL, bytes.NewBufferString("processed"))
+	resp, _ = sendUpstream(cfg, req)
+	resp.Body.Close()
+	if len(bodies) != 1 {
+		t.Errorf("%d attempts, want 1 within the deadline", len(bodies))
+	}
+
+	// Without an Idempotency-Key, a POST the upstream may have acted on is
+	// not sent again.
+	bodies = nil
+	cfg = retryConfig()
+	req, _ = http.NewRequest("POST", upstream.URL, bytes.NewBufferString("processed"))
+	resp, _ = sendUpstream(cfg, req)
+	resp.Body.Close()
+	if len(bodies) != 1 {
+		t.Errorf("%d attempts, want 1 for a POST", len(bodies))
+	}
+
+	// Statuses that are not listed are not retried.
+	bodies = nil
+	cfg = retryConfig()
+	cfg.RetryStatuses = []int{http.StatusBadGateway}
+	req, _ = http.NewRequest("PUT", upstream.URL, bytes.NewBufferString("processed"))
+	resp, _ = sendUpstream(cfg, req)
+	resp.Body.Close()
+	if len(bodies) != 1 {
+		t.Errorf("%d attempts, want 1 for an unlisted status", len(bodies))
+	}
+}
+
+func TestRetryReason(t *testing.T) {
+	cfg := retryConfig()
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	resetErr := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+
+	post, _ := http.NewRequest("POST", "http://upstream", nil)
+	put, _ := http.NewRequest("PUT", "http://upstream", nil)
+	keyed, _ := http.NewRequest("POST", "http://upstream", nil)
+	keyed.Header.Set("Idempotency-Key", "abc")
+
+	tests := []struct {
+		name  string
+		req   *http.Request
+		resp  *http.Response
+		err   error
+		retry bool
+	}{
+		{"dial error on POST", post, nil, dialErr, true},
+		{"reset on POST", post, nil, resetErr, false},
+		{"reset on PUT", put, nil, resetErr, true},
+		{"reset on POST with Idempotency-Key", keyed, nil, resetErr, true},
+		{"502 on PUT", put, &http.Response{StatusCode: 502}, nil, true},
+		{"502 on POST", post, &http.Response{StatusCode: 502}, nil, false},
+		{"502 on POST with Idempotency-Key", keyed, &http.Response{StatusCode: 502}, nil, true},
+		{"500", put, &http.Response{StatusCode: 500}, nil, false},
+		{"200", put, &http.Response{StatusCode: 200}, nil, false},
+	}
+	for _, tt := range tests {
+		if got := retryReason(cfg, tt.req, tt.resp, tt.err) != ""; got != tt.retry {
+			t.Errorf("%s: retry = %v, want %v", tt.name, got, tt.retry)
+		}
+	}
+}
+
+func TestParseStatusList(t *testing.T) {
+	statuses, err := parseStatusList("502, 503,504")
+	if err != nil || formatStatusList(statuses) != "502,503,504" {
+		t.Errorf("got %v, %v", statuses, err)
+	}
+	if _, err := parseStatusList("502,abc"); err == nil {
+		t.Error("Expected an error for a non-numeric status")
+	}
+	if _, err := parseStatusList("999"); err == nil {
+		t.Error("Expected an error for an out of range status")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PathRewrite replaces every match of Pattern in the request path.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+type pathRewriteConfig struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+func (route *Route) hasPathRules() bool {
+	return route.StripPrefix != "" || route.AddPrefix != "" || len(route.Rewrites) > 0
+}
+
+// rewritePath applies the strip, add and regex rules in that order.
+func (route *Route) rewritePath(path string) string {
+	if route.StripPrefix != "" && hasPathPrefix(path, route.StripPrefix) {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(route.StripPrefix, "/"))
+	}
+	if route.AddPrefix != "" {
+		path = joinURLPath(route.AddPrefix, path)
+	}
+	for _, rw := range route.Rewrites {
+		path = rw.Pattern.ReplaceAllString(path, rw.Replacement)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// upstreamURL builds the URL a request is forwarded to. Without path rules
+// the upstream URL is used as is for the route's own path and any other path
+// is copied onto the upstream host. With path rules the rewritten path is
+// appended to the upstream path. The query string is always kept.
+func (route *Route) upstreamURL(in *url.URL) (*url.URL, error) {
+	target, err := url.Parse(route.ForwardDestination)
+	if err != nil {
+		return nil, err
+	}
+
+	if route.hasPathRules() {
+		target.Path = joinURLPath(target.Path, route.rewritePath(in.Path))
+		target.RawPath = ""
+	} else if in.Path != route.PathPrefix {
+		log.Println("Request hit proxy but not the intended path, proxying to copied path")
+		target.Path = in.Path
+		target.RawPath = in.RawPath
+	}
+
+	target.RawQuery = joinQuery(target.RawQuery, in.RawQuery)
+	return target, nil
+}
+
+func joinURLPath(base, path string) string {
+	if path == "" || path == "/" {
+		if base == "" {
+			return "/"
+		}
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func joinQuery(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "&" + b
+}
+
+func parsePathRewrites(raw []pathRewriteConfig) ([]PathRewrite, error) {
+	rewrites := make([]PathRewrite, 0, len(raw))
+	for _, rc := range raw {
+		re, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path rewrite %q: %w", rc.Match, err)
+		}
+		rewrites = append(rewrites, PathRewrite{Pattern: re, Replacement: rc.Replace})
+	}
+	return rewrites, nil
+}
+
+// parsePathRewriteList parses "regex => replacement; regex => replacement".
+func parsePathRewriteList(v string) ([]PathRewrite, error) {
+	var raw []pathRewriteConfig
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		match, replace, found := strings.Cut(entry, "=>")
+		if !found {
+			return nil, fmt.Errorf("invalid path rewrite %q, expected \"regex => replacement\"", entry)
+		}
+		raw = append(raw, pathRewriteConfig{Match: strings.TrimSpace(match), Replace: strings.TrimSpace(replace)})
+	}
+	return parsePathRewrites(raw)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestRouteUpstreamURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    Route
+		incoming string
+		expected string
+	}{
+		{
+			name:     "Listen path uses destination verbatim and keeps query",
+			route:    Route{PathPrefix: "/api/assets", ForwardDestination: "http://immich:3001/api/assets"},
+			incoming: "/api/assets?key=abc",
+			expected: "http://immich:3001/api/assets?key=abc",
+		},
+		{
+			name:     "Other paths are copied onto the upstream host",
+			route:    Route{PathPrefix: "/api/assets", ForwardDestination: "http://immich:3001/api/assets?token=1"},
+			incoming: "/api/albums/1?key=abc",
+			expected: "http://immich:3001/api/albums/1?token=1&key=abc",
+		},
+		{
+			name:     "Strip prefix for sub-path deployment",
+			route:    Route{PathPrefix: "/upload-proxy/", ForwardDestination: "http://immich:3001", StripPrefix: "/upload-proxy/"},
+			incoming: "/upload-proxy/api/assets?key=abc",
+			expected: "http://immich:3001/api/assets?key=abc",
+		},
+		{
+			name:     "Strip prefix leaving the bare upstream path",
+			route:    Route{PathPrefix: "/upload-proxy", ForwardDestination: "http://immich:3001/api/assets", StripPrefix: "/upload-proxy"},
+			incoming: "/upload-proxy",
+			expected: "http://immich:3001/api/assets",
+		},
+		{
+			name:     "Replace prefix",
+			route:    Route{PathPrefix: "/photos", ForwardDestination: "http://immich:3001", StripPrefix: "/photos", AddPrefix: "/api/assets"},
+			incoming: "/photos/123",
+			expected: "http://immich:3001/api/assets/123",
+		},
+		{
+			name: "Regex rewrite",
+			route: Route{
+				PathPrefix:         "/",
+				ForwardDestination: "http://wiki:8080",
+				Rewrites: []PathRewrite{
+					{Pattern: regexp.MustCompile(`^/files/([^/]+)/upload$`), Replacement: "/api/v2/$1/attachments"},
+				},
+			},
+			incoming: "/files/42/upload",
+			expected: "http://wiki:8080/api/v2/42/attachments",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, _ := url.Parse(tt.incoming)
+			result, err := tt.route.upstreamURL(in)
+			if err != nil {
+				t.Fatalf("upstreamURL returned error: %v", err)
+			}
+			if result.String() != tt.expected {
+				t.Errorf("upstreamURL(%q) = %q, want %q", tt.incoming, result.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsePathRewriteList(t *testing.T) {
+	rewrites, err := parsePathRewriteList(`^/old/(.*)$ => /new/$1; /v1/ => /v2/`)
+	if err != nil {
+		t.Fatalf("parsePathRewriteList returned error: %v", err)
+	}
+	if len(rewrites) != 2 {
+		t.Fatalf("len(rewrites) = %d, want 2", len(rewrites))
+	}
+	if rewrites[0].Replacement != "/new/$1" {
+		t.Errorf("Replacement = %q, want %q", rewrites[0].Replacement, "/new/$1")
+	}
+
+	for _, v := range []string{"no arrow", "([ => /x"} {
+		if _, err := parsePathRewriteList(v); err == nil {
+			t.Errorf("parsePathRewriteList(%q) expected error", v)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProcessingProfile is a named set of image processing rules that routes
+// can refer to.
+type ProcessingProfile struct {
+	ImageProcessingSettings
+	NormalizeExt bool
+	// DryRun runs the pipeline and reports the result but forwards the
+	// original file.
+	DryRun bool
+}
+
+// Route maps incoming requests to an upstream and a processing profile.
+type Route struct {
+	Name               string
+	PathPrefix         string
+	Host               string
+	Methods            []string
+	ForwardDestination string
+	FileUploadFields   []string
+	Profile            string
+	StripPrefix        string
+	AddPrefix          string
+	Rewrites           []PathRewrite
+	// FieldRewrites maps form field names to a value describing the
+	// processed file, see fieldSources.
+	FieldRewrites map[string]string
+	// RawUploads processes request bodies sent with an image Content-Type.
+	// RenamePath updates the file name in the path if processing renamed it.
+	RawUploads bool
+	RenamePath bool
+	// JSONFields locates images embedded in JSON bodies.
+	JSONFields []JSONField
+	// WebDAV processes image PUTs, rewrites Destination headers and reports
+	// original sizes in PROPFIND responses.
+	WebDAV bool
+	// Tus makes the route a tus server. Completed uploads are delivered to
+	// the upstream as TusDelivery says.
+	Tus         bool
+	TusDelivery string
+	// S3 handles path-style S3 requests and signs them with the S3_*
+	// credentials.
+	S3 bool
+}
+
+// routeConfig and profileConfig are the serialized forms used by the ROUTES
+// and PROFILES settings. Profile fields left out inherit the global values.
+type routeConfig struct {
+	Name          string              `json:"name"`
+	Path          string              `json:"path"`
+	Host          string              `json:"host,omitempty"`
+	Methods       []string            `json:"methods,omitempty"`
+	Upstream      string              `json:"upstream"`
+	FileFields    []string            `json:"file_fields"`
+	Profile       string              `json:"profile,omitempty"`
+	StripPrefix   string              `json:"strip_prefix,omitempty"`
+	AddPrefix     string              `json:"add_prefix,omitempty"`
+	Rewrites      []pathRewriteConfig `json:"rewrites,omitempty"`
+	FieldRewrites map[string]string   `json:"field_rewrites,omitempty"`
+	RawUploads    *bool               `json:"raw_uploads,omitempty"`
+	RenamePath    *bool               `json:"rename_path,omitempty"`
+	JSONFields    []jsonFieldConfig   `json:"json_fields,omitempty"`
+	WebDAV        *bool               `json:"webdav,omitempty"`
+	Tus           *bool               `json:"tus,omitempty"`
+	TusDelivery   string              `json:"tus_delivery,omitempty"`
+	S3            *bool               `json:"s3,omitempty"`
+}
+
+type profileConfig struct {
+	MaxWidth        *int    `json:"max_width"`
+	MaxHeight       *int    `json:"max_height"`
+	MaxNarrowSide   *int    `json:"max_narrow_side"`
+	JpegQuality     *int    `json:"jpeg_quality"`
+	WebpQuality     *int    `json:"webp_quality"`
+	ConvertToFormat *string `json:"convert_to_format"`
+	NormalizeExt    *bool   `json:"normalize_extensions"`
+	DryRun          *bool   `json:"dry_run"`
+}
+
+// defaultProfile is built from the global image settings and is used by
+// routes without a profile.
+func (cfg *Config) defaultProfile() ProcessingProfile {
+	return ProcessingProfile{
+		ImageProcessingSettings: ImageProcessingSettings{
+			MaxWidth:        cfg.ImgMaxWidth,
+			MaxHeight:       cfg.ImgMaxHeight,
+			MaxNarrowSide:   cfg.ImgMaxNarrowSide,
+			JpegQuality:     cfg.JpegQuality,
+			WebpQuality:     cfg.WebpQuality,
+			ConvertToFormat: cfg.ConvertToFormat,
+		},
+		NormalizeExt: cfg.NormalizeExt,
+		DryRun:       cfg.DryRun,
+	}
+}
+
+// defaultRoute reproduces the single-route behaviour of LISTEN_PATH,
+// FORWARD_DESTINATION, FILE_UPLOAD_FIELD and the global path rules. It also
+// receives every request that no configured route matches.
+func (cfg *Config) defaultRoute() *Route {
+	return &Route{
+		Name:               "default",
+		PathPrefix:         cfg.ListenPath,
+		ForwardDestination: cfg.ForwardDestination,
+		FileUploadFields:   []string{cfg.FileUploadField},
+		StripPrefix:        cfg.StripPathPrefix,
+		AddPrefix:          cfg.AddPathPrefix,
+		Rewrites:           cfg.PathRewrites,
+		FieldRewrites:      cfg.FieldRewrites,
+		RawUploads:         cfg.RawUploads,
+		RenamePath:         cfg.RawRenamePath,
+		JSONFields:         cfg.JSONFields,
+		WebDAV:             cfg.WebDAV,
+		Tus:                cfg.Tus,
+		TusDelivery:        cfg.TusDelivery,
+		S3:                 cfg.S3,
+	}
+}
+
+func (cfg *Config) profileFor(route *Route) ProcessingProfile {
+	if profile, ok := cfg.Profiles[route.Profile]; ok {
+		return profile
+	}
+	return cfg.defaultProfile()
+}
+
+// matchRoute returns the route with the longest matching path prefix whose
+// host and method constraints are satisfied.
+func (cfg *Config) matchRoute(r *http.Request) *Route {
+	var best *Route
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if !route.matches(r) {
+			continue
+		}
+		if best == nil || len(route.PathPrefix) > len(best.PathPrefix) {
+			best = route
+		}
+	}
+	if best == nil {
+		return cfg.defaultRoute()
+	}
+	return best
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if route.Host != "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !strings.EqualFold(host, route.Host) {
+			return false
+		}
+	}
+
+	if len(route.Methods) > 0 {
+		methodAllowed := false
+		for _, m := range route.Methods {
+			if strings.EqualFold(m, r.Method) {
+				methodAllowed = true
+				break
+			}
+		}
+		if !methodAllowed {
+			return false
+		}
+	}
+
+	return hasPathPrefix(r.URL.Path, route.PathPrefix)
+}
+
+// hasPathPrefix matches whole path segments, so "/api" matches "/api" and
+// "/api/assets" but not "/apix".
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func parseProfiles(v string, base ProcessingProfile) (map[string]ProcessingProfile, error) {
+	var raw map[string]profileConfig
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]ProcessingProfile, len(raw))
+	for name, pc := range raw {
+		profile, err := pc.apply(base)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+func (pc profileConfig) apply(profile ProcessingProfile) (ProcessingProfile, error) {
+	if pc.MaxWidth != nil {
+		if *pc.MaxWidth <= 0 {
+			return profile, fmt.Errorf("max_width must be positive, got %d", *pc.MaxWidth)
+		}
+		profile.MaxWidth = *pc.MaxWidth
+	}
+	if pc.MaxHeight != nil {
+		if *pc.MaxHeight <= 0 {
+			return profile, fmt.Errorf("max_height must be positive, got %d", *pc.MaxHeight)
+		}
+		profile.MaxHeight = *pc.MaxHeight
+	}
+	if pc.MaxNarrowSide != nil {
+		if *pc.MaxNarrowSide < 0 {
+			return profile, fmt.Errorf("max_narrow_side must not be negative, got %d", *pc.MaxNarrowSide)
+		}
+		profile.MaxNarrowSide = *pc.MaxNarrowSide
+	}
+	if pc.JpegQuality != nil {
+		if *pc.JpegQuality < 1 || *pc.JpegQuality > 100 {
+			return profile, fmt.Errorf("jpeg_quality must be between 1 and 100, got %d", *pc.JpegQuality)
+		}
+		profile.JpegQuality = *pc.JpegQuality
+	}
+	if pc.WebpQuality != nil {
+		if *pc.WebpQuality < 1 || *pc.WebpQuality > 100 {
+			return profile, fmt.Errorf("webp_quality must be between 1 and 100, got %d", *pc.WebpQuality)
+		}
+		profile.WebpQuality = *pc.WebpQuality
+	}
+	if pc.ConvertToFormat != nil {
+		format, ok := normalizeConvertFormat(*pc.ConvertToFormat)
+		if !ok {
+			return profile, fmt.Errorf("invalid convert_to_format %q", *pc.ConvertToFormat)
+		}
+		profile.ConvertToFormat = format
+	}
+	if pc.NormalizeExt != nil {
+		profile.NormalizeExt = *pc.NormalizeExt
+	}
+	if pc.DryRun != nil {
+		profile.DryRun = *pc.DryRun
+	}
+	return profile, nil
+}
+
+// parseRoutes decodes the ROUTES setting. Routes without an upstream or file
+// fields fall back to FORWARD_DESTINATION and FILE_UPLOAD_FIELD.
+func parseRoutes(v string, cfg *Config) ([]Route, error) {
+	var raw []routeConfig
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, err
+	}
+
+	routes := make([]Route, 0, len(raw))
+	for i, rc := range raw {
+		route := Route{
+			Name:               rc.Name,
+			PathPrefix:         rc.Path,
+			Host:               rc.Host,
+			Methods:            rc.Methods,
+			ForwardDestination: rc.Upstream,
+			FileUploadFields:   rc.FileFields,
+			Profile:            rc.Profile,
+			StripPrefix:        rc.StripPrefix,
+			AddPrefix:          rc.AddPrefix,
+			FieldRewrites:      rc.FieldRewrites,
+			RawUploads:         cfg.RawUploads,
+			RenamePath:         cfg.RawRenamePath,
+			JSONFields:         cfg.JSONFields,
+			WebDAV:             cfg.WebDAV,
+			Tus:                cfg.Tus,
+			TusDelivery:        cfg.TusDelivery,
+			S3:                 cfg.S3,
+		}
+		if rc.WebDAV != nil {
+			route.WebDAV = *rc.WebDAV
+		}
+		if rc.S3 != nil {
+			route.S3 = *rc.S3
+		}
+		if rc.Tus != nil {
+			route.Tus = *rc.Tus
+		}
+		if rc.TusDelivery != "" {
+			delivery, err := parseTusDelivery(rc.TusDelivery)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.TusDelivery = delivery
+		}
+		if rc.RawUploads != nil {
+			route.RawUploads = *rc.RawUploads
+		}
+		if rc.RenamePath != nil {
+			route.RenamePath = *rc.RenamePath
+		}
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i+1)
+		}
+		if route.PathPrefix == "" {
+			route.PathPrefix = "/"
+		}
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return nil, fmt.Errorf("route %q: path must start with /, got %q", route.Name, route.PathPrefix)
+		}
+		if route.ForwardDestination == "" {
+			route.ForwardDestination = cfg.ForwardDestination
+		} else if err := validateUpstreamURL(route.ForwardDestination); err != nil {
+			return nil, fmt.Errorf("route %q: upstream %q: %w", route.Name, route.ForwardDestination, err)
+		}
+		if len(route.FileUploadFields) == 0 {
+			route.FileUploadFields = []string{cfg.FileUploadField}
+		}
+		if route.Profile != "" {
+			if _, ok := cfg.Profiles[route.Profile]; !ok {
+				return nil, fmt.Errorf("route %q: unknown profile %q", route.Name, route.Profile)
+			}
+		}
+		if err := validateFieldRewrites(route.FieldRewrites); err != nil {
+			return nil, fmt.Errorf("route %q: %w", route.Name, err)
+		}
+		if rc.JSONFields != nil {
+			jsonFields, err := parseJSONFields(rc.JSONFields)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.JSONFields = jsonFields
+		}
+		rewrites, err := parsePathRewrites(rc.Rewrites)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", route.Name, err)
+		}
+		route.Rewrites = rewrites
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// formatProfiles and formatRoutes serialize back into the PROFILES and ROUTES
+// format, so the effective values can be logged and compared.
+func formatProfiles(profiles map[string]ProcessingProfile) string {
+	if len(profiles) == 0 {
+		return ""
+	}
+	raw := make(map[string]profileConfig, len(profiles))
+	for name, p := range profiles {
+		p := p
+		raw[name] = profileConfig{
+			MaxWidth:        &p.MaxWidth,
+			MaxHeight:       &p.MaxHeight,
+			MaxNarrowSide:   &p.MaxNarrowSide,
+			JpegQuality:     &p.JpegQuality,
+			WebpQuality:     &p.WebpQuality,
+			ConvertToFormat: &p.ConvertToFormat,
+			NormalizeExt:    &p.NormalizeExt,
+			DryRun:          &p.DryRun,
+		}
+	}
+	b, _ := json.Marshal(raw)
+	return string(b)
+}
+
+func formatRoutes(routes []Route) string {
+	if len(routes) == 0 {
+		return ""
+	}
+	raw := make([]routeConfig, 0, len(routes))
+	for _, route := range routes {
+		rc := routeConfig{
+			Name:          route.Name,
+			Path:          route.PathPrefix,
+			Host:          route.Host,
+			Methods:       route.Methods,
+			Upstream:      route.ForwardDestination,
+			FileFields:    route.FileUploadFields,
+			Profile:       route.Profile,
+			StripPrefix:   route.StripPrefix,
+			AddPrefix:     route.AddPrefix,
+			FieldRewrites: route.FieldRewrites,
+			RawUploads:    &route.RawUploads,
+			RenamePath:    &route.RenamePath,
+			JSONFields:    formatJSONFields(route.JSONFields),
+			WebDAV:        &route.WebDAV,
+			Tus:           &route.Tus,
+			TusDelivery:   route.TusDelivery,
+			S3:            &route.S3,
+		}
+		for _, rw := range route.Rewrites {
+			rc.Rewrites = append(rc.Rewrites, pathRewriteConfig{Match: rw.Pattern.String(), Replace: rw.Replacement})
+		}
+		raw = append(raw, rc)
+	}
+	b, _ := json.Marshal(raw)
+	return string(b)
+}
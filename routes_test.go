@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testRoutesConfig(t *testing.T) *Config {
+	cfg := &Config{
+		ImgMaxWidth:        1920,
+		ImgMaxHeight:       1080,
+		JpegQuality:        90,
+		WebpQuality:        90,
+		NormalizeExt:       true,
+		ForwardDestination: "http://default.example.com/upload",
+		FileUploadField:    "assetData",
+		ListenPath:         "/api/assets",
+	}
+
+	profiles, err := parseProfiles(`{
+		"phone": {"max_width": 1280, "max_height": 720, "convert_to_format": "jpg"},
+		"originals": {"max_width": 100000, "max_height": 100000, "normalize_extensions": false}
+	}`, cfg.defaultProfile())
+	if err != nil {
+		t.Fatalf("parseProfiles failed: %v", err)
+	}
+	cfg.Profiles = profiles
+
+	routes, err := parseRoutes(`[
+		{"name": "immich", "path": "/api/assets", "upstream": "http://immich:3001/api/assets", "profile": "phone"},
+		{"name": "wiki", "path": "/wiki", "host": "wiki.example.com", "upstream": "http://wiki:8080", "file_fields": ["upload", "attachment"], "profile": "originals"},
+		{"name": "chat-put", "path": "/chat", "methods": ["PUT"], "upstream": "http://chat:3000"},
+		{"name": "chat-files", "path": "/chat/files", "upstream": "http://chat-files:3000"}
+	]`, cfg)
+	if err != nil {
+		t.Fatalf("parseRoutes failed: %v", err)
+	}
+	cfg.Routes = routes
+	return cfg
+}
+
+func TestMatchRoute(t *testing.T) {
+	cfg := testRoutesConfig(t)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		expected string
+	}{
+		{"Exact path", "POST", "http://proxy/api/assets", "immich"},
+		{"Sub path", "POST", "http://proxy/api/assets/123/thumbnail", "immich"},
+		{"Prefix must match whole segment", "POST", "http://proxy/api/assetsx", "default"},
+		{"Host constraint satisfied", "POST", "http://wiki.example.com:8443/wiki/upload", "wiki"},
+		{"Host constraint not satisfied", "POST", "http://other.example.com/wiki/upload", "default"},
+		{"Method constraint satisfied", "PUT", "http://proxy/chat/rooms", "chat-put"},
+		{"Method constraint not satisfied", "POST", "http://proxy/chat/rooms", "default"},
+		{"Longest prefix wins", "PUT", "http://proxy/chat/files/1", "chat-files"},
+		{"No route matches", "GET", "http://proxy/", "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			route := cfg.matchRoute(req)
+			if route.Name != tt.expected {
+				t.Errorf("matchRoute(%s %s) = %q, want %q", tt.method, tt.target, route.Name, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseRoutesDefaults(t *testing.T) {
+	cfg := testRoutesConfig(t)
+
+	chat := cfg.Routes[2]
+	if len(chat.FileUploadFields) != 1 || chat.FileUploadFields[0] != "assetData" {
+		t.Errorf("FileUploadFields = %v, want [assetData]", chat.FileUploadFields)
+	}
+
+	routes, err := parseRoutes(`[{"path": "/x"}]`, cfg)
+	if err != nil {
+		t.Fatalf("parseRoutes failed: %v", err)
+	}
+	if routes[0].ForwardDestination != cfg.ForwardDestination {
+		t.Errorf("ForwardDestination = %q, want %q", routes[0].ForwardDestination, cfg.ForwardDestination)
+	}
+	if routes[0].Name != "route-1" {
+		t.Errorf("Name = %q, want %q", routes[0].Name, "route-1")
+	}
+
+	invalid := []string{
+		`[{"path": "/x", "profile": "missing"}]`,
+		`[{"path": "relative"}]`,
+		`{"path": "/x"}`,
+	}
+	for _, v := range invalid {
+		if _, err := parseRoutes(v, cfg); err == nil {
+			t.Errorf("parseRoutes(%s) expected error", v)
+		}
+	}
+}
+
+func TestParseProfiles(t *testing.T) {
+	cfg := testRoutesConfig(t)
+
+	phone := cfg.Profiles["phone"]
+	if phone.MaxWidth != 1280 || phone.MaxHeight != 720 {
+		t.Errorf("phone dimensions = %dx%d, want 1280x720", phone.MaxWidth, phone.MaxHeight)
+	}
+	if phone.ConvertToFormat != "JPEG" {
+		t.Errorf("phone ConvertToFormat = %q, want %q", phone.ConvertToFormat, "JPEG")
+	}
+	if phone.JpegQuality != 90 || !phone.NormalizeExt {
+		t.Errorf("phone should inherit JpegQuality and NormalizeExt, got %d and %t", phone.JpegQuality, phone.NormalizeExt)
+	}
+
+	if cfg.profileFor(&cfg.Routes[1]).NormalizeExt {
+		t.Error("wiki route should use the originals profile with NormalizeExt disabled")
+	}
+	if cfg.profileFor(cfg.defaultRoute()).MaxWidth != 1920 {
+		t.Error("default route should use the global settings")
+	}
+
+	invalid := []string{
+		`{"bad": {"jpeg_quality": 0}}`,
+		`{"bad": {"max_width": -1}}`,
+		`{"bad": {"convert_to_format": "PNG"}}`,
+	}
+	for _, v := range invalid {
+		if _, err := parseProfiles(v, cfg.defaultProfile()); err == nil {
+			t.Errorf("parseProfiles(%s) expected error", v)
+		}
+	}
+}
+
+func TestReformatMultipartRouteFileFields(t *testing.T) {
+	cfg := testRoutesConfig(t)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("title", "Notes")
+	for _, field := range []string{"upload", "attachment", "ignored"} {
+		part, _ := writer.CreateFormFile(field, field+".txt")
+		part.Write([]byte("not an image"))
+	}
+	writer.Close()
+	payload := body.String()
+
+	req := httptest.NewRequest("POST", "http://wiki.example.com/wiki/upload", strings.NewReader(payload))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	contentType, rebuilt, _, err := reformatMultipart(httptest.NewRecorder(), req, cfg, cfg.matchRoute(req))
+	if err != nil {
+		t.Fatalf("reformatMultipart failed: %v", err)
+	}
+	resultBody := readRequestBody(t, rebuilt)
+
+	result := httptest.NewRequest("POST", "/", resultBody)
+	result.Header.Set("Content-Type", contentType)
+	if err := result.ParseMultipartForm(32 << 20); err != nil {
+		t.Fatalf("Failed to parse result: %v", err)
+	}
+
+	for _, field := range []string{"upload", "attachment"} {
+		if len(result.MultipartForm.File[field]) != 1 {
+			t.Errorf("Expected file field %q to be forwarded", field)
+		}
+	}
+	if _, ok := result.MultipartForm.File["ignored"]; ok {
+		t.Error("File field not listed on the route should not be forwarded")
+	}
+	if result.FormValue("title") != "Notes" {
+		t.Errorf("title = %q, want %q", result.FormValue("title"), "Notes")
+	}
+
+	missing := httptest.NewRequest("POST", "http://proxy/chat/files", strings.NewReader(payload))
+	missing.Header.Set("Content-Type", writer.FormDataContentType())
+	if _, _, _, err := reformatMultipart(httptest.NewRecorder(), missing, cfg, cfg.matchRoute(missing)); err == nil {
+		t.Error("Expected error when none of the route's file fields are present")
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3UploadIDPrefix marks multipart uploads the proxy assembles itself. All
+// other upload IDs come from the upstream and are passed through.
+const s3UploadIDPrefix = "upload-proxy-"
+
+// s3MultipartHeaders are the headers of CreateMultipartUpload that are kept
+// for the final PutObject, besides X-Amz-Meta-*, ACL and storage headers.
+var s3MultipartHeaders = []string{"Content-Type", "Cache-Control", "Content-Disposition", "Content-Language", "Expires"}
+
+// isS3Request reports whether a request belongs to a route in S3 mode.
+func isS3Request(r *http.Request, route *Route) bool {
+	return route.S3 && hasPathPrefix(r.URL.Path, route.PathPrefix)
+}
+
+// errS3Credentials is reported when S3 mode is on without credentials. An
+// empty secret would let anyone sign requests.
+var errS3Credentials = errors.New("S3 mode requires " + S3_ACCESS_KEY_ID + " and " + S3_SECRET_ACCESS_KEY)
+
+// usesS3 reports whether S3 mode is on globally or for any route.
+func (cfg *Config) usesS3() bool {
+	if cfg.S3 {
+		return true
+	}
+	for _, route := range cfg.Routes {
+		if route.S3 {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Config) s3Credentials() s3Credentials {
+	return s3Credentials{AccessKeyID: cfg.S3AccessKeyID, SecretAccessKey: cfg.S3SecretAccessKey, Region: cfg.S3Region}
+}
+
+// s3Handler serves path-style S3 requests. PutObject bodies with an image
+// are processed. Multipart uploads of images are assembled locally and sent
+// to the upstream as one PutObject when they complete. Everything else is
+// streamed through. Every upstream request is signed again with our
+// credentials, since the client's signature covers our host and the
+// original body.
+func s3Handler(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route) {
+	if cfg.S3AccessKeyID == "" || cfg.S3SecretAccessKey == "" {
+		log.Println("Rejected S3 request:", errS3Credentials)
+		s3Error(w, http.StatusInternalServerError, "InternalError", errS3Credentials.Error())
+		return
+	}
+	if cfg.S3VerifySignature {
+		if err := verifySigV4(r, cfg.s3Credentials(), time.Now()); err != nil {
+			log.Println("Rejected S3 request:", err)
+			s3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+			return
+		}
+	}
+	profile, err := cfg.requestProfile(r, route)
+	if err != nil {
+		s3Error(w, requestErrorStatus(err), "AccessDenied", err.Error())
+		return
+	}
+
+	header := r.Header.Clone()
+	payload := s3Payload{Reader: r.Body, Length: r.ContentLength, Hash: header.Get("X-Amz-Content-Sha256")}
+	if isAWSChunked(header) {
+		payload.Reader = newAWSChunkedReader(r.Body)
+		payload.Length, err = strconv.ParseInt(header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			payload.Length = -1
+		}
+		payload.Hash = ""
+		dropAWSChunkedHeaders(header)
+	}
+
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	local := strings.HasPrefix(uploadID, s3UploadIDPrefix)
+	createsLocal := r.Method == http.MethodPost && query.Has("uploads") && isImageContentType(header.Get("Content-Type"))
+	putObject := r.Method == http.MethodPut && uploadID == "" && header.Get("X-Amz-Copy-Source") == ""
+	// Requests that are not processed are streamed to the upstream, so
+	// objects of any size pass without being held in memory.
+	if !local && !createsLocal && !(putObject && payload.isImage(header)) {
+		target, err := route.upstreamURL(r.URL)
+		if err != nil {
+			s3Error(w, http.StatusBadGateway, "InternalError", err.Error())
+			return
+		}
+		resp, err := s3SendPayload(cfg, r.Method, target, header, payload, nil)
+		s3Respond(w, cfg, resp, err, nil)
+		return
+	}
+
+	if cfg.BodyMaxSize > 0 && payload.Length > cfg.BodyMaxSize {
+		s3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "request body too large")
+		return
+	}
+	if cfg.BodyMaxSize > 0 {
+		payload.Reader = io.LimitReader(payload.Reader, cfg.BodyMaxSize+1)
+	}
+	body, err := io.ReadAll(payload.Reader)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if cfg.BodyMaxSize > 0 && int64(len(body)) > cfg.BodyMaxSize {
+		s3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "request body too large")
+		return
+	}
+	if len(payload.Hash) == 64 && payload.Hash != hexSHA256(body) {
+		s3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the payload does not match X-Amz-Content-Sha256")
+		return
+	}
+
+	switch {
+	case local && !isUploadID(strings.TrimPrefix(uploadID, s3UploadIDPrefix)):
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "unknown upload ID")
+	case local && r.Method == http.MethodPut:
+		s3UploadPart(w, cfg, uploadID, query.Get("partNumber"), body)
+	case local && r.Method == http.MethodPost:
+		s3CompleteMultipartUpload(w, r, cfg, route, profile, uploadID, body)
+	case local && r.Method == http.MethodDelete:
+		s3AbortMultipartUpload(w, cfg, uploadID)
+	case local:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", "listing parts of uploads assembled by the proxy is not supported")
+	case createsLocal:
+		s3CreateMultipartUpload(w, r, cfg, route, header)
+	default:
+		s3PutObject(w, r, cfg, route, profile, header, body)
+	}
+}
+
+// s3Payload is the body of a client request, decoded if it was sent
+// aws-chunked. Length is -1 if unknown. Hash is the client's
+// X-Amz-Content-Sha256 for it, or "" if the client did not send one for the
+// decoded body.
+type s3Payload struct {
+	io.Reader
+	Length int64
+	Hash   string
+}
+
+// isImage reports whether a PutObject carries an image. Without a specific
+// Content-Type, the first bytes are sniffed; they stay in the reader.
+func (p *s3Payload) isImage(header http.Header) bool {
+	mimeType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mimeType != "" && mimeType != DEFAULT_MIME_TYPE {
+		return strings.HasPrefix(mimeType, "image/")
+	}
+	buffered := bufio.NewReaderSize(p.Reader, 512)
+	p.Reader = buffered
+	head, _ := buffered.Peek(512)
+	return strings.HasPrefix(http.DetectContentType(head), "image/")
+}
+
+func s3PutObject(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route, profile ProcessingProfile, header http.Header, body []byte) {
+	target, err := route.upstreamURL(r.URL)
+	if err != nil {
+		s3Error(w, http.StatusBadGateway, "InternalError", err.Error())
+		return
+	}
+
+	mimeType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mimeType == "" || mimeType == DEFAULT_MIME_TYPE {
+		mimeType = http.DetectContentType(body)
+	}
+	upload := processS3Object(w, s3ObjectName(r.URL.Path), mimeType, profile, body)
+	if !bytes.Equal(upload.Data, body) {
+		setS3Body(header, upload)
+	}
+	s3Forward(w, cfg, r.Method, target, header, upload.Data, []uploadResult{upload})
+}
+
+// processS3Object runs an object through the pipeline. Objects keep their
+// key, so only the content and its type can change.
+func processS3Object(w http.ResponseWriter, name, mimeType string, profile ProcessingProfile, data []byte) uploadResult {
+	log.Printf("Incoming S3 object: %s (%s)", name, mimeType)
+	upload := processUpload(data, name, mimeType, profile)
+	recordUpload(upload, profile.DryRun)
+	if profile.DryRun {
+		return applyDryRun(w, "object", upload, data, name, mimeType)
+	}
+	return upload
+}
+
+// setS3Body updates the headers describing a body that processing changed.
+// Client checksums no longer match, so they are recomputed or dropped.
+func setS3Body(header http.Header, upload uploadResult) {
+	header.Set("Content-Type", upload.MimeType)
+	if header.Get("Content-Md5") != "" {
+		sum := md5.Sum(upload.Data)
+		header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	for name := range header {
+		if strings.HasPrefix(name, "X-Amz-Checksum-") || name == "X-Amz-Sdk-Checksum-Algorithm" {
+			header.Del(name)
+		}
+	}
+}
+
+func dropAWSChunkedHeaders(header http.Header) {
+	var encodings []string
+	for _, encoding := range strings.Split(header.Get("Content-Encoding"), ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		header.Del("Content-Encoding")
+	} else {
+		header.Set("Content-Encoding", strings.Join(encodings, ","))
+	}
+	header.Del("X-Amz-Decoded-Content-Length")
+	header.Del("X-Amz-Trailer")
+	// The trailer carried the checksum, which the header would announce.
+	header.Del("X-Amz-Sdk-Checksum-Algorithm")
+}
+
+// s3Forward signs and sends one request to the upstream and copies the
+// response back.
+func s3Forward(w http.ResponseWriter, cfg *Config, method string, target *url.URL, header http.Header, body []byte, uploads []uploadResult) {
+	resp, err := s3Send(cfg, method, target, header, body, uploads)
+	s3Respond(w, cfg, resp, err, uploads)
+}
+
+// s3Respond copies an upstream response back to the client.
+func s3Respond(w http.ResponseWriter, cfg *Config, resp *http.Response, err error, uploads []uploadResult) {
+	if err != nil {
+		log.Println("S3 upstream error:", err)
+		s3Error(w, http.StatusBadGateway, "InternalError", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	cfg.ResponseHeaders.Apply(w.Header(), resp.Header)
+	if cfg.ReportResponseHeaders && uploads != nil {
+		addReportHeaders(w.Header(), uploads)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func s3Send(cfg *Config, method string, target *url.URL, header http.Header, body []byte, uploads []uploadResult) (*http.Response, error) {
+	return s3SendPayload(cfg, method, target, header, s3Payload{Reader: bytes.NewReader(body), Length: int64(len(body)), Hash: hexSHA256(body)}, uploads)
+}
+
+// s3SendPayload signs and sends a request. Bodies that are not in memory
+// are streamed and signed with the client's payload hash, which the
+// upstream checks, or as UNSIGNED-PAYLOAD.
+func s3SendPayload(cfg *Config, method string, target *url.URL, header http.Header, payload s3Payload, uploads []uploadResult) (*http.Response, error) {
+	var body io.Reader = payload.Reader
+	if payload.Length == 0 {
+		body = nil
+	}
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = payload.Length
+	}
+	cfg.RequestHeaders.Apply(req.Header, header)
+	// A client session token belongs to the client's credentials, not ours.
+	req.Header.Del("X-Amz-Security-Token")
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if cfg.ReportHeaders {
+		addReportHeaders(req.Header, uploads)
+	}
+	payloadHash := payload.Hash
+	if _, err := hex.DecodeString(payloadHash); err != nil || len(payloadHash) != 64 {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	signSigV4(req, cfg.s3Credentials(), payloadHash, time.Now())
+	return sendUpstream(cfg, req)
+}
+
+// s3Multipart is what CreateMultipartUpload asked for, kept until the
+// upload completes.
+type s3Multipart struct {
+	Path    string      `json:"path"`
+	Header  http.Header `json:"header"`
+	Created time.Time   `json:"created"`
+}
+
+// s3MaxObjectSize is the largest object a local multipart upload may
+// assemble, or 0 for no limit.
+func s3MaxObjectSize(cfg *Config) int64 {
+	limit := cfg.UploadMaxSize
+	if cfg.UploadMaxFileSize > 0 && (limit <= 0 || cfg.UploadMaxFileSize < limit) {
+		limit = cfg.UploadMaxFileSize
+	}
+	return limit
+}
+
+// readS3Multipart returns a local multipart upload. Uploads older than
+// S3_EXPIRY are removed and reported as missing.
+func readS3Multipart(cfg *Config, uploadID string) (s3Multipart, string, bool) {
+	dir := filepath.Join(cfg.S3Dir, uploadID)
+	var upload s3Multipart
+	info, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil || json.Unmarshal(info, &upload) != nil {
+		return upload, dir, false
+	}
+	if cfg.S3Expiry > 0 && time.Since(upload.Created) >= cfg.S3Expiry {
+		os.RemoveAll(dir)
+		log.Printf("Expired S3 multipart upload %s", uploadID)
+		return upload, dir, false
+	}
+	return upload, dir, true
+}
+
+// expireS3Uploads removes local multipart uploads older than S3_EXPIRY. It
+// runs whenever a new one is created.
+func expireS3Uploads(cfg *Config) {
+	if cfg.S3Expiry <= 0 {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(cfg.S3Dir, s3UploadIDPrefix+"*"))
+	for _, dir := range dirs {
+		readS3Multipart(cfg, filepath.Base(dir))
+	}
+}
+
+func s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route, header http.Header) {
+	kept := http.Header{}
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if containsHeader(s3MultipartHeaders, name) || strings.HasPrefix(lower, "x-amz-meta-") ||
+			strings.HasPrefix(lower, "x-amz-grant-") || lower == "x-amz-acl" || lower == "x-amz-storage-class" ||
+			lower == "x-amz-tagging" || strings.HasPrefix(lower, "x-amz-server-side-encryption") {
+			kept[name] = values
+		}
+	}
+
+	expireS3Uploads(cfg)
+	uploadID := s3UploadIDPrefix + newUploadID()
+	dir := filepath.Join(cfg.S3Dir, uploadID)
+	info, _ := json.Marshal(s3Multipart{Path: r.URL.Path, Header: kept, Created: time.Now()})
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", "cannot store upload")
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, "upload.json"), info, 0600); err != nil {
+		os.RemoveAll(dir)
+		s3Error(w, http.StatusInternalServerError, "InternalError", "cannot store upload")
+		return
+	}
+	log.Printf("Assembling S3 multipart upload %s for %s", uploadID, r.URL.Path)
+
+	bucket, key := s3BucketAndKey(r.URL.Path, route)
+	s3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: uploadID})
+}
+
+func s3UploadPart(w http.ResponseWriter, cfg *Config, uploadID, partNumber string, body []byte) {
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > 10000 {
+		s3Error(w, http.StatusBadRequest, "InvalidArgument", "partNumber must be between 1 and 10000")
+		return
+	}
+	_, dir, ok := readS3Multipart(cfg, uploadID)
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "unknown upload ID")
+		return
+	}
+	// Parts that would make the object too large are rejected right away,
+	// so that abandoned uploads cannot fill S3_DIR beyond the limit.
+	if limit := s3MaxObjectSize(cfg); limit > 0 {
+		total := int64(len(body))
+		parts, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+		for _, part := range parts {
+			if info, err := os.Stat(part); err == nil && filepath.Base(part) != strconv.Itoa(n)+".part" {
+				total += info.Size()
+			}
+		}
+		if total > limit {
+			s3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "the assembled object would exceed the upload size limit")
+			return
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, strconv.Itoa(n)+".part"), body, 0600); err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", "cannot store part")
+		return
+	}
+	w.Header().Set("ETag", s3ETag(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route, profile ProcessingProfile, uploadID string, body []byte) {
+	upload, dir, ok := readS3Multipart(cfg, uploadID)
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "unknown upload ID")
+		return
+	}
+
+	var complete struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+		s3Error(w, http.StatusBadRequest, "MalformedXML", "invalid CompleteMultipartUpload body")
+		return
+	}
+	var data []byte
+	limit := s3MaxObjectSize(cfg)
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			s3Error(w, http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+			return
+		}
+		path := filepath.Join(dir, strconv.Itoa(part.PartNumber)+".part")
+		if info, err := os.Stat(path); err == nil && limit > 0 && int64(len(data))+info.Size() > limit {
+			s3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "the assembled object would exceed the upload size limit")
+			return
+		}
+		chunk, err := os.ReadFile(path)
+		if err != nil || strings.Trim(part.ETag, `"`) != strings.Trim(s3ETag(chunk), `"`) {
+			s3Error(w, http.StatusBadRequest, "InvalidPart", "part "+strconv.Itoa(part.PartNumber)+" is missing or has another ETag")
+			return
+		}
+		data = append(data, chunk...)
+	}
+
+	header := upload.Header
+	mimeType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	result := processS3Object(w, s3ObjectName(upload.Path), mimeType, profile, data)
+	if !bytes.Equal(result.Data, data) {
+		header.Set("Content-Type", result.MimeType)
+	}
+
+	target, err := route.upstreamURL(&url.URL{Path: upload.Path})
+	if err != nil {
+		s3Error(w, http.StatusBadGateway, "InternalError", err.Error())
+		return
+	}
+	resp, err := s3Send(cfg, http.MethodPut, target, header, result.Data, []uploadResult{result})
+	if err != nil {
+		log.Println("S3 upstream error:", err)
+		s3Error(w, http.StatusBadGateway, "InternalError", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// The parts are kept so the client can complete the upload again.
+		cfg.ResponseHeaders.Apply(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	os.RemoveAll(dir)
+
+	if cfg.ReportResponseHeaders {
+		addReportHeaders(w.Header(), []uploadResult{result})
+	}
+	bucket, key := s3BucketAndKey(upload.Path, route)
+	s3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Location: upload.Path, Bucket: bucket, Key: key, ETag: resp.Header.Get("ETag")})
+}
+
+func s3AbortMultipartUpload(w http.ResponseWriter, cfg *Config, uploadID string) {
+	_, dir, ok := readS3Multipart(cfg, uploadID)
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "unknown upload ID")
+		return
+	}
+	os.RemoveAll(dir)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3BucketAndKey splits a path-style object path below the route's path.
+func s3BucketAndKey(path string, route *Route) (string, string) {
+	if route.PathPrefix != "/" {
+		path = strings.TrimPrefix(path, route.PathPrefix)
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return bucket, key
+}
+
+func s3ObjectName(path string) string {
+	return filepath.Base(path)
+}
+
+func s3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func isImageContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "image/")
+}
+
+func s3XML(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// s3Error answers in the XML error format S3 clients expect.
+func s3Error(w http.ResponseWriter, status int, code, message string) {
+	s3XML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeS3 accepts requests signed with testS3Credentials and remembers the
+// last object written.
+type fakeS3 struct {
+	path, contentType, album, payloadHash string
+	body                                  []byte
+	rejected                              int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verifySigV4(r, testS3Credentials, time.Now()); err != nil {
+		s.rejected++
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if s.payloadHash != "UNSIGNED-PAYLOAD" && s.payloadHash != hexSHA256(body) {
+		s.rejected++
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.Method == "PUT" {
+		s.path, s.contentType, s.album, s.body = r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("X-Amz-Meta-Album"), body
+		w.Header().Set("ETag", s3ETag(body))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func s3Config(t *testing.T, upstream string) *Config {
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream
+	cfg.ListenPath = "/"
+	cfg.S3 = true
+	cfg.S3AccessKeyID = testS3Credentials.AccessKeyID
+	cfg.S3SecretAccessKey = testS3Credentials.SecretAccessKey
+	cfg.S3Dir = t.TempDir()
+	cfg.ImgMaxWidth = 400
+	cfg.ImgMaxHeight = 400
+	return cfg
+}
+
+func s3Request(method, target string, body []byte, payloadHash string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, "http://proxy.local"+target, bytes.NewReader(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	signSigV4(req, testS3Credentials, payloadHash, time.Now())
+	return req
+}
+
+func TestS3PutObject(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+	s3 := &fakeS3{}
+	upstream := httptest.NewServer(s3)
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := s3Config(t, upstream.URL)
+
+	// Streaming uploads arrive aws-chunked and are forwarded decoded.
+	chunked := fmt.Sprintf("%x;chunk-signature=0\r\n%s\r\n0;chunk-signature=0\r\n\r\n", len(pngData), pngData)
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, s3Request("PUT", "/bucket/photos/photo.png", []byte(chunked), "STREAMING-UNSIGNED-PAYLOAD-TRAILER", map[string]string{
+		"Content-Type":                 "image/png",
+		"Content-Encoding":             "aws-chunked",
+		"X-Amz-Decoded-Content-Length": fmt.Sprint(len(pngData)),
+		"X-Amz-Meta-Album":             "holiday",
+	}), cfg)
+	if rec.Code != http.StatusOK || s3.rejected != 0 {
+		t.Fatalf("PutObject: %d, upstream rejected %d request(s)", rec.Code, s3.rejected)
+	}
+	if s3.path != "/bucket/photos/photo.png" || s3.album != "holiday" || s3.contentType != "image/png" {
+		t.Errorf("upstream got path %q, album %q, type %q", s3.path, s3.album, s3.contentType)
+	}
+	if len(s3.body) == 0 || len(s3.body) >= len(pngData) {
+		t.Errorf("Expected a smaller processed object, got %d bytes (original %d)", len(s3.body), len(pngData))
+	}
+
+	// Objects that are not images pass through unchanged.
+	text := []byte("just some text")
+	proxyHandler(httptest.NewRecorder(), s3Request("PUT", "/bucket/notes.txt", text, hexSHA256(text), map[string]string{"Content-Type": "text/plain"}), cfg)
+	if !bytes.Equal(s3.body, text) {
+		t.Errorf("upstream got %q", s3.body)
+	}
+
+	rec = httptest.NewRecorder()
+	forged := s3Request("PUT", "/bucket/notes.txt", text, hexSHA256(text), nil)
+	forged.URL.Path = "/bucket/other.txt"
+	proxyHandler(rec, forged, cfg)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Request with an invalid signature: %d, want 403", rec.Code)
+	}
+}
+
+func TestS3StreamsOtherObjects(t *testing.T) {
+	s3 := &fakeS3{}
+	upstream := httptest.NewServer(s3)
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := s3Config(t, upstream.URL)
+	cfg.BodyMaxSize = 100
+	video := bytes.Repeat([]byte("not an image "), 100)
+
+	// Objects that are not processed are streamed, so BODY_MAX_SIZE does
+	// not apply, and signed with the client's payload hash.
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, s3Request("PUT", "/bucket/video.mp4", video, hexSHA256(video), nil), cfg)
+	if rec.Code != http.StatusOK || !bytes.Equal(s3.body, video) || s3.payloadHash != hexSHA256(video) {
+		t.Errorf("PutObject: %d, upstream got %d bytes with hash %q", rec.Code, len(s3.body), s3.payloadHash)
+	}
+
+	// Decoded streaming uploads have no hash to sign with.
+	chunked := fmt.Sprintf("%x;chunk-signature=0\r\n%s\r\n0;chunk-signature=0\r\n\r\n", len(video), video)
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, s3Request("PUT", "/bucket/video.mp4", []byte(chunked), "STREAMING-UNSIGNED-PAYLOAD-TRAILER", map[string]string{
+		"Content-Encoding":             "aws-chunked",
+		"X-Amz-Decoded-Content-Length": fmt.Sprint(len(video)),
+	}), cfg)
+	if rec.Code != http.StatusOK || !bytes.Equal(s3.body, video) || s3.payloadHash != "UNSIGNED-PAYLOAD" {
+		t.Errorf("Streaming PutObject: %d, upstream got %d bytes with hash %q", rec.Code, len(s3.body), s3.payloadHash)
+	}
+
+	// Images are still read into memory to be processed.
+	image := append([]byte("\x89PNG\r\n\x1a\n"), video...)
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, s3Request("PUT", "/bucket/photo.png", image, hexSHA256(image), nil), cfg)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Image over BODY_MAX_SIZE: %d, want 413", rec.Code)
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+	s3 := &fakeS3{}
+	upstream := httptest.NewServer(s3)
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := s3Config(t, upstream.URL)
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, s3Request("POST", "/bucket/big.png?uploads", nil, hexSHA256(nil), map[string]string{
+		"Content-Type":     "image/png",
+		"X-Amz-Meta-Album": "holiday",
+	}), cfg)
+	var initiate struct{ Bucket, Key, UploadId string }
+	if err := xml.Unmarshal(rec.Body.Bytes(), &initiate); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("CreateMultipartUpload: %d %s", rec.Code, rec.Body.String())
+	}
+	if initiate.Bucket != "bucket" || initiate.Key != "big.png" {
+		t.Errorf("bucket %q, key %q", initiate.Bucket, initiate.Key)
+	}
+
+	half := len(pngData) / 2
+	parts := [][]byte{pngData[:half], pngData[half:]}
+	complete := "<CompleteMultipartUpload>"
+	for i, part := range parts {
+		rec := httptest.NewRecorder()
+		target := fmt.Sprintf("/bucket/big.png?partNumber=%d&uploadId=%s", i+1, initiate.UploadId)
+		proxyHandler(rec, s3Request("PUT", target, part, hexSHA256(part), nil), cfg)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("UploadPart %d: %d %s", i+1, rec.Code, rec.Body.String())
+		}
+		complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, rec.Header().Get("ETag"))
+	}
+	complete += "</CompleteMultipartUpload>"
+	if s3.body != nil {
+		t.Fatal("Parts reached the upstream before the upload was complete")
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, s3Request("POST", "/bucket/big.png?uploadId="+initiate.UploadId, []byte(complete), hexSHA256([]byte(complete)), nil), cfg)
+	var result struct{ Key, ETag string }
+	if err := xml.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("CompleteMultipartUpload: %d %s", rec.Code, rec.Body.String())
+	}
+	if s3.path != "/bucket/big.png" || s3.album != "holiday" || s3.rejected != 0 {
+		t.Errorf("upstream got path %q, album %q, rejected %d", s3.path, s3.album, s3.rejected)
+	}
+	if len(s3.body) == 0 || len(s3.body) >= len(pngData) {
+		t.Errorf("Expected a smaller processed object, got %d bytes (original %d)", len(s3.body), len(pngData))
+	}
+	if result.Key != "big.png" || result.ETag != s3ETag(s3.body) {
+		t.Errorf("result key %q, ETag %q", result.Key, result.ETag)
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, s3Request("DELETE", "/bucket/big.png?uploadId="+initiate.UploadId, nil, hexSHA256(nil), nil), cfg)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Aborting a completed upload: %d, want 404", rec.Code)
+	}
+}
+
+func TestS3MultipartLimits(t *testing.T) {
+	s3 := &fakeS3{}
+	upstream := httptest.NewServer(s3)
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := s3Config(t, upstream.URL)
+	cfg.UploadMaxSize = 10
+
+	create := func() string {
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, s3Request("POST", "/bucket/big.png?uploads", nil, hexSHA256(nil), map[string]string{"Content-Type": "image/png"}), cfg)
+		var initiate struct{ UploadId string }
+		if err := xml.Unmarshal(rec.Body.Bytes(), &initiate); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("CreateMultipartUpload: %d %s", rec.Code, rec.Body.String())
+		}
+		return initiate.UploadId
+	}
+	uploadPart := func(uploadID string, n int, part []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		target := fmt.Sprintf("/bucket/big.png?partNumber=%d&uploadId=%s", n, uploadID)
+		proxyHandler(rec, s3Request("PUT", target, part, hexSHA256(part), nil), cfg)
+		return rec
+	}
+
+	// Parts are counted as they arrive; replacing a part does not count twice.
+	uploadID := create()
+	if rec := uploadPart(uploadID, 1, []byte("123456")); rec.Code != http.StatusOK {
+		t.Fatalf("UploadPart 1: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := uploadPart(uploadID, 1, []byte("abcdef")); rec.Code != http.StatusOK {
+		t.Errorf("Replacing part 1: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := uploadPart(uploadID, 2, []byte("789012")); rec.Code != http.StatusRequestEntityTooLarge || !bytes.Contains(rec.Body.Bytes(), []byte("EntityTooLarge")) {
+		t.Errorf("Part over UPLOAD_MAX_SIZE: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Uploads older than S3_EXPIRY are gone.
+	cfg.S3Expiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if rec := uploadPart(uploadID, 2, []byte("7")); rec.Code != http.StatusNotFound {
+		t.Errorf("UploadPart to an expired upload: %d, want 404", rec.Code)
+	}
+	cfg.S3Expiry = 0
+	stale := create()
+	cfg.S3Expiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	create()
+	if _, err := os.Stat(filepath.Join(cfg.S3Dir, stale)); !os.IsNotExist(err) {
+		t.Errorf("Expired upload %s was not removed on create", stale)
+	}
+}
+
+func TestS3RequiresCredentials(t *testing.T) {
+	clearAllTestEnvVars()
+	defer clearAllTestEnvVars()
+
+	os.Setenv("S3", "1")
+	os.Setenv("S3_ACCESS_KEY_ID", "proxy")
+	if _, problems, _ := loadConfig("", nil); len(problems) != 1 || problems[0] != errS3Credentials {
+		t.Errorf("problems = %v, want missing S3 credentials", problems)
+	}
+	os.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+	if _, problems, _ := loadConfig("", nil); len(problems) != 0 {
+		t.Errorf("problems = %v with both credentials", problems)
+	}
+
+	// A request signed with an empty secret is never accepted.
+	empty := s3Credentials{AccessKeyID: "proxy", Region: "us-east-1"}
+	req := httptest.NewRequest("GET", "http://proxy.local/bucket/photo.png", nil)
+	signSigV4(req, empty, hexSHA256(nil), time.Now())
+	if err := verifySigV4(req, empty, time.Now()); err == nil {
+		t.Error("Request signed with an empty secret was accepted")
+	}
+
+	cfg := s3Config(t, "http://upstream.invalid")
+	cfg.S3SecretAccessKey = ""
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest("GET", "http://proxy.local/bucket/photo.png", nil), cfg)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("S3 request without credentials: %d, want 500", rec.Code)
+	}
+}
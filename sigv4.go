@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+const amzDateFormat = "20060102T150405Z"
+
+// sigV4MaxSkew is how far a client's X-Amz-Date may be from our clock, the
+// same limit S3 uses.
+const sigV4MaxSkew = 15 * time.Minute
+
+// s3Credentials sign upstream requests and verify client requests.
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+}
+
+// signSigV4 signs req for S3 with a payload of the given SHA-256 hash. Host,
+// Content-Type, Content-MD5, Range and all X-Amz-* headers are signed.
+func signSigV4(req *http.Request, creds s3Credentials, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signed := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		switch {
+		case lower == "content-type", lower == "content-md5", lower == "range", strings.HasPrefix(lower, "x-amz-"):
+			signed = append(signed, lower)
+		}
+	}
+	sort.Strings(signed)
+
+	scope := amzDate[:8] + "/" + creds.Region + "/s3/aws4_request"
+	canonical := sigV4CanonicalRequest(req.Method, req.URL, host, req.Header, signed, payloadHash)
+	signature := sigV4Signature(creds.SecretAccessKey, scope, amzDate, canonical)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+// verifySigV4 checks the Authorization header of a client request against
+// our credentials. Only the headers are covered: a hashed payload is checked
+// by the caller, and chunk signatures of streaming uploads are not verified.
+func verifySigV4(r *http.Request, creds s3Credentials, now time.Time) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return errors.New("request is not signed with " + sigV4Algorithm)
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[key] = value
+	}
+
+	scope := strings.Split(fields["Credential"], "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" {
+		return errors.New("malformed credential")
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" || scope[0] != creds.AccessKeyID {
+		return errors.New("unknown access key")
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil || amzDate[:8] != scope[1] {
+		return errors.New("missing or invalid X-Amz-Date")
+	}
+	if skew := now.Sub(signedAt); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return errors.New("request time too skewed")
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return errors.New("missing X-Amz-Content-Sha256")
+	}
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !containsString(signed, "host") {
+		return errors.New("host is not signed")
+	}
+
+	canonical := sigV4CanonicalRequest(r.Method, r.URL, r.Host, r.Header, signed, payloadHash)
+	expected := sigV4Signature(creds.SecretAccessKey, strings.Join(scope[1:], "/"), amzDate, canonical)
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func sigV4CanonicalRequest(method string, u *url.URL, host string, h http.Header, signed []string, payloadHash string) string {
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+
+	var headers strings.Builder
+	for _, name := range signed {
+		value := host
+		if name != "host" {
+			values := append([]string(nil), h.Values(name)...)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	return strings.Join([]string{
+		method,
+		awsEscape(path, false),
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func sigV4Signature(secret, scope, amzDate, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// isAWSChunked reports whether a body uses the aws-chunked encoding that
+// SDKs use for streaming and trailing-checksum uploads.
+func isAWSChunked(h http.Header) bool {
+	return strings.HasPrefix(h.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(h.Get("Content-Encoding"), "aws-chunked")
+}
+
+// decodeAWSChunked returns the payload of an aws-chunked body. Chunk
+// signatures and trailers are dropped.
+func decodeAWSChunked(data []byte) ([]byte, error) {
+	return io.ReadAll(newAWSChunkedReader(bytes.NewReader(data)))
+}
+
+// awsChunkedReader reads the payload of an aws-chunked body as it arrives.
+// Chunk signatures and trailers are dropped.
+type awsChunkedReader struct {
+	r *bufio.Reader
+	// left is what is left of the current chunk.
+	left    int64
+	started bool
+	err     error
+}
+
+func newAWSChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r)}
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.left == 0 {
+		if c.err = c.next(); c.err != nil {
+			return 0, c.err
+		}
+		if c.left == 0 {
+			c.err = io.EOF
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF {
+		err = errors.New("aws-chunked chunk is truncated")
+	}
+	c.err = err
+	return n, err
+}
+
+// next reads the header of the next chunk.
+func (c *awsChunkedReader) next() error {
+	if c.started {
+		if crlf, err := c.r.ReadString('\n'); err != nil || crlf != "\r\n" {
+			return errors.New("aws-chunked chunk is not terminated")
+		}
+	}
+	c.started = true
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return errors.New("aws-chunked body ends without a final chunk")
+	}
+	sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid aws-chunked chunk size %q", sizeHex)
+	}
+	c.left = size
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sync/atomic"
+)
+
+// errSpoolFull is returned when SPOOL_MAX_SIZE would be exceeded.
+var errSpoolFull = errors.New("spool directory is full")
+
+// errFormValuesTooLarge is returned when form values exceed their memory
+// allowance; unlike files they are never spooled.
+var errFormValuesTooLarge = errors.New("multipart form values exceed the memory limit")
+
+// formValueAllowance is the memory form values may use on top of
+// UPLOAD_MEMORY_LIMIT, as in ParseMultipartForm.
+const formValueAllowance = 10 << 20
+
+// spoolUsage is the number of bytes all requests have spooled to disk.
+var spoolUsage atomic.Int64
+
+// spooledFile is an uploaded file kept in memory or in a spool file.
+type spooledFile struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+	data     []byte
+	path     string
+	// parsed is set for forms read by ParseMultipartForm.
+	parsed *multipart.FileHeader
+}
+
+func (f *spooledFile) Open() (io.ReadCloser, error) {
+	if f.parsed != nil {
+		return f.parsed.Open()
+	}
+	if f.path == "" {
+		return io.NopCloser(bytes.NewReader(f.data)), nil
+	}
+	return os.Open(f.path)
+}
+
+// ReadAll returns the file's content. Files kept in memory are returned
+// without a copy.
+func (f *spooledFile) ReadAll() ([]byte, error) {
+	if f.parsed == nil && f.path == "" {
+		return f.data, nil
+	}
+	file, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// spooledForm is a parsed multipart form. RemoveAll must be called once it
+// is no longer needed.
+type spooledForm struct {
+	Value url.Values
+	File  map[string][]*spooledFile
+	// spooled is what this form added to spoolUsage.
+	spooled int64
+	parsed  *multipart.Form
+}
+
+// readSpooledForm parses a multipart request. Values and files are kept in
+// memory up to UPLOAD_MEMORY_LIMIT in total; files that do not fit are
+// written to SPOOL_DIR. If parsing fails, whatever was spooled is removed.
+// Like ParseMultipartForm it fills r.Form and r.PostForm. A request already
+// parsed with ParseMultipartForm is used as it is.
+func readSpooledForm(r *http.Request, cfg *Config) (*spooledForm, error) {
+	if r.MultipartForm != nil {
+		return parsedSpooledForm(r.MultipartForm), nil
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := &spooledForm{Value: url.Values{}, File: map[string][]*spooledFile{}}
+	if err := form.read(reader, cfg); err != nil {
+		form.RemoveAll()
+		return nil, err
+	}
+
+	r.PostForm = form.Value
+	r.Form = url.Values{}
+	for key, values := range form.Value {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	for key, values := range r.URL.Query() {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	return form, nil
+}
+
+func parsedSpooledForm(mf *multipart.Form) *spooledForm {
+	form := &spooledForm{Value: mf.Value, File: map[string][]*spooledFile{}, parsed: mf}
+	for name, headers := range mf.File {
+		for _, fh := range headers {
+			form.File[name] = append(form.File[name], &spooledFile{Filename: fh.Filename, Header: fh.Header, Size: fh.Size, parsed: fh})
+		}
+	}
+	return form
+}
+
+func (form *spooledForm) read(reader *multipart.Reader, cfg *Config) error {
+	memory := cfg.UploadMemoryLimit
+	values := memory + formValueAllowance
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		var buf bytes.Buffer
+		if part.FileName() == "" {
+			n, err := io.CopyN(&buf, part, values+1)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n > values {
+				return errFormValuesTooLarge
+			}
+			values -= n
+			form.Value.Add(name, buf.String())
+			continue
+		}
+
+		// One byte over the file limit is enough to reject it.
+		var src io.Reader = part
+		if cfg.UploadMaxFileSize > 0 {
+			src = io.LimitReader(part, cfg.UploadMaxFileSize+1)
+		}
+		n, err := io.CopyN(&buf, src, memory+1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		file := &spooledFile{Filename: part.FileName(), Header: part.Header}
+		form.File[name] = append(form.File[name], file)
+		if n <= memory {
+			memory -= n
+			file.data, file.Size = buf.Bytes(), n
+		} else if err := form.spool(file, cfg, io.MultiReader(&buf, src)); err != nil {
+			return err
+		}
+		if cfg.UploadMaxFileSize > 0 && file.Size > cfg.UploadMaxFileSize {
+			return errFileTooLarge
+		}
+	}
+}
+
+// spool writes a file that does not fit in memory to SPOOL_DIR.
+func (form *spooledForm) spool(file *spooledFile, cfg *Config, src io.Reader) error {
+	f, err := os.CreateTemp(cfg.SpoolDir, "upload-proxy-*")
+	if err != nil {
+		return err
+	}
+	file.path = f.Name()
+	n, err := io.Copy(&spoolWriter{file: f, form: form, limit: cfg.SpoolMaxSize}, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	file.Size = n
+	return err
+}
+
+// RemoveAll deletes the spool files and releases their share of
+// SPOOL_MAX_SIZE.
+func (form *spooledForm) RemoveAll() {
+	if form.parsed != nil {
+		form.parsed.RemoveAll()
+	}
+	for _, files := range form.File {
+		for _, file := range files {
+			if file.path != "" {
+				os.Remove(file.path)
+				file.path = ""
+			}
+		}
+	}
+	spoolUsage.Add(-form.spooled)
+	form.spooled = 0
+}
+
+// spoolWriter reserves space in spoolUsage before each write.
+type spoolWriter struct {
+	file  *os.File
+	form  *spooledForm
+	limit int64
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if usage := spoolUsage.Add(n); w.limit > 0 && usage > w.limit {
+		spoolUsage.Add(-n)
+		return 0, errSpoolFull
+	}
+	w.form.spooled += n
+	return w.file.Write(p)
+}
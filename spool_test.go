@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func spoolRequest(t *testing.T, data []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("deviceId", "phone")
+	part, _ := writer.CreateFormFile("assetData", "video.mp4")
+	part.Write(data)
+	writer.Close()
+	req := httptest.NewRequest("POST", "/api/assets?album=1", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func assertSpoolEmpty(t *testing.T, dir string) {
+	t.Helper()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d spool file(s) left behind", len(files))
+	}
+	if usage := spoolUsage.Load(); usage != 0 {
+		t.Errorf("spool usage = %d, want 0", usage)
+	}
+}
+
+func TestReadSpooledForm(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SpoolDir = t.TempDir()
+	cfg.UploadMemoryLimit = 100
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	req := spoolRequest(t, data)
+	form, err := readSpooledForm(req, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := form.File["assetData"][0]
+	if file.path == "" || file.Size != int64(len(data)) {
+		t.Errorf("Expected a spooled file of %d bytes, got path %q, size %d", len(data), file.path, file.Size)
+	}
+	if usage := spoolUsage.Load(); usage != int64(len(data)) {
+		t.Errorf("spool usage = %d, want %d", usage, len(data))
+	}
+	f, _ := file.Open()
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(got, data) {
+		t.Error("Spooled file content differs")
+	}
+	if req.Form.Get("deviceId") != "phone" || req.Form.Get("album") != "1" {
+		t.Errorf("r.Form = %v", req.Form)
+	}
+
+	form.RemoveAll()
+	assertSpoolEmpty(t, cfg.SpoolDir)
+
+	cfg.UploadMemoryLimit = 10000
+	form, err = readSpooledForm(spoolRequest(t, data), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.File["assetData"][0].path != "" {
+		t.Error("A file within the memory limit should not be spooled")
+	}
+	form.RemoveAll()
+}
+
+func TestSpoolCleanupOnErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL
+	cfg.SpoolDir = t.TempDir()
+	cfg.UploadMemoryLimit = 100
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, spoolRequest(t, data), cfg)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Spooled upload: %d, want 200", rec.Code)
+	}
+	assertSpoolEmpty(t, cfg.SpoolDir)
+
+	cfg.SpoolMaxSize = 500
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, spoolRequest(t, data), cfg)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("Upload over SPOOL_MAX_SIZE: %d, want 507", rec.Code)
+	}
+	assertSpoolEmpty(t, cfg.SpoolDir)
+
+	cfg.SpoolMaxSize = 0
+	req := spoolRequest(t, data)
+	truncated, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(truncated[:len(truncated)-200]))
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, req, cfg)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Truncated upload: %d, want 400", rec.Code)
+	}
+	assertSpoolEmpty(t, cfg.SpoolDir)
+}
+
+func TestReformatMultipartStreamsSpooledFiles(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SpoolDir = t.TempDir()
+	cfg.UploadMemoryLimit = 100
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	req := spoolRequest(t, data)
+	_, rebuilt, uploads, err := reformatMultipart(httptest.NewRecorder(), req, cfg, cfg.matchRoute(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploads[0].Data != nil || uploads[0].size() != len(data) || uploads[0].Outcome != "not_image" {
+		t.Errorf("Expected the file to be forwarded from the spool, got %d bytes in memory, size %d, outcome %s", len(uploads[0].Data), uploads[0].size(), uploads[0].Outcome)
+	}
+	if !bytes.Contains(readRequestBody(t, rebuilt).Bytes(), data) {
+		t.Error("Rebuilt body does not contain the spooled file")
+	}
+	rebuilt.Close()
+	assertSpoolEmpty(t, cfg.SpoolDir)
+}
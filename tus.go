@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+const tusExtensions = "creation,creation-with-upload,termination,expiration"
+const tusContentType = "application/offset+octet-stream"
+
+// TUS_DELIVERY values: how a completed upload is sent to the upstream.
+const TUS_DELIVERY_MULTIPART = "multipart"
+const TUS_DELIVERY_TUS = "tus"
+
+func parseTusDelivery(v string) (string, error) {
+	delivery := strings.ToLower(strings.TrimSpace(v))
+	if delivery != TUS_DELIVERY_MULTIPART && delivery != TUS_DELIVERY_TUS {
+		return "", fmt.Errorf("must be %s or %s", TUS_DELIVERY_MULTIPART, TUS_DELIVERY_TUS)
+	}
+	return delivery, nil
+}
+
+// tusUpload is the part of an upload kept next to its data file. The
+// offset is the size of the data file.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Created  time.Time         `json:"created"`
+}
+
+// tusActive holds the uploads a request is working on. A second PATCH for
+// the same upload is rejected instead of waiting, so a client resuming after
+// a dropped connection retries once the old request has given up.
+var tusActive = struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+func lockTusUpload(id string) bool {
+	tusActive.mu.Lock()
+	defer tusActive.mu.Unlock()
+	if tusActive.ids[id] {
+		return false
+	}
+	tusActive.ids[id] = true
+	return true
+}
+
+func unlockTusUpload(id string) {
+	tusActive.mu.Lock()
+	defer tusActive.mu.Unlock()
+	delete(tusActive.ids, id)
+}
+
+// isTusRequest reports whether a request belongs to a tus route: its path is
+// the route's path (creation) or below it (one upload).
+func isTusRequest(r *http.Request, route *Route) bool {
+	return route.Tus && hasPathPrefix(r.URL.Path, route.PathPrefix)
+}
+
+// tusHandler implements the tus 1.0.0 core protocol with the creation,
+// termination and expiration extensions. Uploads are assembled in TUS_DIR
+// and delivered to the route's upstream once complete.
+func tusHandler(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route) {
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		r.Method = override
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if cfg.UploadMaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.UploadMaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(route.PathPrefix, "/")), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "OPTIONS, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tusCreate(w, r, cfg, route)
+		return
+	}
+	if !isUploadID(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		tusHead(w, cfg, id)
+	case http.MethodPatch:
+		tusPatch(w, r, cfg, route, id)
+	case http.MethodDelete:
+		tusDelete(w, r, cfg, id)
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if cfg.UploadMaxSize > 0 && length > cfg.UploadMaxSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(cfg.TusDir, 0700); err != nil {
+		log.Println("Cannot create tus directory:", err)
+		http.Error(w, "cannot store upload", http.StatusInternalServerError)
+		return
+	}
+	expireTusUploads(cfg)
+
+	upload := tusUpload{ID: newUploadID(), Length: length, Metadata: metadata, Created: time.Now()}
+	if err := writeTusUpload(cfg.TusDir, upload); err != nil {
+		log.Println("Cannot create tus upload:", err)
+		http.Error(w, "cannot store upload", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created tus upload %s (%d bytes)", upload.ID, length)
+
+	w.Header().Set("Location", strings.TrimSuffix(route.PathPrefix, "/")+"/"+upload.ID)
+	setTusExpires(w.Header(), cfg, upload)
+
+	// creation-with-upload: the first chunk may come with the POST.
+	if r.Header.Get("Content-Type") == tusContentType {
+		r.Header.Set("Upload-Offset", "0")
+		tusPatch(&statusOverride{ResponseWriter: w, status: http.StatusCreated}, r, cfg, route, upload.ID)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// statusOverride replaces the 204 of a successful PATCH with another status,
+// so creation-with-upload can answer 201.
+type statusOverride struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusOverride) WriteHeader(code int) {
+	if code == http.StatusNoContent {
+		code = s.status
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func setTusExpires(h http.Header, cfg *Config, upload tusUpload) {
+	if cfg.TusExpiry > 0 {
+		h.Set("Upload-Expires", upload.Created.Add(cfg.TusExpiry).UTC().Format(http.TimeFormat))
+	}
+}
+
+func tusHead(w http.ResponseWriter, cfg *Config, id string) {
+	upload, offset, err := readTusUpload(cfg.TusDir, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if tusExpired(cfg, upload) {
+		if lockTusUpload(id) {
+			expireTusUpload(cfg, id)
+			unlockTusUpload(id)
+		}
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+	}
+	setTusExpires(w.Header(), cfg, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatch appends a chunk. When the upload is complete it is processed and
+// delivered; if delivery fails the upload is kept and a PATCH with an empty
+// body at the final offset tries again.
+func tusPatch(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route, id string) {
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	profile, err := cfg.requestProfile(r, route)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+	if !lockTusUpload(id) {
+		http.Error(w, "upload is locked by another request", http.StatusLocked)
+		return
+	}
+	defer unlockTusUpload(id)
+
+	upload, offset, err := readTusUpload(cfg.TusDir, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if tusExpired(cfg, upload) {
+		expireTusUpload(cfg, id)
+		http.Error(w, "upload expired", http.StatusGone)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(tusDataPath(cfg.TusDir, id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Println("Cannot open tus upload:", err)
+		http.Error(w, "cannot store upload", http.StatusInternalServerError)
+		return
+	}
+	// What arrived before a dropped connection is kept for resuming.
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	closeErr := f.Close()
+	offset += written
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	setTusExpires(w.Header(), cfg, upload)
+	if copyErr != nil || closeErr != nil {
+		log.Printf("tus upload %s interrupted at %d of %d bytes", id, offset, upload.Length)
+		http.Error(w, "upload interrupted", http.StatusBadRequest)
+		return
+	}
+
+	if offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	log.Printf("tus upload %s complete, delivering", id)
+	status, err := deliverTusUpload(w, r, cfg, route, profile, upload)
+	if err != nil {
+		log.Printf("Delivering tus upload %s failed: %v", id, err)
+		// Clients only resume uploads that are not complete, so the last
+		// byte is dropped again. Resending it retries the delivery.
+		if upload.Length > 0 && os.Truncate(tusDataPath(cfg.TusDir, id), upload.Length-1) == nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Length-1, 10))
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	removeTusUpload(cfg.TusDir, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusDelete(w http.ResponseWriter, r *http.Request, cfg *Config, id string) {
+	if !lockTusUpload(id) {
+		http.Error(w, "upload is locked by another request", http.StatusLocked)
+		return
+	}
+	defer unlockTusUpload(id)
+
+	if _, _, err := readTusUpload(cfg.TusDir, id); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	removeTusUpload(cfg.TusDir, id)
+	log.Printf("Terminated tus upload %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deliverTusUpload processes a completed upload and sends it upstream. The
+// returned status is used for the client response if delivery failed.
+func deliverTusUpload(w http.ResponseWriter, r *http.Request, cfg *Config, route *Route, profile ProcessingProfile, upload tusUpload) (int, error) {
+	data, err := os.ReadFile(tusDataPath(cfg.TusDir, upload.ID))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	filename := upload.Metadata["filename"]
+	if filename == "" {
+		filename = upload.Metadata["name"]
+	}
+	if filename == "" {
+		filename = upload.ID
+	}
+	filename = filepath.Base(filename)
+	mimeType := upload.Metadata["filetype"]
+	if mimeType == "" {
+		mimeType = upload.Metadata["type"]
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	log.Printf("Incoming tus upload: %s (%s)", filename, mimeType)
+	result := processUpload(data, filename, mimeType, profile)
+	recordUpload(result, profile.DryRun)
+	uploads := []uploadResult{result}
+	if profile.DryRun {
+		result = applyDryRun(w, "tus", result, data, filename, mimeType)
+	}
+
+	target, err := route.upstreamURL(&url.URL{Path: route.PathPrefix})
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	header := http.Header{}
+	cfg.RequestHeaders.Apply(header, r.Header)
+	for name := range header {
+		if strings.HasPrefix(name, "Upload-") || strings.HasPrefix(name, "Tus-") || name == "X-Http-Method-Override" {
+			header.Del(name)
+		}
+	}
+	if cfg.ReportHeaders {
+		addReportHeaders(header, uploads)
+	}
+
+	if route.TusDelivery == TUS_DELIVERY_TUS {
+		err = deliverTus(cfg, target, header, upload.Metadata, result)
+	} else {
+		err = deliverMultipart(cfg, target, header, route, upload.Metadata, result)
+	}
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	if cfg.ReportResponseHeaders {
+		addReportHeaders(w.Header(), uploads)
+	}
+	return 0, nil
+}
+
+// deliverMultipart posts the file under the route's first file field. The
+// other metadata entries become form fields.
+func deliverMultipart(cfg *Config, target *url.URL, header http.Header, route *Route, metadata map[string]string, result uploadResult) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, key := range sortedKeys(metadata) {
+		switch key {
+		case "filename", "name", "filetype", "type":
+			continue
+		}
+		writer.WriteField(key, metadata[key])
+	}
+	fw, _ := CreateFormFileWithMime(writer, route.FileUploadFields[0], result.Filename, result.MimeType)
+	fw.Write(result.Data)
+	writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return doDelivery(cfg, req)
+}
+
+// deliverTus creates an upload on an upstream tus server and sends the file
+// in one PATCH, with filename and filetype updated to the processed file.
+func deliverTus(cfg *Config, target *url.URL, header http.Header, metadata map[string]string, result uploadResult) error {
+	forwarded := map[string]string{}
+	for key, value := range metadata {
+		forwarded[key] = value
+	}
+	forwarded["filename"] = result.Filename
+	forwarded["filetype"] = result.MimeType
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.Header.Del("Content-Type")
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(len(result.Data)))
+	req.Header.Set("Upload-Metadata", formatTusMetadata(forwarded))
+	resp, err := sendUpstream(cfg, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upstream tus creation returned %s", resp.Status)
+	}
+	location, err := target.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return errors.New("upstream tus creation returned no usable Location")
+	}
+
+	req, err = http.NewRequest(http.MethodPatch, location.String(), bytes.NewReader(result.Data))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Offset", "0")
+	req.Header.Set("Content-Type", tusContentType)
+	return doDelivery(cfg, req)
+}
+
+// doDelivery sends req and accepts any 2xx status.
+func doDelivery(cfg *Config, req *http.Request) error {
+	resp, err := sendUpstream(cfg, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return nil
+}
+
+// parseTusMetadata decodes "key base64value,key base64value". Values are
+// optional.
+func parseTusMetadata(v string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for _, key := range sortedKeys(metadata) {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newUploadID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isUploadID keeps upload IDs from URLs out of other directories.
+func isUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func tusInfoPath(dir, id string) string { return filepath.Join(dir, id+".info") }
+func tusDataPath(dir, id string) string { return filepath.Join(dir, id+".bin") }
+
+func writeTusUpload(dir string, upload tusUpload) error {
+	info, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(tusDataPath(dir, upload.ID), nil, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(tusInfoPath(dir, upload.ID), info, 0600)
+}
+
+// readTusUpload returns an upload and its current offset.
+func readTusUpload(dir, id string) (tusUpload, int64, error) {
+	var upload tusUpload
+	info, err := os.ReadFile(tusInfoPath(dir, id))
+	if err != nil {
+		return upload, 0, err
+	}
+	if err := json.Unmarshal(info, &upload); err != nil {
+		return upload, 0, err
+	}
+	stat, err := os.Stat(tusDataPath(dir, id))
+	if err != nil {
+		return upload, 0, err
+	}
+	return upload, stat.Size(), nil
+}
+
+func removeTusUpload(dir, id string) {
+	os.Remove(tusInfoPath(dir, id))
+	os.Remove(tusDataPath(dir, id))
+}
+
+// tusExpired reports whether upload is older than TUS_EXPIRY.
+func tusExpired(cfg *Config, upload tusUpload) bool {
+	return cfg.TusExpiry > 0 && time.Since(upload.Created) >= cfg.TusExpiry
+}
+
+// expireTusUpload removes an expired upload. The caller holds its lock.
+func expireTusUpload(cfg *Config, id string) {
+	removeTusUpload(cfg.TusDir, id)
+	log.Printf("Expired tus upload %s", id)
+}
+
+// expireTusUploads removes uploads older than TUS_EXPIRY. It runs whenever
+// an upload is created; HEAD and PATCH requests check the upload they refer
+// to, so an expired upload is never resumed.
+func expireTusUploads(cfg *Config) {
+	if cfg.TusExpiry <= 0 {
+		return
+	}
+	infos, _ := filepath.Glob(filepath.Join(cfg.TusDir, "*.info"))
+	for _, path := range infos {
+		id := strings.TrimSuffix(filepath.Base(path), ".info")
+		upload, _, err := readTusUpload(cfg.TusDir, id)
+		if err != nil || !tusExpired(cfg, upload) {
+			continue
+		}
+		if !lockTusUpload(id) {
+			continue
+		}
+		expireTusUpload(cfg, id)
+		unlockTusUpload(id)
+	}
+}
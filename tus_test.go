@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tusRequest(method, target string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func tusConfig(t *testing.T, upstream string) *Config {
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream
+	cfg.ListenPath = "/files"
+	cfg.Tus = true
+	cfg.TusDir = t.TempDir()
+	cfg.ImgMaxWidth = 400
+	cfg.ImgMaxHeight = 400
+	return cfg
+}
+
+func TestTusUploadDeliveredAsMultipart(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	fileField := defaultConfig().FileUploadField
+	var gotPath, gotFilename, gotAlbum string
+	var gotFile []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		r.ParseMultipartForm(32 << 20)
+		gotAlbum = r.FormValue("album")
+		if file, header, err := r.FormFile(fileField); err == nil {
+			gotFilename = header.Filename
+			gotFile, _ = io.ReadAll(file)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := tusConfig(t, upstream.URL+"/upload")
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest("OPTIONS", "/files", nil), cfg)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Tus-Version") != tusVersion {
+		t.Fatalf("OPTIONS: %d, Tus-Version %q", rec.Code, rec.Header().Get("Tus-Version"))
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("POST", "/files", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(pngData)),
+		"Upload-Metadata": formatTusMetadata(map[string]string{"filename": "photo.png", "filetype": "image/png", "album": "holiday"}),
+	}), cfg)
+	location := rec.Header().Get("Location")
+	if rec.Code != http.StatusCreated || location == "" {
+		t.Fatalf("creation: %d, Location %q", rec.Code, location)
+	}
+
+	half := len(pngData) / 2
+	patch := func(offset int, chunk []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, tusRequest("PATCH", location, chunk, map[string]string{
+			"Content-Type":  tusContentType,
+			"Upload-Offset": strconv.Itoa(offset),
+		}), cfg)
+		return rec
+	}
+
+	if rec := patch(0, pngData[:half]); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first PATCH: %d, Upload-Offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := patch(0, pngData[:half]); rec.Code != http.StatusConflict {
+		t.Errorf("PATCH at a stale offset: %d, want 409", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("HEAD", location, nil, nil), cfg)
+	if rec.Header().Get("Upload-Offset") != strconv.Itoa(half) || rec.Header().Get("Upload-Length") != strconv.Itoa(len(pngData)) {
+		t.Errorf("HEAD: offset %q, length %q", rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+	if gotFile != nil {
+		t.Fatal("Upload delivered before it was complete")
+	}
+
+	if rec := patch(half, pngData[half:]); rec.Code != http.StatusNoContent {
+		t.Fatalf("final PATCH: %d %s", rec.Code, rec.Body.String())
+	}
+	if gotPath != "/upload" || gotFilename != "photo.png" || gotAlbum != "holiday" {
+		t.Errorf("upstream got path %q, filename %q, album %q", gotPath, gotFilename, gotAlbum)
+	}
+	if len(gotFile) == 0 || len(gotFile) >= len(pngData) {
+		t.Errorf("Expected a smaller processed file, got %d bytes (original %d)", len(gotFile), len(pngData))
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("HEAD", location, nil, nil), cfg)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD after delivery: %d, want 404", rec.Code)
+	}
+}
+
+func TestTusUploadDeliveredViaTus(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	var gotMetadata map[string]string
+	var gotLength string
+	var gotBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			gotLength = r.Header.Get("Upload-Length")
+			gotMetadata, _ = parseTusMetadata(r.Header.Get("Upload-Metadata"))
+			w.Header().Set("Location", "/tus/abc")
+			w.WriteHeader(http.StatusCreated)
+		case "PATCH":
+			if r.URL.Path != "/tus/abc" || r.Header.Get("Upload-Offset") != "0" {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			gotBody, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := tusConfig(t, upstream.URL+"/tus")
+	cfg.TusDelivery = TUS_DELIVERY_TUS
+	cfg.ConvertToFormat = "JPEG"
+	cfg.JpegQuality = 30
+
+	// creation-with-upload sends the whole file with the POST.
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("POST", "/files", pngData, map[string]string{
+		"Content-Type":    tusContentType,
+		"Upload-Length":   strconv.Itoa(len(pngData)),
+		"Upload-Metadata": formatTusMetadata(map[string]string{"filename": "photo.png", "filetype": "image/png"}),
+	}), cfg)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Upload-Offset") != strconv.Itoa(len(pngData)) {
+		t.Fatalf("creation-with-upload: %d, Upload-Offset %q: %s", rec.Code, rec.Header().Get("Upload-Offset"), rec.Body.String())
+	}
+	if gotMetadata["filename"] != "photo.JPG" || gotMetadata["filetype"] != JPEG_MIME_TYPE {
+		t.Errorf("upstream metadata = %v", gotMetadata)
+	}
+	if len(gotBody) == 0 || gotLength != strconv.Itoa(len(gotBody)) {
+		t.Errorf("upstream got Upload-Length %q and %d bytes", gotLength, len(gotBody))
+	}
+}
+
+func TestTusDeliveryFailureKeepsUpload(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+	cfg := tusConfig(t, upstream.URL)
+
+	data := []byte("not an image")
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("POST", "/files", nil, map[string]string{"Upload-Length": strconv.Itoa(len(data))}), cfg)
+	location := rec.Header().Get("Location")
+
+	patch := func(offset int, chunk []byte) int {
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, tusRequest("PATCH", location, chunk, map[string]string{
+			"Content-Type":  tusContentType,
+			"Upload-Offset": strconv.Itoa(offset),
+		}), cfg)
+		return rec.Code
+	}
+	if code := patch(0, data); code != http.StatusBadGateway {
+		t.Fatalf("PATCH with a failing upstream: %d, want 502", code)
+	}
+
+	// The upload is not reported complete, so clients resume it.
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("HEAD", location, nil, nil), cfg)
+	if got := rec.Header().Get("Upload-Offset"); got != strconv.Itoa(len(data)-1) {
+		t.Fatalf("Upload-Offset after failed delivery = %q, want %d", got, len(data)-1)
+	}
+
+	status = http.StatusOK
+	if code := patch(len(data)-1, data[len(data)-1:]); code != http.StatusNoContent {
+		t.Errorf("Retrying delivery: %d, want 204", code)
+	}
+	if files, _ := os.ReadDir(cfg.TusDir); len(files) != 0 {
+		t.Errorf("Delivered upload left %d files behind", len(files))
+	}
+}
+
+func TestTusTerminationAndValidation(t *testing.T) {
+	cfg := tusConfig(t, "http://upstream.invalid")
+
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, httptest.NewRequest("POST", "/files", nil), cfg)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Missing Tus-Resumable: %d, want 412", rec.Code)
+	}
+
+	cfg.UploadMaxSize = 10
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("POST", "/files", nil, map[string]string{"Upload-Length": "11"}), cfg)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversize upload: %d, want 413", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("POST", "/files", nil, map[string]string{"Upload-Length": "5"}), cfg)
+	location := rec.Header().Get("Location")
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("PATCH", location, []byte("abc"), map[string]string{"Upload-Offset": "0"}), cfg)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH without offset content type: %d, want 415", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("DELETE", location, nil, nil), cfg)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE: %d, want 204", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("HEAD", location, nil, nil), cfg)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD after termination: %d, want 404", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("HEAD", "/files/../../etc/passwd", nil, nil), cfg)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD with an invalid ID: %d, want 404", rec.Code)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	cfg := tusConfig(t, "http://upstream.invalid")
+	create := func() string {
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, tusRequest("POST", "/files", nil, map[string]string{"Upload-Length": "5"}), cfg)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST: %d", rec.Code)
+		}
+		return rec.Header().Get("Location")
+	}
+	patch := map[string]string{"Upload-Offset": "0", "Content-Type": tusContentType}
+
+	// Expiry is checked on every request for the upload, not only when
+	// another upload is created.
+	headed, patched := create(), create()
+	cfg.TusExpiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("HEAD", headed, nil, nil), cfg)
+	if rec.Code != http.StatusGone {
+		t.Errorf("HEAD of an expired upload: %d, want 410", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	proxyHandler(rec, tusRequest("PATCH", patched, []byte("abc"), patch), cfg)
+	if rec.Code != http.StatusGone {
+		t.Errorf("PATCH of an expired upload: %d, want 410", rec.Code)
+	}
+	for _, location := range []string{headed, patched} {
+		rec = httptest.NewRecorder()
+		proxyHandler(rec, tusRequest("HEAD", location, nil, nil), cfg)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("HEAD after expiry: %d, want the upload removed", rec.Code)
+		}
+	}
+}
+
+func TestTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["filename"] != "world_domination_plan.pdf" {
+		t.Errorf("filename = %q", metadata["filename"])
+	}
+	if value, ok := metadata["is_confidential"]; !ok || value != "" {
+		t.Errorf("is_confidential = %q, %v", value, ok)
+	}
+	if _, err := parseTusMetadata("filename !!!"); err == nil {
+		t.Error("Expected an error for invalid base64")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// dryRunHeader is added to the response once per file in dry-run mode.
+const dryRunHeader = "X-Upload-Proxy-Dry-Run"
+
+// uploadResult describes one file after processing. Outcome is one of
+// "converted", "resized", "unchanged" or "not_image".
+type uploadResult struct {
+	Filename           string
+	MimeType           string
+	Data               []byte
+	OriginalMimeType   string
+	OriginalSize       int
+	OriginalDimensions ImageSize
+	Dimensions         ImageSize
+	Outcome            string
+	SkipReason         string
+	// source is set instead of Data for files forwarded straight from the
+	// upload, which are never read into memory.
+	source *spooledFile
+}
+
+// processUpload runs a single uploaded file through the image pipeline and
+// returns the filename, MIME type and bytes that should be forwarded.
+func processUpload(data []byte, filename, mimeType string, profile ProcessingProfile) uploadResult {
+	upload := uploadResult{OriginalMimeType: mimeType, OriginalSize: len(data)}
+	result, err := processImageWithStrategy(data, profile.ImageProcessingSettings)
+
+	var wasImageProcessed bool
+	var actuallyCompressed bool
+	var wasResized bool
+
+	if err == nil {
+		wasImageProcessed = true
+		actuallyCompressed = result.WasCompressed
+		wasResized = result.WasResized
+		data = result.ProcessedData
+		upload.OriginalDimensions = result.OriginalDimensions
+		upload.Dimensions = result.NewDimensions
+		upload.SkipReason = result.SkipReason
+		if result.SkipReason == SKIP_REASON_LARGER_OUTPUT {
+			upload.Dimensions = result.OriginalDimensions
+		}
+	} else {
+		log.Printf("Image processing error: %v", err)
+		upload.SkipReason = SKIP_REASON_PROCESSING_ERROR
+		wasImageProcessed = false
+		actuallyCompressed = false
+		wasResized = false
+	}
+
+	var finalFilename string
+	var finalMimeType string
+
+	convertFormat := profile.ConvertToFormat
+
+	if wasImageProcessed && actuallyCompressed {
+		upload.Outcome = "converted"
+		switch convertFormat {
+		case "JPEG":
+			finalMimeType = JPEG_MIME_TYPE
+			if profile.NormalizeExt {
+				finalFilename = changeExtensionToJPG(filename)
+				log.Printf("Converted to JPEG with normalized filename: %s -> %s", filename, finalFilename)
+			} else {
+				finalFilename = filename
+				log.Printf("Converted to JPEG but keeping original filename: %s", finalFilename)
+			}
+		case "WEBP":
+			finalMimeType = WEBP_MIME_TYPE
+			if profile.NormalizeExt {
+				finalFilename = changeExtensionToWebP(filename)
+				log.Printf("Converted to WebP with normalized filename: %s -> %s", filename, finalFilename)
+			} else {
+				finalFilename = filename
+				log.Printf("Converted to WebP but keeping original filename: %s", finalFilename)
+			}
+		default:
+			// Fallback (shouldn't happen)
+			finalMimeType = JPEG_MIME_TYPE
+			finalFilename = filename
+			log.Printf("Unknown convert format, defaulting to JPEG MIME: %s", finalFilename)
+		}
+	} else if wasImageProcessed && !actuallyCompressed {
+		upload.Outcome = "unchanged"
+		finalFilename = filename
+		finalMimeType = mimeType
+		if finalMimeType == "" {
+			finalMimeType = DEFAULT_MIME_TYPE
+		}
+		if convertFormat == "" {
+			if wasResized {
+				upload.Outcome = "resized"
+				log.Printf("Image resized but format conversion disabled: %s (%s)", finalFilename, finalMimeType)
+			} else {
+				log.Printf("Image processed but no changes needed: %s (%s)", finalFilename, finalMimeType)
+			}
+		} else {
+			log.Printf("Image processed but original kept (better compression): %s (%s)", finalFilename, finalMimeType)
+		}
+	} else {
+		upload.Outcome = "not_image"
+		finalFilename = filename
+		finalMimeType = mimeType
+		if finalMimeType == "" {
+			finalMimeType = DEFAULT_MIME_TYPE
+		}
+		log.Printf("Non-image file or processing failed, keeping original: %s (%s)", finalFilename, finalMimeType)
+	}
+
+	upload.Filename = finalFilename
+	upload.MimeType = finalMimeType
+	upload.Data = data
+	return upload
+}
+
+// passThrough describes a file that is not an image and is forwarded from
+// source as it is.
+func passThrough(source *spooledFile, mimeType string) uploadResult {
+	upload := uploadResult{
+		Filename:         source.Filename,
+		MimeType:         mimeType,
+		OriginalMimeType: mimeType,
+		OriginalSize:     int(source.Size),
+		Outcome:          "not_image",
+		SkipReason:       SKIP_REASON_PROCESSING_ERROR,
+		source:           source,
+	}
+	if upload.MimeType == "" {
+		upload.MimeType = DEFAULT_MIME_TYPE
+	}
+	log.Printf("Non-image file, forwarding original: %s (%s)", upload.Filename, upload.MimeType)
+	return upload
+}
+
+// size is the size of the forwarded file.
+func (u uploadResult) size() int {
+	if u.source != nil {
+		return int(u.source.Size)
+	}
+	return len(u.Data)
+}
+
+// digest returns the hex digest of the forwarded file.
+func (u uploadResult) digest(h hash.Hash) string {
+	if u.source == nil {
+		h.Write(u.Data)
+	} else if f, err := u.source.Open(); err == nil {
+		io.Copy(h, f)
+		f.Close()
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// summary describes what processing did, or would have done in dry-run mode,
+// e.g. "outcome=converted; size=5120->2048; dimensions=1920x1080; type=image/png->image/jpeg".
+func (u uploadResult) summary() string {
+	parts := []string{
+		"outcome=" + u.Outcome,
+		fmt.Sprintf("size=%d->%d", u.OriginalSize, u.size()),
+	}
+	if u.Dimensions.Width > 0 && u.Dimensions.Height > 0 {
+		parts = append(parts, fmt.Sprintf("dimensions=%dx%d", u.Dimensions.Width, u.Dimensions.Height))
+	}
+	if u.OriginalMimeType != "" && u.OriginalMimeType != u.MimeType {
+		parts = append(parts, "type="+u.OriginalMimeType+"->"+u.MimeType)
+	} else {
+		parts = append(parts, "type="+u.MimeType)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// applyDryRun reports what processing would have done on w and returns the
+// upload with the original file restored, so it is forwarded untouched. The
+// result describes the forwarded file, so report headers do not claim a
+// conversion that did not happen.
+func applyDryRun(w http.ResponseWriter, label string, upload uploadResult, data []byte, filename, mimeType string) uploadResult {
+	log.Printf("Dry run, forwarding original %s: %s", filename, upload.summary())
+	w.Header().Add(dryRunHeader, label+": "+upload.summary())
+	if upload.Outcome != "not_image" && upload.Outcome != "unchanged" {
+		upload.Outcome = "unchanged"
+		upload.SkipReason = SKIP_REASON_DRY_RUN
+	}
+	upload.Filename = filename
+	upload.MimeType = mimeType
+	if upload.MimeType == "" {
+		upload.MimeType = DEFAULT_MIME_TYPE
+	}
+	if upload.source == nil {
+		upload.Data = data
+	}
+	upload.Dimensions = upload.OriginalDimensions
+	return upload
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReformatMultipartDryRun(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("assetData", "photo.png")
+	part.Write(pngData)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/assets", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	cfg := &Config{
+		FileUploadField: "assetData",
+		ListenPath:      "/api/assets",
+		ImgMaxWidth:     200,
+		ImgMaxHeight:    200,
+		UploadMaxSize:   32 << 20,
+		DryRun:          true,
+	}
+	before := uploadFiles.Value("resized", "true")
+
+	recorder := httptest.NewRecorder()
+	contentType, rebuilt, _, err := reformatMultipart(recorder, req, cfg, cfg.matchRoute(req))
+	if err != nil {
+		t.Fatalf("reformatMultipart failed: %v", err)
+	}
+	resultBody := readRequestBody(t, rebuilt)
+
+	result := httptest.NewRequest("POST", "/", resultBody)
+	result.Header.Set("Content-Type", contentType)
+	if err := result.ParseMultipartForm(32 << 20); err != nil {
+		t.Fatalf("Failed to parse result: %v", err)
+	}
+	fh := result.MultipartForm.File["assetData"][0]
+	f, _ := fh.Open()
+	forwarded, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(forwarded, pngData) {
+		t.Error("Dry run should forward the original bytes")
+	}
+	if fh.Filename != "photo.png" {
+		t.Errorf("Filename = %q, want photo.png", fh.Filename)
+	}
+
+	report := recorder.Header().Get(dryRunHeader)
+	for _, want := range []string{"assetData: outcome=resized", "dimensions=200x150"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("%s = %q, missing %q", dryRunHeader, report, want)
+		}
+	}
+	if got := uploadFiles.Value("resized", "true"); got != before+1 {
+		t.Errorf("dry-run resized counter = %v, want %v", got, before+1)
+	}
+}
+
+func TestUploadResultSummary(t *testing.T) {
+	u := uploadResult{
+		MimeType:         JPEG_MIME_TYPE,
+		Data:             make([]byte, 10),
+		OriginalMimeType: "image/png",
+		OriginalSize:     40,
+		Dimensions:       ImageSize{Width: 4, Height: 3},
+		Outcome:          "converted",
+	}
+	want := "outcome=converted; size=40->10; dimensions=4x3; type=image/png->image/jpeg"
+	if got := u.summary(); got != want {
+		t.Errorf("summary() = %q, want %q", got, want)
+	}
+
+	u = uploadResult{MimeType: "text/plain", Data: []byte("hi"), OriginalMimeType: "text/plain", OriginalSize: 2, Outcome: "not_image"}
+	if got := u.summary(); got != "outcome=not_image; size=2->2; type=text/plain" {
+		t.Errorf("summary() = %q", got)
+	}
+}
+
+func TestProcessUploadReportsDimensionsAndSkipReason(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	resized := processUpload(pngData, "photo.png", "image/png", ProcessingProfile{
+		ImageProcessingSettings: ImageProcessingSettings{MaxWidth: 400, MaxHeight: 400},
+	})
+	if resized.OriginalDimensions != (ImageSize{Width: 1600, Height: 1200}) {
+		t.Errorf("OriginalDimensions = %+v", resized.OriginalDimensions)
+	}
+	if resized.Dimensions != (ImageSize{Width: 400, Height: 300}) || resized.SkipReason != "" {
+		t.Errorf("Dimensions = %+v, SkipReason = %q", resized.Dimensions, resized.SkipReason)
+	}
+
+	kept := processUpload(pngData, "photo.png", "image/png", ProcessingProfile{
+		ImageProcessingSettings: ImageProcessingSettings{MaxWidth: 4000, MaxHeight: 4000},
+	})
+	if kept.SkipReason != SKIP_REASON_WITHIN_LIMITS || kept.Outcome != "unchanged" {
+		t.Errorf("SkipReason = %q, Outcome = %q", kept.SkipReason, kept.Outcome)
+	}
+
+	text := processUpload([]byte("hello"), "notes.txt", "text/plain", ProcessingProfile{})
+	if text.SkipReason != SKIP_REASON_PROCESSING_ERROR || text.Outcome != "not_image" {
+		t.Errorf("SkipReason = %q, Outcome = %q", text.SkipReason, text.Outcome)
+	}
+}
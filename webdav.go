@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// isWebDAVImagePut reports whether a WebDAV PUT carries an image. Sync
+// clients often send application/octet-stream, so the body is sniffed when
+// the Content-Type does not say.
+func isWebDAVImagePut(r *http.Request, body []byte) (string, bool) {
+	if r.Method != http.MethodPut {
+		return "", false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == DEFAULT_MIME_TYPE {
+		mediaType = http.DetectContentType(body)
+	}
+	return mediaType, strings.HasPrefix(mediaType, "image/")
+}
+
+// webdavSize is what a client uploaded to a path and what the upstream
+// stored after processing.
+type webdavSize struct {
+	original  int
+	processed int
+}
+
+// webdavSizeCache remembers the sizes of processed uploads by upstream URL,
+// so PROPFIND responses can report the size the client uploaded. Clients
+// that verify uploads would otherwise upload the same file again and again.
+// Only the limit most recently used entries are kept; the worst case for a
+// forgotten one is one re-upload.
+type webdavSizeCache struct {
+	mu    sync.Mutex
+	sizes map[string]*list.Element
+	// order holds webdavSizeEntry values, most recently used first.
+	order *list.List
+	limit int
+}
+
+type webdavSizeEntry struct {
+	key  string
+	size webdavSize
+}
+
+var webdavSizes = newWebdavSizeCache(100000)
+
+func newWebdavSizeCache(limit int) *webdavSizeCache {
+	return &webdavSizeCache{sizes: map[string]*list.Element{}, order: list.New(), limit: limit}
+}
+
+// webdavSizeKey identifies a file by the upstream's origin and its path
+// there, so routes to different upstreams do not share sizes.
+func webdavSizeKey(upstream *url.URL, path string) string {
+	return upstream.Scheme + "://" + upstream.Host + path
+}
+
+func (c *webdavSizeCache) set(key string, size webdavSize) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.sizes[key]; ok {
+		e.Value = webdavSizeEntry{key: key, size: size}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.sizes[key] = c.order.PushFront(webdavSizeEntry{key: key, size: size})
+	if c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.sizes, oldest.Value.(webdavSizeEntry).key)
+	}
+}
+
+func (c *webdavSizeCache) get(key string) (webdavSize, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.sizes[key]
+	if !ok {
+		return webdavSize{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(webdavSizeEntry).size, true
+}
+
+func (c *webdavSizeCache) remove(key string) (webdavSize, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.sizes[key]
+	if !ok {
+		return webdavSize{}, false
+	}
+	c.order.Remove(e)
+	delete(c.sizes, key)
+	return e.Value.(webdavSizeEntry).size, true
+}
+
+// rewriteDestination points the Destination header of MOVE and COPY
+// requests at the upstream, using the route's path rules.
+func rewriteDestination(h http.Header, route *Route) error {
+	dest := h.Get("Destination")
+	if dest == "" {
+		return nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+	target, err := route.upstreamURL(&url.URL{Path: u.Path, RawPath: u.RawPath})
+	if err != nil {
+		return err
+	}
+	h.Set("Destination", target.String())
+	return nil
+}
+
+// webdavAfterResponse keeps the size cache in sync with successful requests
+// and returns the response body, with sizes rewritten for PROPFIND and HEAD.
+// A GET returns the processed file, so its Content-Length is left alone.
+func webdavAfterResponse(r *http.Request, route *Route, target *url.URL, destination string, uploads []uploadResult, resp *http.Response) io.Reader {
+	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+	key := webdavSizeKey(target, target.Path)
+	switch {
+	case success && r.Method == http.MethodPut && len(uploads) == 1:
+		if upload := uploads[0]; upload.OriginalSize != upload.size() {
+			webdavSizes.set(key, webdavSize{original: upload.OriginalSize, processed: upload.size()})
+		} else {
+			webdavSizes.remove(key)
+		}
+	case success && r.Method == http.MethodDelete:
+		webdavSizes.remove(key)
+	case success && (r.Method == "MOVE" || r.Method == "COPY"):
+		dest, err := url.Parse(destination)
+		if err != nil {
+			break
+		}
+		var size webdavSize
+		var ok bool
+		if r.Method == "MOVE" {
+			size, ok = webdavSizes.remove(key)
+		} else {
+			size, ok = webdavSizes.get(key)
+		}
+		if ok {
+			webdavSizes.set(webdavSizeKey(dest, dest.Path), size)
+		}
+	case success && r.Method == http.MethodHead:
+		if size, ok := webdavSizes.get(key); ok && resp.Header.Get("Content-Length") == strconv.Itoa(size.processed) {
+			resp.Header.Set("Content-Length", strconv.Itoa(size.original))
+		}
+	case r.Method == "PROPFIND" && resp.StatusCode == http.StatusMultiStatus:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Println("Failed to read PROPFIND response:", err)
+			return bytes.NewReader(body)
+		}
+		body = rewritePropfindSizes(body, route, target)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return bytes.NewReader(body)
+	}
+	return resp.Body
+}
+
+var (
+	davResponsePattern      = regexp.MustCompile(`(?s)<([A-Za-z0-9]+:)?response[\s>].*?</([A-Za-z0-9]+:)?response>`)
+	davHrefPattern          = regexp.MustCompile(`(?s)<([A-Za-z0-9]+:)?href>(.*?)</([A-Za-z0-9]+:)?href>`)
+	davContentLengthPattern = regexp.MustCompile(`(<([A-Za-z0-9]+:)?getcontentlength(?:\s[^>]*)?>)\s*(\d+)\s*(</([A-Za-z0-9]+:)?getcontentlength>)`)
+)
+
+// rewritePropfindSizes replaces getcontentlength of processed files with the
+// size the client uploaded, as long as the upstream still has the processed
+// file. Sizes are remembered by upstream path, on the upstream the PROPFIND
+// was sent to. Most servers answer with hrefs in that form, but some know
+// the path clients use and answer with that, so hrefs that are not found
+// are mapped through the route's path rules.
+func rewritePropfindSizes(body []byte, route *Route, upstream *url.URL) []byte {
+	return davResponsePattern.ReplaceAllFunc(body, func(response []byte) []byte {
+		href := davHrefPattern.FindSubmatch(response)
+		if href == nil {
+			return response
+		}
+		u, err := url.Parse(strings.TrimSpace(string(href[2])))
+		if err != nil {
+			return response
+		}
+		size, ok := webdavSizes.get(webdavSizeKey(upstream, u.Path))
+		if !ok {
+			target, err := route.upstreamURL(&url.URL{Path: u.Path, RawPath: u.RawPath})
+			if err != nil {
+				return response
+			}
+			if size, ok = webdavSizes.get(webdavSizeKey(upstream, target.Path)); !ok {
+				return response
+			}
+		}
+		return davContentLengthPattern.ReplaceAllFunc(response, func(element []byte) []byte {
+			m := davContentLengthPattern.FindSubmatch(element)
+			if string(m[3]) != strconv.Itoa(size.processed) {
+				return element
+			}
+			return []byte(string(m[1]) + strconv.Itoa(size.original) + string(m[4]))
+		})
+	})
+}
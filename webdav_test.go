@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDAV is a minimal WebDAV upstream that stores files in memory.
+type fakeDAV struct {
+	mu              sync.Mutex
+	files           map[string][]byte
+	lastDestination string
+	// href maps a stored path to the href PROPFIND reports, if set.
+	href func(path string) string
+}
+
+func (d *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		d.files[r.URL.Path], _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case "MOVE":
+		d.lastDestination = r.Header.Get("Destination")
+		dest := strings.TrimPrefix(d.lastDestination, "http://"+r.Host)
+		d.files[dest] = d.files[r.URL.Path]
+		delete(d.files, r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead:
+		data, ok := d.files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:">`)
+		for path, data := range d.files {
+			if d.href != nil {
+				path = d.href(path)
+			}
+			fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:getcontentlength>%d</d:getcontentlength></d:prop></d:propstat></d:response>`, path, len(data))
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestProxyHandlerWebDAV(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	dav := &fakeDAV{files: map[string][]byte{}}
+	upstream := httptest.NewServer(dav)
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL
+	cfg.ListenPath = "/dav"
+	cfg.StripPathPrefix = "/dav"
+	cfg.ImgMaxWidth = 400
+	cfg.ImgMaxHeight = 400
+	cfg.WebDAV = true
+
+	do := func(method, path string, body []byte, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://proxy"+path, bytes.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		recorder := httptest.NewRecorder()
+		proxyHandler(recorder, req, cfg)
+		return recorder
+	}
+
+	// Sync clients often send images as application/octet-stream.
+	resp := do("PUT", "/dav/photos/a.png", pngData, http.Header{"Content-Type": {DEFAULT_MIME_TYPE}})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("PUT status = %d", resp.Code)
+	}
+	stored := dav.files["/photos/a.png"]
+	if len(stored) == 0 || len(stored) >= len(pngData) {
+		t.Fatalf("Expected the upstream to store a smaller image, got %d bytes", len(stored))
+	}
+
+	resp = do("MOVE", "/dav/photos/a.png", nil, http.Header{"Destination": {"http://proxy/dav/photos/b.png"}})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("MOVE status = %d", resp.Code)
+	}
+	if dav.lastDestination != upstream.URL+"/photos/b.png" {
+		t.Errorf("Destination = %q, want it rewritten to the upstream", dav.lastDestination)
+	}
+
+	dav.files["/photos/other.txt"] = []byte("hello")
+	resp = do("PROPFIND", "/dav/photos/", nil, http.Header{"Depth": {"1"}})
+	body := resp.Body.String()
+	if resp.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND status = %d", resp.Code)
+	}
+	if !strings.Contains(body, fmt.Sprintf("<d:href>/photos/b.png</d:href><d:propstat><d:prop><d:getcontentlength>%d<", len(pngData))) {
+		t.Errorf("PROPFIND should report the uploaded size for the moved file, got %s", body)
+	}
+	if !strings.Contains(body, "<d:getcontentlength>5<") {
+		t.Errorf("Sizes of unprocessed files should be left alone, got %s", body)
+	}
+	if resp.Header().Get("Content-Length") != fmt.Sprint(len(body)) {
+		t.Errorf("Content-Length = %q, body has %d bytes", resp.Header().Get("Content-Length"), len(body))
+	}
+}
+
+func TestProxyHandlerWebDAVPrefixedRoute(t *testing.T) {
+	pngData, err := createTestPNG(1600, 1200)
+	if err != nil {
+		t.Skipf("Cannot create test image: %v", err)
+	}
+
+	// This upstream lives below /remote.php/webdav but answers PROPFIND with
+	// the paths the client uses.
+	dav := &fakeDAV{files: map[string][]byte{}, href: func(path string) string {
+		return "/dav" + strings.TrimPrefix(path, "/remote.php/webdav")
+	}}
+	upstream := httptest.NewServer(dav)
+	defer upstream.Close()
+	useClient(t, upstream.Client())
+
+	cfg := defaultConfig()
+	cfg.ForwardDestination = upstream.URL + "/remote.php/webdav"
+	cfg.ListenPath = "/dav"
+	cfg.StripPathPrefix = "/dav"
+	cfg.ImgMaxWidth = 400
+	cfg.ImgMaxHeight = 400
+	cfg.WebDAV = true
+
+	do := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://proxy"+path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "image/png")
+		recorder := httptest.NewRecorder()
+		proxyHandler(recorder, req, cfg)
+		return recorder
+	}
+
+	if resp := do("PUT", "/dav/photos/a.png", pngData); resp.Code != http.StatusCreated {
+		t.Fatalf("PUT status = %d", resp.Code)
+	}
+	if stored := dav.files["/remote.php/webdav/photos/a.png"]; len(stored) == 0 || len(stored) >= len(pngData) {
+		t.Fatalf("Expected the upstream to store a smaller image, got %d bytes", len(stored))
+	}
+
+	resp := do("PROPFIND", "/dav/photos/", nil)
+	if want := fmt.Sprintf("<d:href>/dav/photos/a.png</d:href><d:propstat><d:prop><d:getcontentlength>%d<", len(pngData)); !strings.Contains(resp.Body.String(), want) {
+		t.Errorf("PROPFIND should report the uploaded size, got %s", resp.Body.String())
+	}
+
+	resp = do("HEAD", "/dav/photos/a.png", nil)
+	if got := resp.Header().Get("Content-Length"); got != fmt.Sprint(len(pngData)) {
+		t.Errorf("HEAD Content-Length = %s, want the uploaded size %d", got, len(pngData))
+	}
+}
+
+func TestWebDAVSizeCache(t *testing.T) {
+	cache := newWebdavSizeCache(2)
+	photos, _ := url.Parse("http://photos.internal/dav")
+	docs, _ := url.Parse("http://docs.internal/dav")
+	cache.set(webdavSizeKey(photos, "/a.jpg"), webdavSize{original: 100, processed: 10})
+	if _, ok := cache.get(webdavSizeKey(docs, "/a.jpg")); ok {
+		t.Error("Sizes are shared between upstreams")
+	}
+
+	// The least recently used entry is forgotten first.
+	cache.set(webdavSizeKey(photos, "/b.jpg"), webdavSize{original: 200, processed: 20})
+	cache.get(webdavSizeKey(photos, "/a.jpg"))
+	cache.set(webdavSizeKey(photos, "/c.jpg"), webdavSize{original: 300, processed: 30})
+	if _, ok := cache.get(webdavSizeKey(photos, "/b.jpg")); ok {
+		t.Error("Least recently used entry was kept")
+	}
+	if size, ok := cache.get(webdavSizeKey(photos, "/a.jpg")); !ok || size.original != 100 {
+		t.Errorf("Recently used entry = %+v, %v", size, ok)
+	}
+}